@@ -0,0 +1,299 @@
+// Copyright © 2015-2023 Brett Vickers.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ntp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// RestrictFlag is a set of restrictions applied by a Server to packets
+// received from a network. The flags correspond to those of ntpd's
+// "restrict" directive.
+type RestrictFlag uint
+
+const (
+	// RestrictIgnore causes all packets to be ignored silently, even with
+	// RestrictKoD.
+	RestrictIgnore RestrictFlag = 1 << iota
+
+	// RestrictNoQuery causes control (mode 6 and 7) queries to be ignored.
+	// Time queries are unaffected.
+	RestrictNoQuery
+
+	// RestrictNoModify causes control queries that attempt to modify the
+	// server's state to be ignored.
+	RestrictNoModify
+
+	// RestrictNoServe causes time queries to be ignored. With RestrictKoD,
+	// a DENY kiss-of-death packet is sent instead.
+	RestrictNoServe
+
+	// RestrictNoTrust causes time queries not authenticated by a trusted key
+	// to be ignored.
+	RestrictNoTrust
+
+	// RestrictLimited applies the server's rate limiter. When a Server has
+	// an AccessList, only networks with this flag are rate limited.
+	RestrictLimited
+
+	// RestrictKoD causes a kiss-of-death packet to be sent in place of a
+	// query dropped by RestrictLimited or RestrictNoServe.
+	RestrictKoD
+)
+
+var restrictFlagNames = []struct {
+	flag RestrictFlag
+	name string
+}{
+	{RestrictIgnore, "ignore"},
+	{RestrictNoQuery, "noquery"},
+	{RestrictNoModify, "nomodify"},
+	{RestrictNoServe, "noserve"},
+	{RestrictNoTrust, "notrust"},
+	{RestrictLimited, "limited"},
+	{RestrictKoD, "kod"},
+}
+
+// restrictIgnored lists ntpd restrict flags that have no meaning for this
+// package's server. They are accepted and ignored when parsing.
+var restrictIgnored = map[string]bool{
+	"nopeer":      true,
+	"noepeer":     true,
+	"notrap":      true,
+	"nomrulist":   true,
+	"ntpport":     true,
+	"version":     true,
+	"lowpriotrap": true,
+}
+
+// String returns the restrict flag names, separated by spaces.
+func (f RestrictFlag) String() string {
+	var names []string
+	for _, n := range restrictFlagNames {
+		if f&n.flag != 0 {
+			names = append(names, n.name)
+		}
+	}
+	return strings.Join(names, " ")
+}
+
+// An AccessRule applies restrictions to packets received from a network.
+type AccessRule struct {
+	// Network is the network to which the rule applies. A nil network
+	// applies to all addresses.
+	Network *net.IPNet
+
+	// Flags holds the restrictions applied to the network.
+	Flags RestrictFlag
+}
+
+// An AccessList is a set of access rules, evaluated by a Server for each
+// packet it receives. The flags of the most specific rule matching the
+// packet's source address are applied, as in ntpd. Addresses matching no
+// rule are unrestricted. A network is allowed by a rule without the
+// RestrictIgnore flag and denied by a rule with it. An AccessList is safe
+// for concurrent use.
+type AccessList struct {
+	mu    sync.RWMutex
+	rules []AccessRule
+}
+
+// NewAccessList returns an access list containing the requested rules.
+func NewAccessList(rules ...AccessRule) *AccessList {
+	a := &AccessList{}
+	for _, r := range rules {
+		a.addRule(r)
+	}
+	return a
+}
+
+// ParseAccessList parses ntpd "restrict" directives, one per line, and
+// returns an access list containing them. Other directives, blank lines and
+// comments are ignored, so an ntp.conf file may be parsed directly. Each
+// directive has one of the forms:
+//
+//	restrict default [flag ...]
+//	restrict [-4|-6] address [mask mask] [flag ...]
+//	restrict address/prefix [flag ...]
+func ParseAccessList(r io.Reader) (*AccessList, error) {
+	a := &AccessList{}
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := s.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 || fields[0] != "restrict" {
+			continue
+		}
+
+		rules, err := parseRestrict(fields[1:])
+		if err != nil {
+			return nil, fmt.Errorf("%w: line %d: %v", ErrInvalidRestriction, n, err)
+		}
+		for _, r := range rules {
+			a.addRule(r)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func parseRestrict(fields []string) ([]AccessRule, error) {
+	family := ""
+	if len(fields) > 0 && (fields[0] == "-4" || fields[0] == "-6") {
+		family, fields = fields[0], fields[1:]
+	}
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("missing address")
+	}
+
+	var networks []*net.IPNet
+	addr := fields[0]
+	fields = fields[1:]
+	switch {
+	case addr == "default":
+		if family != "-6" {
+			networks = append(networks, &net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)})
+		}
+		if family != "-4" {
+			networks = append(networks, &net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)})
+		}
+	case strings.Contains(addr, "/"):
+		_, network, err := net.ParseCIDR(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q", addr)
+		}
+		networks = append(networks, network)
+	default:
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address %q", addr)
+		}
+		bits := 128
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 32
+		}
+		mask := net.CIDRMask(bits, bits)
+		if len(fields) >= 2 && fields[0] == "mask" {
+			m := net.ParseIP(fields[1])
+			if m == nil {
+				return nil, fmt.Errorf("invalid mask %q", fields[1])
+			}
+			if bits == 32 {
+				m = m.To4()
+			}
+			mask = net.IPMask(m)
+			if ones, _ := mask.Size(); ones == 0 && !m.IsUnspecified() {
+				return nil, fmt.Errorf("non-contiguous mask %q", fields[1])
+			}
+			fields = fields[2:]
+		}
+		networks = append(networks, &net.IPNet{IP: ip.Mask(mask), Mask: mask})
+	}
+
+	var flags RestrictFlag
+flags:
+	for _, f := range fields {
+		for _, n := range restrictFlagNames {
+			if f == n.name {
+				flags |= n.flag
+				continue flags
+			}
+		}
+		if !restrictIgnored[f] {
+			return nil, fmt.Errorf("unknown flag %q", f)
+		}
+	}
+
+	rules := make([]AccessRule, len(networks))
+	for i, network := range networks {
+		rules[i] = AccessRule{Network: network, Flags: flags}
+	}
+	return rules, nil
+}
+
+// Add adds a rule applying flags to the network, given in CIDR notation
+// (e.g., "192.0.2.0/24") or as a single address. A rule for the same network
+// replaces any existing rule.
+func (a *AccessList) Add(network string, flags RestrictFlag) error {
+	if !strings.Contains(network, "/") {
+		ip := net.ParseIP(network)
+		if ip == nil {
+			return fmt.Errorf("%w: invalid address %q", ErrInvalidRestriction, network)
+		}
+		if ip.To4() != nil {
+			network += "/32"
+		} else {
+			network += "/128"
+		}
+	}
+	_, n, err := net.ParseCIDR(network)
+	if err != nil {
+		return fmt.Errorf("%w: invalid network %q", ErrInvalidRestriction, network)
+	}
+	a.addRule(AccessRule{Network: n, Flags: flags})
+	return nil
+}
+
+// addRule adds a rule to the list, keeping the rules sorted from most to
+// least specific.
+func (a *AccessList) addRule(r AccessRule) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i := range a.rules {
+		if sameNetwork(a.rules[i].Network, r.Network) {
+			a.rules[i].Flags = r.Flags
+			return
+		}
+	}
+	a.rules = append(a.rules, r)
+	sort.SliceStable(a.rules, func(i, j int) bool {
+		return prefixLen(a.rules[i].Network) > prefixLen(a.rules[j].Network)
+	})
+}
+
+// Rules returns the access list's rules, from most to least specific.
+func (a *AccessList) Rules() []AccessRule {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return append([]AccessRule(nil), a.rules...)
+}
+
+// Flags returns the restrictions applied to packets received from ip.
+func (a *AccessList) Flags(ip net.IP) RestrictFlag {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	for _, r := range a.rules {
+		if r.Network == nil || r.Network.Contains(ip) {
+			return r.Flags
+		}
+	}
+	return 0
+}
+
+func prefixLen(n *net.IPNet) int {
+	if n == nil {
+		return -1
+	}
+	ones, _ := n.Mask.Size()
+	return ones
+}
+
+func sameNetwork(a, b *net.IPNet) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.IP.Equal(b.IP) && a.Mask.String() == b.Mask.String()
+}
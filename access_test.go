@@ -0,0 +1,135 @@
+// Copyright © 2015-2023 Brett Vickers.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ntp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testRestrictConf = `
+# ntp.conf
+server 0.pool.ntp.org iburst
+restrict default kod limited nomodify nopeer noquery
+restrict -6 default ignore
+restrict 127.0.0.1
+restrict 192.0.2.0 mask 255.255.255.0 notrust nomodify
+restrict 192.0.2.128/25 noserve
+restrict 2001:db8::/32 nomodify  # documentation prefix
+`
+
+func TestOfflineParseAccessList(t *testing.T) {
+	a, err := ParseAccessList(strings.NewReader(testRestrictConf))
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Len(t, a.Rules(), 6)
+
+	cases := []struct {
+		ip    string
+		flags RestrictFlag
+	}{
+		{"127.0.0.1", 0},
+		{"192.0.2.1", RestrictNoTrust | RestrictNoModify},
+		{"192.0.2.200", RestrictNoServe},
+		{"198.51.100.1", RestrictKoD | RestrictLimited | RestrictNoModify | RestrictNoQuery},
+		{"2001:db8::1", RestrictNoModify},
+		{"::1", RestrictIgnore},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.flags, a.Flags(net.ParseIP(c.ip)), c.ip)
+	}
+	assert.Equal(t, "nomodify notrust", (RestrictNoTrust | RestrictNoModify).String())
+
+	// Adding a rule for an existing network replaces it.
+	assert.Nil(t, a.Add("192.0.2.0/24", RestrictIgnore))
+	assert.Equal(t, RestrictIgnore, a.Flags(net.ParseIP("192.0.2.1")))
+	assert.Len(t, a.Rules(), 6)
+	assert.Nil(t, a.Add("192.0.2.1", 0))
+	assert.Equal(t, RestrictFlag(0), a.Flags(net.ParseIP("192.0.2.1")))
+
+	bad := []string{
+		"restrict",
+		"restrict 192.0.2.300",
+		"restrict 192.0.2.0/33",
+		"restrict 192.0.2.0 mask 255.0.255.0",
+		"restrict default bogus",
+	}
+	for _, b := range bad {
+		_, err := ParseAccessList(strings.NewReader(b))
+		assert.ErrorIs(t, err, ErrInvalidRestriction, b)
+	}
+	assert.ErrorIs(t, a.Add("bogus", 0), ErrInvalidRestriction)
+}
+
+func TestOfflineServerAccess(t *testing.T) {
+	a, err := ParseAccessList(strings.NewReader(testRestrictConf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(ServerState{Stratum: 1})
+	s.Access = a
+	s.RateLimit = &RateLimiter{Interval: time.Minute, Burst: 1}
+	now := time.Now()
+
+	query := make([]byte, 48)
+	query[0] = 4<<3 | byte(client)
+	control := make([]byte, 12)
+	control[0] = 2<<3 | byte(controlMessage)
+	control[1] = 2 // read variables
+	addr := func(ip string) net.Addr { return &net.UDPAddr{IP: net.ParseIP(ip), Port: 123} }
+
+	// Unrestricted clients are not rate limited.
+	for i := 0; i < 3; i++ {
+		assert.NotNil(t, s.Respond(query, addr("127.0.0.1"), now))
+	}
+
+	// Limited clients receive a RATE kiss-of-death packet.
+	assert.NotNil(t, s.Respond(query, addr("198.51.100.1"), now))
+	resp := s.Respond(query, addr("198.51.100.1"), now)
+	if assert.Len(t, resp, 48) {
+		h := new(header)
+		binary.Read(bytes.NewReader(resp), binary.BigEndian, h)
+		assert.Equal(t, "RATE", kissCode(h.ReferenceID))
+	}
+
+	// Ignored, unserved and untrusted clients receive nothing.
+	assert.Nil(t, s.Respond(query, addr("::1"), now))
+	assert.Nil(t, s.Respond(query, addr("192.0.2.200"), now))
+	assert.Nil(t, s.Respond(query, addr("192.0.2.1"), now))
+
+	// Control queries are refused, and counted when the client is
+	// restricted with noquery.
+	assert.Nil(t, s.Respond(control, addr("198.51.100.2"), now))
+
+	// Ignored clients receive nothing even if kod is set, but unserved
+	// clients receive a DENY kiss-of-death packet.
+	assert.Nil(t, a.Add("203.0.113.0/25", RestrictIgnore|RestrictKoD))
+	assert.Nil(t, s.Respond(query, addr("203.0.113.1"), now))
+	assert.Nil(t, a.Add("203.0.113.128/25", RestrictNoServe|RestrictKoD))
+	resp = s.Respond(query, addr("203.0.113.129"), now)
+	if assert.Len(t, resp, 48) {
+		h := new(header)
+		binary.Read(bytes.NewReader(resp), binary.BigEndian, h)
+		assert.Equal(t, "DENY", kissCode(h.ReferenceID))
+		assert.Equal(t, uint8(0), h.Stratum)
+	}
+
+	assert.Equal(t, ServerStats{
+		Received:    11,
+		Responded:   6,
+		Denied:      4,
+		NoQuery:     1,
+		NoTrust:     1,
+		RateLimited: 1,
+		KissOfDeath: 2,
+	}, s.Stats())
+}
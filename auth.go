@@ -7,6 +7,7 @@ package ntp
 import (
 	"bytes"
 	"crypto/aes"
+	"crypto/hmac"
 	"crypto/md5"
 	"crypto/sha1"
 	"crypto/sha256"
@@ -14,22 +15,45 @@ import (
 	"crypto/subtle"
 	"encoding/binary"
 	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/sha3"
 )
 
 // AuthType specifies the cryptographic hash algorithm used to generate a
 // symmetric key authentication digest (or CMAC) for an NTP message. Please
 // note that MD5 and SHA1 are no longer considered secure; they appear here
 // solely for compatibility with existing NTP server implementations.
+//
+// The AuthSHA256 and AuthSHA512 types truncate their digests to 20 bytes
+// for compatibility with ntpd and NTPsec. The AuthHMAC* and AuthAESSIV*
+// types produce full-length MACs; they are not supported by other NTP
+// implementations and should be used only when both the client and server
+// use this package. Because NTPv4 parsers treat MACs longer than 24 bytes as
+// extension fields, MACs of 32 or more bytes are best used with NTP
+// version 3 packets or with servers built on this package.
+//
+// Additional algorithms may be added using RegisterMACAlgorithm.
 type AuthType int
 
 const (
-	AuthNone   AuthType = iota // no authentication
-	AuthMD5                    // MD5 digest
-	AuthSHA1                   // SHA-1 digest
-	AuthSHA256                 // SHA-2 digest (256 bits)
-	AuthSHA512                 // SHA-2 digest (512 bits)
-	AuthAES128                 // AES-128-CMAC
-	AuthAES256                 // AES-256-CMAC
+	AuthNone         AuthType = iota // no authentication
+	AuthMD5                          // MD5 digest
+	AuthSHA1                         // SHA-1 digest
+	AuthSHA256                       // SHA-2 digest (256 bits, truncated to 160)
+	AuthSHA512                       // SHA-2 digest (512 bits, truncated to 160)
+	AuthAES128                       // AES-128-CMAC
+	AuthAES256                       // AES-256-CMAC
+	AuthHMACSHA256                   // HMAC-SHA-256 (full length)
+	AuthHMACSHA512                   // HMAC-SHA-512 (full length)
+	AuthHMACSHA3_256                 // HMAC-SHA3-256 (full length)
+	AuthAESSIV256                    // AES-SIV-CMAC-256 (RFC 5297 S2V)
+	AuthAESSIV384                    // AES-SIV-CMAC-384 (RFC 5297 S2V)
+	AuthAESSIV512                    // AES-SIV-CMAC-512 (RFC 5297 S2V)
 )
 
 // AuthOptions contains fields used to configure symmetric key authentication
@@ -49,21 +73,150 @@ type AuthOptions struct {
 	// The identifier used by the NTP server to identify which key to use
 	// for authentication purposes.
 	KeyID uint16
+
+	// KeyRing, if not nil, supplies the keys used for authentication. The
+	// Type and Key fields are ignored, and KeyID selects the key used to
+	// authenticate the query. If KeyID is zero, the key ring's current key
+	// is used (see KeyRing.Use). The server's response may be authenticated
+	// using any trusted key in the key ring.
+	KeyRing *KeyRing
 }
 
-var algorithms = []struct {
+// enabled returns true if the options call for symmetric key
+// authentication.
+func (opt *AuthOptions) enabled() bool {
+	return opt.Type != AuthNone || opt.KeyRing != nil
+}
+
+// SigningKey returns the key used to authenticate a query made with the
+// options. If KeyRing is set, it is the trusted key selected by KeyID, or
+// the key ring's current key if KeyID is zero. Otherwise, it is decoded
+// from Key, and has the requested Type and KeyID. If the options don't
+// call for authentication, the returned key's Type is AuthNone.
+func (opt AuthOptions) SigningKey() (Key, error) {
+	opt, secret, err := resolveAuth(opt)
+	if err != nil {
+		return Key{}, err
+	}
+	return Key{ID: opt.KeyID, Type: opt.Type, Secret: secret}, nil
+}
+
+// A MACAlgorithm describes an algorithm used to compute the message
+// authentication code (MAC) appended to authenticated NTP packets.
+type MACAlgorithm struct {
+	// Name identifies the algorithm in key files and diagnostics (e.g.,
+	// "SHA1" or "AES128CMAC"). Names are case-insensitive.
+	Name string
+
+	// MinKeySize and MaxKeySize determine the acceptable key lengths, in
+	// bytes. Keys longer than MaxKeySize are truncated.
 	MinKeySize int
 	MaxKeySize int
+
+	// DigestSize is the length of the computed digest, in bytes. It must be
+	// a multiple of 4.
 	DigestSize int
+
+	// CalcDigest computes the digest of payload using key. It must not
+	// modify payload.
 	CalcDigest func(payload, key []byte) []byte
-}{
-	{0, 0, 0, nil},                 // AuthNone
-	{4, 32, 16, calcDigest_MD5},    // AuthMD5
-	{4, 32, 20, calcDigest_SHA1},   // AuthSHA1
-	{4, 32, 20, calcDigest_SHA256}, // AuthSHA256
-	{4, 32, 20, calcDigest_SHA512}, // AuthSHA512
-	{16, 16, 16, calcCMAC_AES},     // AuthAES128
-	{32, 32, 16, calcCMAC_AES},     // AuthAES256
+}
+
+var (
+	algorithmsMu sync.RWMutex
+	algorithms   = []MACAlgorithm{
+		{"", 0, 0, 0, nil},                                // AuthNone
+		{"MD5", 4, 32, 16, calcDigest_MD5},                // AuthMD5
+		{"SHA1", 4, 32, 20, calcDigest_SHA1},              // AuthSHA1
+		{"SHA256", 4, 32, 20, calcDigest_SHA256},          // AuthSHA256
+		{"SHA512", 4, 32, 20, calcDigest_SHA512},          // AuthSHA512
+		{"AES128CMAC", 16, 16, 16, calcCMAC_AES},          // AuthAES128
+		{"AES256CMAC", 32, 32, 16, calcCMAC_AES},          // AuthAES256
+		{"HMAC-SHA256", 16, 64, 32, calcHMAC_SHA256},      // AuthHMACSHA256
+		{"HMAC-SHA512", 16, 128, 64, calcHMAC_SHA512},     // AuthHMACSHA512
+		{"HMAC-SHA3-256", 16, 136, 32, calcHMAC_SHA3_256}, // AuthHMACSHA3_256
+		{"AES-SIV-CMAC-256", 32, 32, 16, calcSIV_AES},     // AuthAESSIV256
+		{"AES-SIV-CMAC-384", 48, 48, 16, calcSIV_AES},     // AuthAESSIV384
+		{"AES-SIV-CMAC-512", 64, 64, 16, calcSIV_AES},     // AuthAESSIV512
+	}
+)
+
+// RegisterMACAlgorithm adds a MAC algorithm to the set available for
+// symmetric key authentication and returns the AuthType that selects it.
+// Algorithms are typically registered during program initialization.
+func RegisterMACAlgorithm(a MACAlgorithm) (AuthType, error) {
+	switch {
+	case a.Name == "":
+		return AuthNone, fmt.Errorf("%w: missing name", ErrInvalidAuthType)
+	case a.CalcDigest == nil:
+		return AuthNone, fmt.Errorf("%w: missing digest function", ErrInvalidAuthType)
+	case a.DigestSize <= 0 || a.DigestSize%4 != 0:
+		return AuthNone, fmt.Errorf("%w: digest size must be a positive multiple of 4", ErrInvalidAuthType)
+	case a.MinKeySize < 0 || a.MaxKeySize < a.MinKeySize:
+		return AuthNone, fmt.Errorf("%w: invalid key size range", ErrInvalidAuthType)
+	}
+
+	algorithmsMu.Lock()
+	defer algorithmsMu.Unlock()
+	for _, b := range algorithms {
+		if strings.EqualFold(a.Name, b.Name) {
+			return AuthNone, fmt.Errorf("%w: %q already registered", ErrInvalidAuthType, a.Name)
+		}
+	}
+	algorithms = append(algorithms, a)
+	return AuthType(len(algorithms) - 1), nil
+}
+
+// ParseAuthType returns the AuthType of the registered MAC algorithm with
+// the requested name, ignoring case.
+func ParseAuthType(name string) (AuthType, bool) {
+	algorithmsMu.RLock()
+	defer algorithmsMu.RUnlock()
+	for i, a := range algorithms {
+		if i != int(AuthNone) && strings.EqualFold(name, a.Name) {
+			return AuthType(i), true
+		}
+	}
+	return AuthNone, false
+}
+
+// Algorithm returns the MAC algorithm selected by the auth type. It returns
+// false for AuthNone and unregistered types.
+func (t AuthType) Algorithm() (MACAlgorithm, bool) {
+	algorithmsMu.RLock()
+	defer algorithmsMu.RUnlock()
+	if t <= AuthNone || int(t) >= len(algorithms) {
+		return MACAlgorithm{}, false
+	}
+	return algorithms[t], true
+}
+
+// String returns the name of the auth type's MAC algorithm.
+func (t AuthType) String() string {
+	if t == AuthNone {
+		return "none"
+	}
+	if a, ok := t.Algorithm(); ok {
+		return a.Name
+	}
+	return "AuthType(" + strconv.Itoa(int(t)) + ")"
+}
+
+// digestSizes returns the distinct digest sizes of all registered MAC
+// algorithms, in ascending order.
+func digestSizes() []int {
+	algorithmsMu.RLock()
+	defer algorithmsMu.RUnlock()
+	var sizes []int
+	seen := make(map[int]bool)
+	for _, a := range algorithms[1:] {
+		if !seen[a.DigestSize] {
+			seen[a.DigestSize] = true
+			sizes = append(sizes, a.DigestSize)
+		}
+	}
+	sort.Ints(sizes)
+	return sizes
 }
 
 func calcDigest_MD5(payload, key []byte) []byte {
@@ -86,6 +239,55 @@ func calcDigest_SHA512(payload, key []byte) []byte {
 	return digest[:20]
 }
 
+func calcHMAC_SHA256(payload, key []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(payload)
+	return h.Sum(nil)
+}
+
+func calcHMAC_SHA512(payload, key []byte) []byte {
+	h := hmac.New(sha512.New, key)
+	h.Write(payload)
+	return h.Sum(nil)
+}
+
+func calcHMAC_SHA3_256(payload, key []byte) []byte {
+	h := hmac.New(sha3.New256, key)
+	h.Write(payload)
+	return h.Sum(nil)
+}
+
+func calcSIV_AES(payload, key []byte) []byte {
+	// An AES-SIV key is the concatenation of a CMAC key and a CTR key. Only
+	// the CMAC key is needed to compute the synthetic IV, which serves as
+	// the MAC of a message having the payload as its associated data and an
+	// empty plaintext. See https://tools.ietf.org/html/rfc5297.
+	return s2v(key[:len(key)/2], payload, nil)
+}
+
+func s2v(key []byte, strs ...[]byte) []byte {
+	// Calculate the S2V pseudo-random function according to the algorithm
+	// defined in RFC 5297, section 2.4.
+	const rb = 0x87
+	d := calcCMAC_AES(make([]byte, 16), key)
+	for _, s := range strs[:len(strs)-1] {
+		double(d, d, rb)
+		xor(d, calcCMAC_AES(s, key))
+	}
+
+	last := strs[len(strs)-1]
+	var t []byte
+	if len(last) >= 16 {
+		t = append([]byte(nil), last...)
+		xor(t[len(t)-16:], d)
+	} else {
+		double(d, d, rb)
+		t = pad(append(make([]byte, 0, 16), last...))
+		xor(t, d)
+	}
+	return calcCMAC_AES(t, key)
+}
+
 func calcCMAC_AES(payload, key []byte) []byte {
 	// calculate the CMAC according to the algorithm defined in RFC 4493. See
 	// https://tools.ietf.org/html/rfc4493 for details.
@@ -114,7 +316,7 @@ func calcCMAC_AES(payload, key []byte) []byte {
 		xor(cmac, payload)
 		xor(cmac, k1)
 	} else {
-		xor(cmac, pad(payload))
+		xor(cmac, pad(append(make([]byte, 0, 16), payload...)))
 		xor(cmac, k2)
 	}
 	c.Encrypt(cmac, cmac)
@@ -182,7 +384,10 @@ func decodeAuthKey(opt AuthOptions) (key []byte, err error) {
 		key = []byte(keyIn)
 	}
 
-	a := algorithms[opt.Type]
+	a, ok := opt.Type.Algorithm()
+	if !ok {
+		return nil, ErrInvalidAuthType
+	}
 	if len(key) < a.MinKeySize {
 		return nil, ErrInvalidAuthKey
 	}
@@ -193,12 +398,29 @@ func decodeAuthKey(opt AuthOptions) (key []byte, err error) {
 	return key, nil
 }
 
+// resolveAuth returns the authentication options and decoded key used to
+// authenticate a query. If the options contain a key ring, the returned
+// options hold the type and ID of the selected key.
+func resolveAuth(opt AuthOptions) (AuthOptions, []byte, error) {
+	if opt.KeyRing == nil {
+		key, err := decodeAuthKey(opt)
+		return opt, key, err
+	}
+
+	key, ok := opt.KeyRing.trustedKey(opt.KeyID)
+	if !ok {
+		return opt, nil, ErrUnknownKey
+	}
+	opt.Type, opt.KeyID = key.Type, key.ID
+	return opt, key.Secret, nil
+}
+
 func appendMAC(buf *bytes.Buffer, opt AuthOptions, key []byte) {
 	if opt.Type == AuthNone {
 		return
 	}
 
-	a := algorithms[opt.Type]
+	a, _ := opt.Type.Algorithm()
 	payload := buf.Bytes()
 	digest := a.CalcDigest(payload, key)
 	binary.Write(buf, binary.BigEndian, uint32(opt.KeyID))
@@ -206,18 +428,22 @@ func appendMAC(buf *bytes.Buffer, opt AuthOptions, key []byte) {
 }
 
 func verifyMAC(buf []byte, opt AuthOptions, key []byte) error {
+	if opt.KeyRing != nil {
+		return opt.KeyRing.verifyMAC(buf)
+	}
 	if opt.Type == AuthNone {
 		return nil
 	}
 
 	// Validate that there are enough bytes at the end of the message to
 	// contain a MAC.
-	const headerSize = 48
-	a := algorithms[opt.Type]
+	a, ok := opt.Type.Algorithm()
+	if !ok {
+		return ErrInvalidAuthType
+	}
 	macLen := 4 + a.DigestSize
-	remain := len(buf) - headerSize
-	if remain < macLen || (remain%4) != 0 {
-		return ErrAuthFailed
+	if err := checkMACLength(buf, macLen); err != nil {
+		return err
 	}
 
 	// The key ID returned by the server must be the same as the key ID sent
@@ -226,15 +452,33 @@ func verifyMAC(buf []byte, opt AuthOptions, key []byte) error {
 	mac := buf[payloadLen:]
 	keyID := binary.BigEndian.Uint32(mac[:4])
 	if keyID != uint32(opt.KeyID) {
-		return ErrAuthFailed
+		return &AuthError{AuthWrongKeyID, keyID}
 	}
 
 	// Calculate and compare digests.
 	payload := buf[:payloadLen]
 	digest := a.CalcDigest(payload, key)
 	if subtle.ConstantTimeCompare(digest, mac[4:]) != 1 {
-		return ErrAuthFailed
+		return &AuthError{AuthDigestMismatch, keyID}
 	}
 
 	return nil
 }
+
+// checkMACLength verifies that the message in buf ends with a MAC of
+// length macLen, reporting a missing, truncated or crypto-NAK MAC
+// otherwise.
+func checkMACLength(buf []byte, macLen int) error {
+	const headerSize = 48
+	remain := len(buf) - headerSize
+	switch {
+	case remain <= 0:
+		return &AuthError{Failure: AuthMissingMAC}
+	case remain == 4:
+		keyID := binary.BigEndian.Uint32(buf[headerSize:])
+		return &AuthError{AuthCryptoNAK, keyID}
+	case remain < macLen || (remain%4) != 0:
+		return &AuthError{Failure: AuthTruncatedMAC}
+	}
+	return nil
+}
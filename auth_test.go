@@ -111,24 +111,24 @@ func TestOnlineAuthenticatedQuery(t *testing.T) {
 	for i, c := range cases {
 		opt := QueryOptions{
 			Timeout: 250 * time.Millisecond,
-			Auth:    AuthOptions{c.Type, c.Key, c.KeyID},
+			Auth:    AuthOptions{Type: c.Type, Key: c.Key, KeyID: c.KeyID},
 		}
 		r, err := QueryWithOptions(host, opt)
 		if c.ExpectedErr == errAuthFail {
 			// With old NTP servers, failed authentication leads to Crypto-NAK
 			// (ErrAuthFailed). With modern NTP servers, it leads to an I/O
 			// timeout error.
-			if err != ErrAuthFailed && !strings.Contains(err.Error(), "timeout") {
+			if !errors.Is(err, ErrAuthFailed) && !strings.Contains(err.Error(), "timeout") {
 				t.Errorf("case %d: expected error [%v], got error [%v]\n", i, c.ExpectedErr, err)
 			}
 			continue
 		}
-		if c.ExpectedErr != nil && c.ExpectedErr == err {
+		if c.ExpectedErr != nil && errors.Is(err, c.ExpectedErr) {
 			continue
 		}
 		if err == nil {
 			err = r.Validate()
-			if err != c.ExpectedErr {
+			if !errors.Is(err, c.ExpectedErr) {
 				t.Errorf("case %d: expected error [%v], got error [%v]\n", i, c.ExpectedErr, err)
 			}
 		}
@@ -194,3 +194,195 @@ func hexDecode(s string) []byte {
 	}
 	return b
 }
+
+func TestOfflineAuthFailures(t *testing.T) {
+	opt := AuthOptions{Type: AuthSHA1, Key: "HEX:6931564b4a5a5045766c55356b30656c7666316c", KeyID: 2}
+	key, err := decodeAuthKey(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hdr := make([]byte, 48)
+	signed := func(keyID uint16) []byte {
+		var buf bytes.Buffer
+		buf.Write(hdr)
+		appendMAC(&buf, AuthOptions{Type: opt.Type, KeyID: keyID}, key)
+		return buf.Bytes()
+	}
+
+	good := signed(2)
+	if err := verifyMAC(good, opt, key); err != nil {
+		t.Errorf("valid MAC rejected: %v", err)
+	}
+
+	tampered := signed(2)
+	tampered[1] ^= 0x01
+
+	cases := []struct {
+		buf     []byte
+		failure AuthFailure
+		keyID   uint32
+	}{
+		{hdr, AuthMissingMAC, 0},
+		{append(hdr[:48:48], 0, 0, 0, 0), AuthCryptoNAK, 0},
+		{append(hdr[:48:48], 0, 0, 0, 2), AuthCryptoNAK, 2},
+		{good[:len(good)-4], AuthTruncatedMAC, 0},
+		{good[:len(good)-1], AuthTruncatedMAC, 0},
+		{signed(3), AuthWrongKeyID, 3},
+		{tampered, AuthDigestMismatch, 2},
+	}
+	for i, c := range cases {
+		err := verifyMAC(c.buf, opt, key)
+		if !errors.Is(err, ErrAuthFailed) {
+			t.Errorf("case %d: expected ErrAuthFailed, got %v", i, err)
+			continue
+		}
+		var authErr *AuthError
+		if !errors.As(err, &authErr) {
+			t.Errorf("case %d: expected *AuthError, got %T", i, err)
+			continue
+		}
+		if authErr.Failure != c.failure || authErr.KeyID != c.keyID {
+			t.Errorf("case %d: expected %v (key %d), got %v (key %d)",
+				i, c.failure, c.keyID, authErr.Failure, authErr.KeyID)
+		}
+	}
+
+	r := generateResponse(&header{Stratum: 1}, 0, &AuthError{Failure: AuthCryptoNAK})
+	if err := r.Validate(); !errors.Is(err, ErrAuthFailed) {
+		t.Errorf("expected Validate to report ErrAuthFailed, got %v", err)
+	}
+	if r.AuthErr() == nil || r.AuthErr().Error() != "authentication failed: crypto-NAK received (key ID 0)" {
+		t.Errorf("unexpected AuthErr: %v", r.AuthErr())
+	}
+}
+
+func TestOfflineAesSiv(t *testing.T) {
+	// Test case taken from RFC 5297, appendix A.1.
+	key := hexDecode("fffefdfc fbfaf9f8 f7f6f5f4 f3f2f1f0 f0f1f2f3 f4f5f6f7 f8f9fafb fcfdfeff")
+	ad := hexDecode("10111213 14151617 18191a1b 1c1d1e1f 20212223 24252627")
+	pt := hexDecode("11223344 55667788 99aabbcc ddee")
+	iv := hexDecode("85632d07 c6e8f37f 950acd32 0a2ecc93")
+
+	if result := s2v(key[:16], ad, pt); !bytes.Equal(iv, result) {
+		t.Errorf("S2V mismatch: got %x", result)
+	}
+	if result := calcSIV_AES(ad, key); !bytes.Equal(s2v(key[:16], ad, nil), result) {
+		t.Errorf("AES-SIV MAC mismatch: got %x", result)
+	}
+}
+
+func TestOfflineHmac(t *testing.T) {
+	// Test case taken from RFC 4231, section 4.3.
+	key := []byte("Jefe")
+	msg := []byte("what do ya want for nothing?")
+	expected := hexDecode("5bdcc146 bf60754e 6a042426 089575c7 5a003f08 9d273983 9dec58b9 64ec3843")
+	if result := calcHMAC_SHA256(msg, key); !bytes.Equal(expected, result) {
+		t.Errorf("HMAC-SHA256 mismatch: got %x", result)
+	}
+}
+
+func TestOfflineMACAlgorithms(t *testing.T) {
+	cases := []struct {
+		typ        AuthType
+		name       string
+		key        string
+		digestSize int
+	}{
+		{AuthSHA256, "SHA256", "HEX:7133736e777057764256777739706a5533326164", 20},
+		{AuthHMACSHA256, "HMAC-SHA256", "HEX:7133736e777057764256777739706a5533326164", 32},
+		{AuthHMACSHA512, "HMAC-SHA512", "HEX:597675555446585868494d447543425971526e74", 64},
+		{AuthHMACSHA3_256, "HMAC-SHA3-256", "HEX:597675555446585868494d447543425971526e74", 32},
+		{AuthAESSIV256, "AES-SIV-CMAC-256", "HEX:47cb76a9a507cf26dc00eb0935f082f390f10308c3e0d58716273a63259a758a", 16},
+		{AuthAESSIV512, "AES-SIV-CMAC-512", "HEX:47cb76a9a507cf26dc00eb0935f082f390f10308c3e0d58716273a63259a758a" +
+			"68663033736f77706568707164304049597675555446585868494d4475434259", 16},
+	}
+
+	hdr := make([]byte, 48)
+	for _, c := range cases {
+		if c.typ.String() != c.name {
+			t.Errorf("%s: unexpected name %q", c.name, c.typ.String())
+		}
+		if typ, ok := ParseAuthType(strings.ToLower(c.name)); !ok || typ != c.typ {
+			t.Errorf("%s: ParseAuthType returned %v, %v", c.name, typ, ok)
+		}
+
+		opt := AuthOptions{Type: c.typ, Key: c.key, KeyID: 7}
+		key, err := decodeAuthKey(opt)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+
+		var buf bytes.Buffer
+		buf.Write(hdr)
+		appendMAC(&buf, opt, key)
+		if n := buf.Len() - 48; n != 4+c.digestSize {
+			t.Errorf("%s: expected %d-byte MAC, got %d", c.name, 4+c.digestSize, n)
+		}
+		if err := verifyMAC(buf.Bytes(), opt, key); err != nil {
+			t.Errorf("%s: valid MAC rejected: %v", c.name, err)
+		}
+
+		ring := NewKeyRing(Key{ID: 7, Type: c.typ, Secret: key})
+		if err := ring.verifyMAC(buf.Bytes()); err != nil {
+			t.Errorf("%s: valid MAC rejected by key ring: %v", c.name, err)
+		}
+	}
+
+	if _, err := decodeAuthKey(AuthOptions{Type: AuthType(1000), Key: "HEX:00"}); !errors.Is(err, ErrInvalidAuthType) {
+		t.Errorf("expected ErrInvalidAuthType, got %v", err)
+	}
+}
+
+func TestOfflineRegisterMACAlgorithm(t *testing.T) {
+	xorDigest := func(payload, key []byte) []byte {
+		d := make([]byte, 8)
+		for i, b := range payload {
+			d[i%8] ^= b ^ key[i%len(key)]
+		}
+		return d
+	}
+
+	typ, ok := ParseAuthType("test-xor")
+	if !ok {
+		var err error
+		typ, err = RegisterMACAlgorithm(MACAlgorithm{"TEST-XOR", 4, 8, 8, xorDigest})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	a, ok := typ.Algorithm()
+	if !ok || a.Name != "TEST-XOR" || a.DigestSize != 8 {
+		t.Fatalf("unexpected algorithm %+v", a)
+	}
+
+	keys, err := ParseKeys(strings.NewReader("9 test-xor HEX:0102030405060708\n"), KeyFileChrony)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0].Type != typ {
+		t.Fatalf("unexpected keys %+v", keys)
+	}
+
+	var buf bytes.Buffer
+	buf.Write(make([]byte, 48))
+	appendMAC(&buf, AuthOptions{Type: typ, KeyID: 9}, keys[0].Secret)
+	if err := NewKeyRing(keys...).verifyMAC(buf.Bytes()); err != nil {
+		t.Errorf("valid MAC rejected: %v", err)
+	}
+
+	invalid := []MACAlgorithm{
+		{"", 4, 8, 8, xorDigest},
+		{"TEST-XOR", 4, 8, 8, xorDigest},
+		{"TEST-NIL", 4, 8, 8, nil},
+		{"TEST-ODD", 4, 8, 6, xorDigest},
+		{"TEST-KEY", 8, 4, 8, xorDigest},
+	}
+	for _, a := range invalid {
+		if _, err := RegisterMACAlgorithm(a); !errors.Is(err, ErrInvalidAuthType) {
+			t.Errorf("%q: expected ErrInvalidAuthType, got %v", a.Name, err)
+		}
+	}
+}
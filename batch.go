@@ -0,0 +1,200 @@
+// Copyright © 2015-2023 Brett Vickers.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ntp
+
+import (
+	"errors"
+	"net"
+	"runtime"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Batch I/O parameters.
+const (
+	batchSize     = 64   // maximum number of packets read or written at once
+	maxPacketSize = 1024 // maximum size of a query packet
+)
+
+// errReusePortUnsupported is returned by listenReusePort on platforms that
+// do not support SO_REUSEPORT.
+var errReusePortUnsupported = errors.New("SO_REUSEPORT not supported")
+
+// batchConn is implemented by ipv4.PacketConn and ipv6.PacketConn.
+type batchConn interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+// ListenReusePort opens n UDP sockets bound to the same address using the
+// SO_REUSEPORT socket option, allowing the kernel to distribute incoming
+// packets among them. If n is zero or negative, one socket per CPU is
+// opened. If the address has no port or port 0, all sockets are bound to
+// the port chosen for the first. SO_REUSEPORT is currently supported only
+// on Linux.
+func ListenReusePort(network, address string, n int) ([]net.PacketConn, error) {
+	if n <= 0 {
+		n = runtime.NumCPU()
+	}
+	conns := make([]net.PacketConn, 0, n)
+	for i := 0; i < n; i++ {
+		conn, err := listenReusePort(network, address)
+		if err != nil {
+			for _, c := range conns {
+				c.Close()
+			}
+			return nil, err
+		}
+		conns = append(conns, conn)
+		if i == 0 {
+			address = conn.LocalAddr().String()
+		}
+	}
+	return conns, nil
+}
+
+// ListenAndServeParallel listens for NTP queries on the UDP address addr
+// using n sockets, each served by its own goroutine using batched I/O (see
+// ListenReusePort and ServeBatch). If n is zero or negative, one socket per
+// CPU is opened. On platforms that don't support SO_REUSEPORT, a single
+// socket served by n goroutines is used instead. ListenAndServeParallel
+// always returns a non-nil error; after Close, it returns ErrServerClosed.
+func (s *Server) ListenAndServeParallel(addr string, n int) error {
+	if addr == "" {
+		addr = ":123"
+	}
+	if n <= 0 {
+		n = runtime.NumCPU()
+	}
+
+	conns, err := ListenReusePort("udp", addr, n)
+	if errors.Is(err, errReusePortUnsupported) {
+		var conn net.PacketConn
+		conn, err = net.ListenPacket("udp", addr)
+		if err != nil {
+			return err
+		}
+		return s.serveShared(conn, n)
+	}
+	if err != nil {
+		return err
+	}
+
+	errs := make(chan error, len(conns))
+	for _, conn := range conns {
+		go func(conn net.PacketConn) {
+			errs <- s.ServeBatch(conn)
+		}(conn)
+	}
+
+	// Return the first error, closing the remaining sockets so their
+	// goroutines exit.
+	err = <-errs
+	for _, conn := range conns {
+		conn.Close()
+	}
+	for i := 1; i < len(conns); i++ {
+		<-errs
+	}
+	return err
+}
+
+// serveShared serves conn using n goroutines.
+func (s *Server) serveShared(conn net.PacketConn, n int) error {
+	if !s.track(conn, true) {
+		conn.Close()
+		return ErrServerClosed
+	}
+	defer s.track(conn, false)
+	defer conn.Close()
+
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			errs <- s.serveBatch(conn)
+		}()
+	}
+
+	// Return the first error, closing the socket so the remaining
+	// goroutines exit. Their errors are caused by the close.
+	err := <-errs
+	conn.Close()
+	for i := 1; i < n; i++ {
+		<-errs
+	}
+	return err
+}
+
+// ServeBatch answers NTP queries received on conn until conn fails or the
+// server is closed, like Serve. On Linux, packets are read and written in
+// batches using the recvmmsg and sendmmsg system calls, reducing the
+// per-packet system call overhead under heavy load. ServeBatch always
+// returns a non-nil error and closes conn; after Close, it returns
+// ErrServerClosed.
+func (s *Server) ServeBatch(conn net.PacketConn) error {
+	if !s.track(conn, true) {
+		conn.Close()
+		return ErrServerClosed
+	}
+	defer s.track(conn, false)
+	defer conn.Close()
+	return s.serveBatch(conn)
+}
+
+func (s *Server) serveBatch(conn net.PacketConn) error {
+	var bc batchConn
+	if a, ok := conn.LocalAddr().(*net.UDPAddr); ok && a.IP.To4() == nil {
+		bc = ipv6.NewPacketConn(conn)
+	} else {
+		bc = ipv4.NewPacketConn(conn)
+	}
+
+	in := make([]ipv4.Message, batchSize)
+	out := make([]ipv4.Message, batchSize)
+	for i := range in {
+		in[i].Buffers = [][]byte{make([]byte, maxPacketSize)}
+		out[i].Buffers = [][]byte{make([]byte, 0, maxPacketSize)}
+	}
+
+	for {
+		n, err := bc.ReadBatch(in, 0)
+		rxTime := s.now()
+		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			return err
+		}
+
+		k := 0
+		for i := 0; i < n; i++ {
+			req := in[i].Buffers[0][:in[i].N]
+			resp := s.appendResponse(out[k].Buffers[0][:0], req, in[i].Addr, rxTime)
+			if len(resp) == 0 {
+				continue
+			}
+			out[k].Buffers[0] = resp
+			out[k].Addr = in[i].Addr
+			k++
+		}
+
+		// Write the responses, skipping any that fail.
+		for sent := 0; sent < k; {
+			m, err := bc.WriteBatch(out[sent:k], 0)
+			if err != nil {
+				if s.isClosed() {
+					return ErrServerClosed
+				}
+				m++
+			}
+			sent += m
+		}
+	}
+}
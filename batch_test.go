@@ -0,0 +1,153 @@
+// Copyright © 2015-2023 Brett Vickers.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ntp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOfflineHeaderEncoding(t *testing.T) {
+	h := &header{
+		LiVnMode:       0xe4,
+		Stratum:        2,
+		Poll:           6,
+		Precision:      -20,
+		RootDelay:      0x00012345,
+		RootDispersion: 0x00006789,
+		ReferenceID:    0xc0000201,
+		ReferenceTime:  0xe5a1b2c31a2b3c4d,
+		OriginTime:     0x0102030405060708,
+		ReceiveTime:    0x1112131415161718,
+		TransmitTime:   0x2122232425262728,
+	}
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, h)
+	assert.Equal(t, buf.Bytes(), h.appendTo(nil))
+
+	var h2 header
+	h2.unmarshal(buf.Bytes())
+	assert.Equal(t, *h, h2)
+}
+
+func TestOfflineServeBatch(t *testing.T) {
+	conns, err := ListenReusePort("udp", "127.0.0.1:0", 4)
+	if err == errReusePortUnsupported {
+		t.Skip(err)
+	}
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Len(t, conns, 4)
+	addr := conns[0].LocalAddr().String()
+	for _, conn := range conns {
+		assert.Equal(t, addr, conn.LocalAddr().String())
+	}
+
+	s := NewServer(ServerState{Stratum: 1})
+	s.Clock = &offsetClock{time.Minute}
+	done := make(chan error, len(conns))
+	for _, conn := range conns {
+		go func(conn net.PacketConn) { done <- s.ServeBatch(conn) }(conn)
+	}
+
+	for i := 0; i < 8; i++ {
+		r, err := QueryWithOptions(addr, QueryOptions{Timeout: time.Second})
+		if assert.Nil(t, err) {
+			assert.Nil(t, r.Validate())
+			assert.InDelta(t, float64(time.Minute), float64(r.ClockOffset), float64(10*time.Millisecond))
+		}
+	}
+	assert.Equal(t, uint64(8), s.Stats().Responded)
+
+	s.Close()
+	for range conns {
+		assert.ErrorIs(t, <-done, ErrServerClosed)
+	}
+}
+
+func BenchmarkServerRespond(b *testing.B) {
+	s := NewServer(ServerState{Stratum: 1})
+	addr := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 123}
+	query := make([]byte, 48)
+	query[0] = 4<<3 | byte(client)
+	out := make([]byte, 0, 48)
+	now := time.Now()
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		out = s.appendResponse(out[:0], query, addr, now)
+	}
+}
+
+func BenchmarkServerLoopback(b *testing.B) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	s := NewServer(ServerState{Stratum: 1})
+	go s.Serve(conn)
+	defer s.Close()
+	benchmarkLoopback(b, conn.LocalAddr().String())
+}
+
+func BenchmarkServerLoopbackBatch(b *testing.B) {
+	conns, err := ListenReusePort("udp", "127.0.0.1:0", runtime.NumCPU())
+	if err == errReusePortUnsupported {
+		b.Skip(err)
+	}
+	if err != nil {
+		b.Fatal(err)
+	}
+	s := NewServer(ServerState{Stratum: 1})
+	for _, conn := range conns {
+		go s.ServeBatch(conn)
+	}
+	defer s.Close()
+	benchmarkLoopback(b, conns[0].LocalAddr().String())
+}
+
+// benchmarkLoopback measures the rate at which the server at addr answers
+// queries sent by parallel clients, each with a window of outstanding
+// queries.
+func benchmarkLoopback(b *testing.B, addr string) {
+	const window = 16
+	query := make([]byte, 48)
+	query[0] = 4<<3 | byte(client)
+
+	b.SetParallelism(4)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		conn, err := net.Dial("udp", addr)
+		if err != nil {
+			b.Error(err)
+			return
+		}
+		defer conn.Close()
+
+		buf := make([]byte, 128)
+		outstanding := 0
+		for pb.Next() {
+			conn.Write(query)
+			outstanding++
+			if outstanding < window {
+				continue
+			}
+			conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+			if _, err := conn.Read(buf); err == nil {
+				outstanding--
+			} else {
+				outstanding = 0 // assume the window's packets were lost
+			}
+		}
+	})
+}
@@ -0,0 +1,258 @@
+// Copyright © 2015-2023 Brett Vickers.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Command check_ntp is a Nagios and Icinga compatible plugin that checks the
+// clock offset of the local host against an NTP server, along with the
+// server's stratum and root distance and the jitter of the measured offsets.
+//
+// The server is queried several times. The sample with the smallest
+// round-trip time supplies the reported offset, stratum and root distance,
+// and the jitter is the RMS difference between the offsets of the other
+// samples and that of the best sample. Each value is compared against its
+// warning and critical thresholds, given in the standard plugin range
+// format; the offset is compared as an absolute value.
+//
+// Usage:
+//
+//	check_ntp -H host [-p port] [-w offset] [-c offset] [-W stratum]
+//	    [-C stratum] [-j jitter] [-k jitter] [-r distance] [-R distance]
+//	    [-n samples] [-i interval] [-t timeout] [-a type -K key -I id]
+//	    [-keyfile path [-chrony]]
+//
+// The plugin prints a single line of status, followed by perfdata, and exits
+// with status 0 (OK), 1 (WARNING), 2 (CRITICAL) or 3 (UNKNOWN).
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jocelyndb/ntp"
+)
+
+// Plugin exit statuses.
+const (
+	statusOK = iota
+	statusWarning
+	statusCritical
+	statusUnknown
+)
+
+var statusNames = []string{"OK", "WARNING", "CRITICAL", "UNKNOWN"}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// config holds the plugin's command line settings.
+type config struct {
+	host     string
+	port     int
+	samples  int
+	interval time.Duration
+	timeout  time.Duration
+
+	warnOffset, critOffset     threshold
+	warnStratum, critStratum   threshold
+	warnJitter, critJitter     threshold
+	warnDistance, critDistance threshold
+
+	auth ntp.AuthOptions
+}
+
+// parseFlags parses the command line arguments, writing usage messages to
+// w, which should not be the plugin's standard output.
+func parseFlags(args []string, w io.Writer) (*config, error) {
+	c := &config{}
+	fs := flag.NewFlagSet("check_ntp", flag.ContinueOnError)
+	fs.SetOutput(w)
+	fs.StringVar(&c.host, "H", "", "NTP server `host` to query")
+	fs.IntVar(&c.port, "p", 123, "NTP server `port`")
+	fs.IntVar(&c.samples, "n", 4, "number of `samples` to take")
+	fs.DurationVar(&c.interval, "i", time.Second, "`interval` between samples")
+	fs.DurationVar(&c.timeout, "t", 10*time.Second, "plugin `timeout`")
+	c.warnOffset.Set("60")
+	c.critOffset.Set("120")
+	fs.Var(&c.warnOffset, "w", "offset warning `range` in seconds")
+	fs.Var(&c.critOffset, "c", "offset critical `range` in seconds")
+	fs.Var(&c.warnStratum, "W", "stratum warning `range`")
+	fs.Var(&c.critStratum, "C", "stratum critical `range`")
+	fs.Var(&c.warnJitter, "j", "jitter warning `range` in seconds")
+	fs.Var(&c.critJitter, "k", "jitter critical `range` in seconds")
+	fs.Var(&c.warnDistance, "r", "root distance warning `range` in seconds")
+	fs.Var(&c.critDistance, "R", "root distance critical `range` in seconds")
+
+	var authType, keyFile string
+	var keyID uint
+	var chrony bool
+	fs.StringVar(&authType, "a", "", "authentication `type` (e.g. MD5, SHA1, AES128CMAC)")
+	fs.StringVar(&c.auth.Key, "K", "", "authentication `key`, prefixed by HEX: or ASCII:")
+	fs.UintVar(&keyID, "I", 0, "authentication key `id`")
+	fs.StringVar(&keyFile, "keyfile", "", "ntpd key file `path` supplying the key")
+	fs.BoolVar(&chrony, "chrony", false, "read the key file in chrony format")
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	switch {
+	case fs.NArg() > 0:
+		return nil, fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	case c.host == "":
+		return nil, errors.New("no host specified (-H)")
+	case c.samples < 1:
+		return nil, errors.New("at least one sample is required (-n)")
+	case keyID > math.MaxUint16:
+		return nil, fmt.Errorf("invalid key id %d", keyID)
+	case keyFile != "" && c.auth.Key != "":
+		return nil, errors.New("a key (-K) cannot be combined with a key file (-keyfile)")
+	case authType == "" && keyFile == "" && (c.auth.Key != "" || keyID != 0):
+		return nil, errors.New("an authentication type (-a) or key file (-keyfile) is required with a key or key id")
+	case authType != "" && keyFile == "" && c.auth.Key == "":
+		return nil, errors.New("a key (-K) or key file (-keyfile) is required with an authentication type")
+	}
+	c.auth.KeyID = uint16(keyID)
+
+	if authType != "" {
+		t, ok := ntp.ParseAuthType(authType)
+		if !ok {
+			return nil, fmt.Errorf("unknown authentication type %q", authType)
+		}
+		c.auth.Type = t
+	}
+	if keyFile != "" {
+		format := ntp.KeyFileNTPD
+		if chrony {
+			format = ntp.KeyFileChrony
+		}
+		ring, err := ntp.LoadKeyFile(keyFile, format)
+		if err != nil {
+			return nil, err
+		}
+		if c.auth.KeyID == 0 {
+			return nil, errors.New("a key id is required with a key file (-I)")
+		}
+		c.auth.KeyRing = ring
+	}
+	return c, nil
+}
+
+// run runs the plugin with the command line arguments args, writing its
+// output to w and usage messages to usage, and returns its exit status.
+func run(args []string, w, usage io.Writer) int {
+	c, err := parseFlags(args, usage)
+	if err != nil {
+		fmt.Fprintf(w, "NTP UNKNOWN: %v\n", err)
+		return statusUnknown
+	}
+	status, msg := check(c)
+	fmt.Fprintf(w, "NTP %s: %s\n", statusNames[status], msg)
+	return status
+}
+
+// check queries the server and evaluates the thresholds. It returns the
+// plugin status and its output, including perfdata.
+func check(c *config) (int, string) {
+	deadline := time.Now().Add(c.timeout)
+	opt := ntp.QueryOptions{Auth: c.auth}
+	addr := c.host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(strings.Trim(addr, "[]"), strconv.Itoa(c.port))
+	}
+
+	var valid []*ntp.Response
+	var lastErr error
+	for i := 0; i < c.samples; i++ {
+		if i > 0 {
+			if time.Now().Add(c.interval).After(deadline) {
+				break
+			}
+			time.Sleep(c.interval)
+		}
+		opt.Timeout = time.Until(deadline)
+		if opt.Timeout <= 0 {
+			break
+		}
+		r, err := ntp.QueryWithOptions(addr, opt)
+		if err == nil {
+			err = r.Validate()
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		valid = append(valid, r)
+	}
+	if len(valid) == 0 {
+		if lastErr == nil {
+			lastErr = errors.New("plugin timed out")
+		}
+		return statusCritical, fmt.Sprintf("no valid response from %s: %v", c.host, lastErr)
+	}
+
+	// Use the sample with the smallest round-trip time, which is least
+	// affected by network delays.
+	sort.SliceStable(valid, func(i, j int) bool { return valid[i].RTT < valid[j].RTT })
+	best := valid[0]
+	var sum float64
+	for _, r := range valid[1:] {
+		d := (r.ClockOffset - best.ClockOffset).Seconds()
+		sum += d * d
+	}
+	var jitter float64
+	if len(valid) > 1 {
+		jitter = math.Sqrt(sum / float64(len(valid)-1))
+	}
+
+	status := statusOK
+	var msgs, perf []string
+	metric := func(name, label string, v, abs float64, unit string, warn, crit *threshold, bounds string) {
+		s := statusOK
+		switch {
+		case crit.alert(abs):
+			s = statusCritical
+		case warn.alert(abs):
+			s = statusWarning
+		}
+		if s > status {
+			status = s
+		}
+
+		value := strconv.FormatFloat(v, 'f', 6, 64)
+		if unit == "" {
+			value = strconv.FormatFloat(v, 'f', -1, 64)
+		}
+		msg := name + " " + value
+		if unit != "" {
+			msg += " secs"
+		}
+		if s != statusOK {
+			msg += " (" + statusNames[s] + ")"
+		}
+		msgs = append(msgs, msg)
+		perf = append(perf, fmt.Sprintf("%s=%s%s;%s;%s;%s", label, value, unit, warn, crit, bounds))
+	}
+
+	offset := best.ClockOffset.Seconds()
+	metric("Offset", "offset", offset, math.Abs(offset), "s", &c.warnOffset, &c.critOffset, ";")
+	metric("jitter", "jitter", jitter, jitter, "s", &c.warnJitter, &c.critJitter, "0;")
+	stratum := float64(best.Stratum)
+	metric("stratum", "stratum", stratum, stratum, "", &c.warnStratum, &c.critStratum, "0;16")
+	distance := best.RootDistance.Seconds()
+	metric("root distance", "root_distance", distance, distance, "s", &c.warnDistance, &c.critDistance, "0;")
+
+	msg := strings.Join(msgs, ", ")
+	if n := len(valid); n < c.samples {
+		msg += fmt.Sprintf(", %d of %d samples valid", n, c.samples)
+	}
+	return status, msg + "|" + strings.Join(perf, " ")
+}
@@ -0,0 +1,109 @@
+// Copyright © 2015-2023 Brett Vickers.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jocelyndb/ntp"
+	"github.com/jocelyndb/ntp/ntptest"
+	"github.com/stretchr/testify/assert"
+)
+
+// startServer starts a test server replying with reply, whose clock is
+// ahead of the local clock by offset.
+func startServer(t *testing.T, reply *ntptest.Reply, offset time.Duration) string {
+	s := ntptest.NewUnstartedServer(ntptest.Script(reply))
+	s.Clock = ntptest.SkewedClock(offset)
+	s.Start()
+	t.Cleanup(s.Close)
+	return s.Addr
+}
+
+func runPlugin(args ...string) (int, string) {
+	var buf bytes.Buffer
+	status := run(append([]string{"-i", "0", "-t", "2s"}, args...), &buf, io.Discard)
+	return status, buf.String()
+}
+
+func TestOfflineCheck(t *testing.T) {
+	addr := startServer(t, &ntptest.Reply{Stratum: 2}, 500*time.Millisecond)
+
+	status, out := runPlugin("-H", addr, "-w", "1", "-c", "2")
+	assert.Equal(t, statusOK, status, out)
+	assert.Regexp(t, `^NTP OK: Offset 0\.(49|50)\d{4} secs, jitter 0\.\d{6} secs, stratum 2, root distance 0\.\d{6} secs\|`, out)
+	assert.Regexp(t, `\|offset=0\.(49|50)\d{4}s;1;2;; jitter=0\.\d{6}s;;;0; `, out)
+	assert.Contains(t, out, " stratum=2;;;0;16 root_distance=")
+	assert.Equal(t, 1, strings.Count(out, "\n"))
+
+	status, out = runPlugin("-H", addr, "-w", "0.1", "-c", "2")
+	assert.Equal(t, statusWarning, status, out)
+	assert.True(t, strings.HasPrefix(out, "NTP WARNING: Offset 0."), out)
+	assert.Contains(t, out, "secs (WARNING), jitter")
+
+	status, out = runPlugin("-H", addr, "-c", "0.2")
+	assert.Equal(t, statusCritical, status, out)
+
+	// Stratum, jitter and root distance thresholds are applied too.
+	status, out = runPlugin("-H", addr, "-W", "1", "-C", "5")
+	assert.Equal(t, statusWarning, status, out)
+	assert.Contains(t, out, "stratum 2 (WARNING)")
+	status, out = runPlugin("-H", addr, "-k", "@0:1")
+	assert.Equal(t, statusCritical, status, out)
+	assert.Contains(t, out, "(CRITICAL), stratum")
+	status, out = runPlugin("-H", addr, "-r", "0:0")
+	assert.Equal(t, statusWarning, status, out)
+	assert.Contains(t, out, "root distance")
+
+	// The port may be given separately.
+	host, port := addr[:strings.LastIndexByte(addr, ':')], addr[strings.LastIndexByte(addr, ':')+1:]
+	status, out = runPlugin("-H", host, "-p", port, "-n", "1")
+	assert.Equal(t, statusOK, status, out)
+}
+
+func TestOfflineCheckFailures(t *testing.T) {
+	addr := startServer(t, nil, 0)
+	status, out := runPlugin("-H", addr, "-n", "1", "-t", "100ms")
+	assert.Equal(t, statusCritical, status, out)
+	assert.True(t, strings.HasPrefix(out, "NTP CRITICAL: no valid response from "+addr), out)
+
+	addr = startServer(t, &ntptest.Reply{KissCode: "RATE"}, 0)
+	status, out = runPlugin("-H", addr, "-n", "2")
+	assert.Equal(t, statusCritical, status, out)
+	assert.Contains(t, out, "RATE")
+
+	for _, args := range [][]string{
+		{},
+		{"-H", addr, "-w", "x"},
+		{"-H", addr, "-n", "0"},
+		{"-H", addr, "-a", "nonsense"},
+		{"-H", addr, "-I", "70000"},
+		{"-H", addr, "extra"},
+		{"-H", addr, "-bogus"},
+		{"-H", addr, "-K", "ASCII:0123456789abcdef", "-I", "7"},
+		{"-H", addr, "-I", "7"},
+		{"-H", addr, "-a", "sha1", "-I", "7"},
+	} {
+		status, out = runPlugin(args...)
+		assert.Equal(t, statusUnknown, status, out)
+		assert.True(t, strings.HasPrefix(out, "NTP UNKNOWN: "), out)
+	}
+}
+
+func TestOfflineCheckAuth(t *testing.T) {
+	auth := ntp.AuthOptions{Type: ntp.AuthSHA1, Key: "ASCII:0123456789abcdef", KeyID: 7}
+	addr := startServer(t, &ntptest.Reply{Stratum: 1, Auth: auth}, 0)
+
+	status, out := runPlugin("-H", addr, "-n", "1", "-a", "sha1", "-K", "ASCII:0123456789abcdef", "-I", "7")
+	assert.Equal(t, statusOK, status, out)
+
+	status, out = runPlugin("-H", addr, "-n", "1", "-a", "sha1", "-K", "ASCII:fedcba9876543210", "-I", "7")
+	assert.Equal(t, statusCritical, status, out)
+	assert.Contains(t, out, "authentication")
+}
@@ -0,0 +1,80 @@
+// Copyright © 2015-2023 Brett Vickers.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// A threshold is a range in the Nagios plugin threshold format. A value
+// outside the range raises an alert, or inside the range if the threshold
+// is inverted with a leading '@':
+//
+//	10      < 0 or > 10
+//	10:     < 10
+//	~:10    > 10
+//	10:20   < 10 or > 20
+//	@10:20  >= 10 and <= 20
+//
+// The zero threshold is unset and never raises an alert.
+type threshold struct {
+	spec   string
+	lo, hi float64
+	inside bool
+}
+
+// String returns the threshold as it was specified, for use in perfdata.
+func (t *threshold) String() string {
+	return t.spec
+}
+
+// Set parses the threshold s. It implements flag.Value.
+func (t *threshold) Set(s string) error {
+	r := threshold{spec: s, lo: 0, hi: math.Inf(1)}
+	if strings.HasPrefix(s, "@") {
+		r.inside = true
+		s = s[1:]
+	}
+	if s == "" {
+		return fmt.Errorf("invalid threshold %q", r.spec)
+	}
+
+	lo, hi := "", s
+	if i := strings.IndexByte(s, ':'); i >= 0 {
+		lo, hi = s[:i], s[i+1:]
+	}
+	var err error
+	switch lo {
+	case "":
+	case "~":
+		r.lo = math.Inf(-1)
+	default:
+		if r.lo, err = strconv.ParseFloat(lo, 64); err != nil {
+			return fmt.Errorf("invalid threshold %q", r.spec)
+		}
+	}
+	if hi != "" {
+		if r.hi, err = strconv.ParseFloat(hi, 64); err != nil {
+			return fmt.Errorf("invalid threshold %q", r.spec)
+		}
+	}
+	if r.lo > r.hi {
+		return fmt.Errorf("invalid threshold %q: start exceeds end", r.spec)
+	}
+	*t = r
+	return nil
+}
+
+// alert returns true if the value v raises an alert.
+func (t *threshold) alert(v float64) bool {
+	if t.spec == "" {
+		return false
+	}
+	in := v >= t.lo && v <= t.hi
+	return in == t.inside
+}
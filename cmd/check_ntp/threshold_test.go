@@ -0,0 +1,47 @@
+// Copyright © 2015-2023 Brett Vickers.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOfflineThreshold(t *testing.T) {
+	tests := []struct {
+		spec  string
+		alert []float64
+		ok    []float64
+	}{
+		{"10", []float64{-1, 10.5}, []float64{0, 5, 10}},
+		{"10:", []float64{-1, 9.9}, []float64{10, 1e9}},
+		{"~:10", []float64{10.1}, []float64{-1e9, 10}},
+		{"10:20", []float64{9, 21}, []float64{10, 15, 20}},
+		{"@10:20", []float64{10, 15, 20}, []float64{9, 21}},
+		{"0.5", []float64{0.6}, []float64{0.25}},
+	}
+	for _, tt := range tests {
+		var th threshold
+		if !assert.Nil(t, th.Set(tt.spec), tt.spec) {
+			continue
+		}
+		assert.Equal(t, tt.spec, th.String())
+		for _, v := range tt.alert {
+			assert.True(t, th.alert(v), "%s %v", tt.spec, v)
+		}
+		for _, v := range tt.ok {
+			assert.False(t, th.alert(v), "%s %v", tt.spec, v)
+		}
+	}
+
+	var unset threshold
+	assert.False(t, unset.alert(1e9))
+
+	for _, spec := range []string{"x", "1:y", "20:10", "@"} {
+		var th threshold
+		assert.NotNil(t, th.Set(spec), spec)
+	}
+}
@@ -0,0 +1,196 @@
+// Copyright © 2015-2023 Brett Vickers.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ntp
+
+import (
+	"fmt"
+)
+
+// A KissOfDeathError is returned by Response.Validate when the server
+// responded with a "kiss of death" (stratum 0). It satisfies errors.Is for
+// ErrKissOfDeath.
+type KissOfDeathError struct {
+	// Code is the 4-character ASCII kiss code reported by the server (e.g.,
+	// "RATE" or "DENY"). It is empty if the reference ID did not contain a
+	// printable kiss code.
+	Code string
+}
+
+func (e *KissOfDeathError) Error() string {
+	if e.Code == "" {
+		return ErrKissOfDeath.Error()
+	}
+	return fmt.Sprintf("%v: %s", ErrKissOfDeath, e.Code)
+}
+
+// Unwrap returns ErrKissOfDeath.
+func (e *KissOfDeathError) Unwrap() error {
+	return ErrKissOfDeath
+}
+
+// A ValidationCheck names one of the sanity checks performed on a Response
+// when determining whether it is suitable for time synchronization.
+type ValidationCheck string
+
+// Checks performed by Response.Validate.
+const (
+	// CheckStratum verifies that the server stratum is below 16.
+	CheckStratum ValidationCheck = "stratum"
+
+	// CheckFreshness verifies that the server clock was updated within the
+	// maximum polling interval (~36 hours).
+	CheckFreshness ValidationCheck = "freshness"
+
+	// CheckDispersion verifies that the root synchronization distance
+	// (RootDelay/2 + RootDispersion) does not exceed 16 seconds.
+	CheckDispersion ValidationCheck = "dispersion"
+
+	// CheckTime verifies that the server's transmit time is not earlier than
+	// its reference time.
+	CheckTime ValidationCheck = "time"
+
+	// CheckLeap verifies that the server's leap indicator does not report
+	// an unsynchronized clock.
+	CheckLeap ValidationCheck = "leap"
+)
+
+// A ValidationError describes a Response that failed one of the checks
+// performed by Response.Validate. It satisfies errors.Is for the sentinel
+// error stored in Err (e.g., ErrInvalidStratum).
+type ValidationError struct {
+	// Check identifies the validation check that failed.
+	Check ValidationCheck
+
+	// Value is the offending value taken from the response.
+	Value interface{}
+
+	// Limit is the limit the value was compared against. It is nil for
+	// checks that do not compare against a limit.
+	Limit interface{}
+
+	// Err is the sentinel error describing the failure.
+	Err error
+}
+
+func (e *ValidationError) Error() string {
+	if e.Limit == nil {
+		return fmt.Sprintf("%v (%s %v)", e.Err, e.Check, e.Value)
+	}
+	return fmt.Sprintf("%v (%s %v, limit %v)", e.Err, e.Check, e.Value, e.Limit)
+}
+
+// Unwrap returns the sentinel error describing the failure.
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+// Operations reported by a QueryError.
+const (
+	opConfigure = "configure"
+	opDial      = "dial"
+	opEncode    = "encode"
+	opWrite     = "write"
+	opRead      = "read"
+	opDecode    = "decode"
+	opVerify    = "verify"
+)
+
+// A QueryError is returned by Query and QueryWithOptions when the query
+// fails before a response could be generated. It records the server that
+// was queried and the step of the query that failed.
+type QueryError struct {
+	// Server is the server address passed to Query or QueryWithOptions.
+	Server string
+
+	// Op is the query step that failed: "configure", "dial", "encode",
+	// "write", "read", "decode" or "verify".
+	Op string
+
+	// Err is the underlying error.
+	Err error
+}
+
+func (e *QueryError) Error() string {
+	return fmt.Sprintf("%s %s: %v", e.Op, e.Server, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *QueryError) Unwrap() error {
+	return e.Err
+}
+
+// Timeout reports whether the underlying error was caused by a timeout.
+func (e *QueryError) Timeout() bool {
+	t, ok := e.Err.(interface{ Timeout() bool })
+	return ok && t.Timeout()
+}
+
+// An AuthFailure identifies the reason symmetric key authentication of a
+// server response failed.
+type AuthFailure int
+
+const (
+	// AuthMissingMAC indicates the response contained no MAC.
+	AuthMissingMAC AuthFailure = iota + 1
+
+	// AuthCryptoNAK indicates the response contained a crypto-NAK: a 4-byte
+	// MAC holding a key ID but no digest. Servers send a crypto-NAK when
+	// they do not recognize or trust the client's key.
+	AuthCryptoNAK
+
+	// AuthTruncatedMAC indicates the response's MAC was too short to hold
+	// a digest of the expected size, or was not a multiple of 4 bytes long.
+	AuthTruncatedMAC
+
+	// AuthWrongKeyID indicates the response's MAC used a key ID other than
+	// the one sent in the query, or one not trusted by the key ring.
+	AuthWrongKeyID
+
+	// AuthDigestMismatch indicates the response's digest did not match the
+	// digest computed over its contents, suggesting the wrong key was used
+	// or the packet was altered in transit.
+	AuthDigestMismatch
+)
+
+var authFailureNames = []string{
+	AuthMissingMAC:     "missing MAC",
+	AuthCryptoNAK:      "crypto-NAK received",
+	AuthTruncatedMAC:   "truncated MAC",
+	AuthWrongKeyID:     "wrong key ID",
+	AuthDigestMismatch: "digest mismatch",
+}
+
+func (f AuthFailure) String() string {
+	if f > 0 && int(f) < len(authFailureNames) {
+		return authFailureNames[f]
+	}
+	return "unknown failure"
+}
+
+// An AuthError describes the failure to authenticate a server response
+// using symmetric key authentication. It is reported by Response.AuthErr
+// and Response.Validate, and it satisfies errors.Is for ErrAuthFailed.
+type AuthError struct {
+	// Failure identifies the reason authentication failed.
+	Failure AuthFailure
+
+	// KeyID is the key ID found in the response's MAC. It is zero for
+	// AuthMissingMAC and AuthTruncatedMAC failures.
+	KeyID uint32
+}
+
+func (e *AuthError) Error() string {
+	switch e.Failure {
+	case AuthCryptoNAK, AuthWrongKeyID, AuthDigestMismatch:
+		return fmt.Sprintf("%v: %v (key ID %d)", ErrAuthFailed, e.Failure, e.KeyID)
+	default:
+		return fmt.Sprintf("%v: %v", ErrAuthFailed, e.Failure)
+	}
+}
+
+// Unwrap returns ErrAuthFailed.
+func (e *AuthError) Unwrap() error {
+	return ErrAuthFailed
+}
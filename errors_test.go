@@ -0,0 +1,100 @@
+// Copyright © 2015-2023 Brett Vickers.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ntp
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOfflineKissOfDeathError(t *testing.T) {
+	h := &header{
+		Stratum:       0,
+		ReferenceID:   0x52415445, // RATE
+		ReferenceTime: 1 << 32,
+		OriginTime:    1 << 32,
+		ReceiveTime:   1 << 32,
+		TransmitTime:  1 << 32,
+	}
+	r := generateResponse(h, 1<<32, nil)
+	err := r.Validate()
+	assert.ErrorIs(t, err, ErrKissOfDeath)
+
+	var kod *KissOfDeathError
+	if assert.True(t, errors.As(err, &kod)) {
+		assert.Equal(t, "RATE", kod.Code)
+	}
+	assert.Equal(t, "kiss of death received: RATE", err.Error())
+}
+
+func TestOfflineValidationError(t *testing.T) {
+	newHeader := func() *header {
+		return &header{
+			Stratum:       1,
+			ReferenceID:   refID,
+			ReferenceTime: 1 << 32,
+			OriginTime:    1 << 32,
+			ReceiveTime:   1 << 32,
+			TransmitTime:  1 << 32,
+		}
+	}
+
+	cases := []struct {
+		modify func(h *header)
+		check  ValidationCheck
+		err    error
+	}{
+		{func(h *header) { h.Stratum = 16 }, CheckStratum, ErrInvalidStratum},
+		{func(h *header) { h.TransmitTime = 2 * 86400 << 32 }, CheckFreshness, ErrServerClockFreshness},
+		{func(h *header) { h.RootDispersion = 17 << 16 }, CheckDispersion, ErrInvalidDispersion},
+		{func(h *header) { h.ReferenceTime = 2 << 32 }, CheckTime, ErrInvalidTime},
+		{func(h *header) { h.setLeap(LeapNotInSync) }, CheckLeap, ErrInvalidLeapSecond},
+	}
+
+	for _, c := range cases {
+		h := newHeader()
+		c.modify(h)
+		r := generateResponse(h, h.TransmitTime, nil)
+		err := r.Validate()
+		assert.ErrorIs(t, err, c.err)
+
+		var verr *ValidationError
+		if assert.True(t, errors.As(err, &verr)) {
+			assert.Equal(t, c.check, verr.Check)
+		}
+	}
+
+	h := newHeader()
+	h.RootDispersion = 17 << 16
+	err := generateResponse(h, h.TransmitTime, nil).Validate()
+	assert.Equal(t, "invalid dispersion in response (dispersion 17s, limit 16s)", err.Error())
+}
+
+func TestOfflineQueryError(t *testing.T) {
+	dialErr := errors.New("not dialing")
+	opt := QueryOptions{
+		Dialer: func(la, ra string) (net.Conn, error) { return nil, dialErr },
+	}
+	_, err := QueryWithOptions("remote", opt)
+	assert.ErrorIs(t, err, dialErr)
+
+	var qerr *QueryError
+	if assert.True(t, errors.As(err, &qerr)) {
+		assert.Equal(t, "remote", qerr.Server)
+		assert.Equal(t, "dial", qerr.Op)
+		assert.False(t, qerr.Timeout())
+	}
+	assert.Equal(t, "dial remote: not dialing", err.Error())
+
+	_, err = QueryWithOptions("remote", QueryOptions{Version: 5, Timeout: time.Second})
+	assert.ErrorIs(t, err, ErrInvalidProtocolVersion)
+	if assert.True(t, errors.As(err, &qerr)) {
+		assert.Equal(t, "configure", qerr.Op)
+	}
+}
@@ -0,0 +1,266 @@
+// Copyright © 2015-2023 Brett Vickers.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ntp
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// A FaultInjector injects network faults into the connections used to make
+// NTP queries, so that the handling of degraded time sources can be tested.
+// Queries and responses may be dropped, and responses may be delayed,
+// reordered, duplicated, corrupted, truncated, or altered to look spoofed.
+//
+// Each fault is applied with the configured probability, drawn from a
+// source seeded when the injector is created. Each connection draws from its
+// own source, seeded in the order connections are dialed, so that a sequence
+// of queries made with the same seed encounters the same faults.
+//
+// The fault probabilities should be configured before the injector is used.
+type FaultInjector struct {
+	// Drop is the probability that each query or response is dropped.
+	Drop float64
+
+	// Delay, if not nil, draws an additional delay for each response. A
+	// response delayed past the connection's read deadline is delivered by
+	// the connection's next read. Distributions from the ntpsim package may
+	// be used.
+	Delay func(r *rand.Rand) time.Duration
+
+	// Reorder is the probability that a response is held back and
+	// delivered after the next response received on the same connection.
+	// Since QueryWithOptions reads a single response from each connection,
+	// a reordered response to a query is lost unless the connection is
+	// reused.
+	Reorder float64
+
+	// Duplicate is the probability that a response is delivered twice.
+	Duplicate float64
+
+	// BitFlip is the probability that a single random bit of a response is
+	// inverted.
+	BitFlip float64
+
+	// Truncate is the probability that a response is truncated to a random
+	// shorter length.
+	Truncate float64
+
+	// SpoofMode is the probability that the mode of a response is replaced
+	// by a mode other than server mode.
+	SpoofMode float64
+
+	// SpoofOrigin is the probability that the origin timestamp of a response
+	// is altered, so that it no longer matches the query.
+	SpoofOrigin float64
+
+	mu    sync.Mutex
+	rand  *rand.Rand
+	stats FaultStats
+}
+
+// FaultStats counts the faults injected by a FaultInjector.
+type FaultStats struct {
+	DroppedQueries   uint64
+	DroppedResponses uint64
+	Delayed          uint64
+	Late             uint64
+	Reordered        uint64
+	Duplicated       uint64
+	BitFlips         uint64
+	Truncated        uint64
+	SpoofedModes     uint64
+	SpoofedOrigins   uint64
+}
+
+// NewFaultInjector returns a fault injector drawing its faults from a
+// source seeded with seed. No faults are injected until their probabilities
+// are configured.
+func NewFaultInjector(seed int64) *FaultInjector {
+	return &FaultInjector{rand: rand.New(rand.NewSource(seed))}
+}
+
+// Options returns a copy of opt whose Dialer injects faults into the
+// connections opened by the dialer that opt would otherwise use.
+func (f *FaultInjector) Options(opt QueryOptions) QueryOptions {
+	dial, owned := opt.Dialer, false
+	switch {
+	case opt.Dial != nil:
+		dialFn := opt.Dial
+		dial = func(la, ra string) (net.Conn, error) {
+			return dialWrapper(la, ra, dialFn)
+		}
+		opt.Dial = nil
+	case dial == nil:
+		dial, owned = defaultDialer, true
+	}
+
+	opt.Dialer = func(la, ra string) (net.Conn, error) {
+		con, err := dial(la, ra)
+		if err != nil {
+			return nil, err
+		}
+		c := f.wrap(con)
+		c.owned = owned
+		return c, nil
+	}
+	return opt
+}
+
+// Wrap returns a connection that injects faults into the packets written to
+// and read from con. Closing the returned connection closes con.
+func (f *FaultInjector) Wrap(con net.Conn) net.Conn {
+	return f.wrap(con)
+}
+
+// Stats returns the number of faults injected so far.
+func (f *FaultInjector) Stats() FaultStats {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.stats
+}
+
+func (f *FaultInjector) wrap(con net.Conn) *faultConn {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.rand == nil {
+		f.rand = rand.New(rand.NewSource(1))
+	}
+	return &faultConn{
+		Conn: con,
+		f:    f,
+		rand: rand.New(rand.NewSource(f.rand.Int63())),
+	}
+}
+
+func (f *FaultInjector) count(n *uint64) {
+	f.mu.Lock()
+	*n++
+	f.mu.Unlock()
+}
+
+// A faultConn injects faults into the packets sent and received over a
+// connection. Responses held back by reordering, duplicated, or delivered
+// late are queued for delivery by subsequent reads.
+type faultConn struct {
+	net.Conn
+	f        *FaultInjector
+	rand     *rand.Rand
+	owned    bool
+	deadline time.Time
+	held     []byte
+	pending  [][]byte
+}
+
+func (c *faultConn) chance(p float64) bool {
+	return p > 0 && c.rand.Float64() < p
+}
+
+func (c *faultConn) Write(b []byte) (int, error) {
+	if c.chance(c.f.Drop) {
+		c.f.count(&c.f.stats.DroppedQueries)
+		return len(b), nil
+	}
+	return c.Conn.Write(b)
+}
+
+func (c *faultConn) unwrap() (net.Conn, bool) {
+	return c.Conn, c.owned
+}
+
+func (c *faultConn) Read(b []byte) (int, error) {
+	f := c.f
+	for {
+		if len(c.pending) > 0 {
+			p := c.pending[0]
+			c.pending = c.pending[1:]
+			return copy(b, p), nil
+		}
+
+		buf := make([]byte, len(b))
+		n, err := c.Conn.Read(buf)
+		if err != nil {
+			return 0, err
+		}
+		p := buf[:n]
+
+		if c.chance(f.Drop) {
+			f.count(&f.stats.DroppedResponses)
+			continue
+		}
+		if c.held == nil && c.chance(f.Reorder) {
+			f.count(&f.stats.Reordered)
+			c.held = p
+			continue
+		}
+		p = c.corrupt(p)
+		if c.held != nil {
+			c.pending = append(c.pending, c.held)
+			c.held = nil
+		}
+		if c.chance(f.Duplicate) {
+			f.count(&f.stats.Duplicated)
+			c.pending = append(c.pending, append([]byte(nil), p...))
+		}
+
+		if f.Delay != nil {
+			d := f.Delay(c.rand)
+			if d > 0 {
+				f.count(&f.stats.Delayed)
+				if !c.deadline.IsZero() && time.Until(c.deadline) < d {
+					// The response arrives too late for this read.
+					f.count(&f.stats.Late)
+					time.Sleep(time.Until(c.deadline))
+					c.pending = append([][]byte{p}, c.pending...)
+					return 0, os.ErrDeadlineExceeded
+				}
+				time.Sleep(d)
+			}
+		}
+		return copy(b, p), nil
+	}
+}
+
+// corrupt applies the configured corruption faults to the response p.
+func (c *faultConn) corrupt(p []byte) []byte {
+	f := c.f
+	if len(p) > 0 && c.chance(f.BitFlip) {
+		f.count(&f.stats.BitFlips)
+		i := c.rand.Intn(len(p) * 8)
+		p[i/8] ^= 1 << (i % 8)
+	}
+	if len(p) > 0 && c.chance(f.Truncate) {
+		f.count(&f.stats.Truncated)
+		p = p[:c.rand.Intn(len(p))]
+	}
+	if len(p) > 0 && c.chance(f.SpoofMode) {
+		f.count(&f.stats.SpoofedModes)
+		m := byte(c.rand.Intn(7))
+		if m >= byte(server) {
+			m++
+		}
+		p[0] = p[0]&^0x07 | m
+	}
+	if len(p) >= 32 && c.chance(f.SpoofOrigin) {
+		f.count(&f.stats.SpoofedOrigins)
+		origin := binary.BigEndian.Uint64(p[24:])
+		binary.BigEndian.PutUint64(p[24:], origin^(c.rand.Uint64()|1))
+	}
+	return p
+}
+
+func (c *faultConn) SetDeadline(t time.Time) error {
+	c.deadline = t
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *faultConn) SetReadDeadline(t time.Time) error {
+	c.deadline = t
+	return c.Conn.SetReadDeadline(t)
+}
@@ -0,0 +1,151 @@
+// Copyright © 2015-2023 Brett Vickers.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ntp
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOfflineFaultInjection(t *testing.T) {
+	addr := startTestServer(t, NewServer(ServerState{Stratum: 1}))
+	opt := QueryOptions{Timeout: 100 * time.Millisecond}
+
+	f := NewFaultInjector(1)
+	_, err := QueryWithOptions(addr, f.Options(opt))
+	assert.Nil(t, err)
+
+	f.Drop = 1
+	_, err = QueryWithOptions(addr, f.Options(opt))
+	assert.True(t, errors.Is(err, os.ErrDeadlineExceeded))
+	assert.Equal(t, uint64(1), f.Stats().DroppedQueries)
+
+	f = NewFaultInjector(1)
+	f.SpoofMode = 1
+	_, err = QueryWithOptions(addr, f.Options(opt))
+	assert.ErrorIs(t, err, ErrInvalidMode)
+
+	f = NewFaultInjector(1)
+	f.SpoofOrigin = 1
+	_, err = QueryWithOptions(addr, f.Options(opt))
+	assert.ErrorIs(t, err, ErrServerResponseMismatch)
+
+	f = NewFaultInjector(1)
+	f.Truncate = 1
+	_, err = QueryWithOptions(addr, f.Options(opt))
+	assert.NotNil(t, err)
+	assert.Equal(t, uint64(1), f.Stats().Truncated)
+
+	f = NewFaultInjector(1)
+	f.Delay = func(*rand.Rand) time.Duration { return 30 * time.Millisecond }
+	r, err := QueryWithOptions(addr, f.Options(opt))
+	if assert.Nil(t, err) {
+		assert.True(t, r.RTT >= 30*time.Millisecond)
+	}
+	f.Delay = func(*rand.Rand) time.Duration { return time.Second }
+	_, err = QueryWithOptions(addr, f.Options(opt))
+	assert.True(t, errors.Is(err, os.ErrDeadlineExceeded))
+	assert.Equal(t, uint64(1), f.Stats().Late)
+}
+
+func TestOfflineFaultReorderDuplicate(t *testing.T) {
+	addr := startTestServer(t, NewServer(ServerState{Stratum: 1}))
+	raddr, _ := net.ResolveUDPAddr("udp", addr)
+	con, err := net.DialUDP("udp", nil, raddr)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	f := NewFaultInjector(1)
+	f.Reorder = 1
+	f.Duplicate = 1
+	c := f.Wrap(con)
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(time.Second))
+
+	query := func(xmt ntpTime) {
+		h := header{LiVnMode: 4<<3 | byte(client), TransmitTime: xmt}
+		_, err := c.Write(h.appendTo(nil))
+		assert.Nil(t, err)
+	}
+	origin := func() ntpTime {
+		var h header
+		b := make([]byte, 128)
+		n, err := c.Read(b)
+		if !assert.Nil(t, err) || !assert.Equal(t, 48, n) {
+			return 0
+		}
+		h.unmarshal(b[:n])
+		return h.OriginTime
+	}
+
+	// The first response is held back until the second arrives, and the
+	// second is duplicated.
+	query(1)
+	query(2)
+	assert.Equal(t, ntpTime(2), origin())
+	assert.Equal(t, ntpTime(1), origin())
+	assert.Equal(t, ntpTime(2), origin())
+	stats := f.Stats()
+	assert.Equal(t, uint64(1), stats.Reordered)
+	assert.Equal(t, uint64(1), stats.Duplicated)
+}
+
+func TestOfflineFaultReproducible(t *testing.T) {
+	addr := startTestServer(t, NewServer(ServerState{Stratum: 1}))
+
+	run := func(seed int64) ([]bool, FaultStats) {
+		f := NewFaultInjector(seed)
+		f.Drop = 0.2
+		f.BitFlip = 0.3
+		f.SpoofOrigin = 0.2
+		opt := f.Options(QueryOptions{Timeout: 50 * time.Millisecond})
+		var ok []bool
+		for i := 0; i < 20; i++ {
+			_, err := QueryWithOptions(addr, opt)
+			ok = append(ok, err == nil)
+		}
+		return ok, f.Stats()
+	}
+
+	ok1, stats1 := run(7)
+	ok2, stats2 := run(7)
+	assert.Equal(t, ok1, ok2)
+	assert.Equal(t, stats1, stats2)
+	assert.Contains(t, ok1, true)
+	assert.Contains(t, ok1, false)
+}
+
+func TestOfflineFaultTTL(t *testing.T) {
+	addr := startTestServer(t, NewServer(ServerState{Stratum: 1}))
+	f := NewFaultInjector(1)
+	_, err := QueryWithOptions(addr, f.Options(QueryOptions{Timeout: time.Second, TTL: 32}))
+	assert.Nil(t, err)
+
+	// The TTL is also applied through a recorder wrapping the injector, and
+	// the connection opened by the default dialer is closed.
+	opt := NewRecorder(nil).Options(f.Options(QueryOptions{Timeout: time.Second, TTL: 32}))
+	dial := opt.Dialer
+	var con net.Conn
+	opt.Dialer = func(la, ra string) (net.Conn, error) {
+		var err error
+		con, err = dial(la, ra)
+		return con, err
+	}
+	_, err = QueryWithOptions(addr, opt)
+	assert.Nil(t, err)
+	if assert.NotNil(t, con) {
+		raw, owned := unwrapConn(con)
+		assert.True(t, owned)
+		_, err = raw.Write([]byte{0})
+		assert.ErrorIs(t, err, net.ErrClosed)
+	}
+}
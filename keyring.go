@@ -0,0 +1,322 @@
+// Copyright © 2015-2023 Brett Vickers.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ntp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// KeyFileFormat identifies the syntax of a symmetric key file.
+type KeyFileFormat int
+
+const (
+	// KeyFileNTPD is the ntp.keys format used by ntpd and NTPsec. Each line
+	// contains a key ID, a type name (e.g., "MD5", "SHA1" or "AES128CMAC")
+	// and a key. Keys of up to 20 characters are ASCII; longer keys are
+	// hex-encoded.
+	KeyFileNTPD KeyFileFormat = iota
+
+	// KeyFileChrony is the chrony.keys format used by chronyd. Each line
+	// contains a key ID, an optional type name (defaulting to "MD5") and a
+	// key. Keys are ASCII unless prefixed by "HEX:".
+	KeyFileChrony
+)
+
+// keyTypes maps key type names used in ntpd and chrony key files to
+// authentication types.
+var keyTypes = map[string]AuthType{
+	"M":            AuthMD5,
+	"MD5":          AuthMD5,
+	"SHA":          AuthSHA1,
+	"SHA1":         AuthSHA1,
+	"SHA256":       AuthSHA256,
+	"SHA512":       AuthSHA512,
+	"AES128":       AuthAES128,
+	"AES128CMAC":   AuthAES128,
+	"AES-128-CMAC": AuthAES128,
+	"AES256":       AuthAES256,
+	"AES256CMAC":   AuthAES256,
+	"AES-256-CMAC": AuthAES256,
+}
+
+// A Key is a symmetric authentication key.
+type Key struct {
+	// ID is the key identifier transmitted in the MAC of each packet.
+	ID uint16
+
+	// Type is the algorithm used to compute MACs with the key.
+	Type AuthType
+
+	// Secret is the decoded key material.
+	Secret []byte
+}
+
+// A KeyRing holds a set of symmetric authentication keys indexed by key ID.
+// A KeyRing may be assigned to AuthOptions.KeyRing to authenticate queries
+// using any of its keys. It is safe for concurrent use, and its keys may be
+// replaced at runtime using Load or LoadFile while queries are in flight.
+type KeyRing struct {
+	mu      sync.RWMutex
+	keys    map[uint16]Key
+	trusted map[uint16]bool
+	current uint16
+}
+
+// NewKeyRing returns a key ring containing the requested keys.
+func NewKeyRing(keys ...Key) *KeyRing {
+	k := &KeyRing{keys: make(map[uint16]Key)}
+	for _, key := range keys {
+		k.keys[key.ID] = key
+	}
+	return k
+}
+
+// LoadKeyFile reads a key file in the requested format and returns a key
+// ring containing its keys.
+func LoadKeyFile(path string, format KeyFileFormat) (*KeyRing, error) {
+	k := NewKeyRing()
+	if err := k.LoadFile(path, format); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// LoadFile reads a key file in the requested format and replaces the key
+// ring's keys with the keys it contains. On error, the key ring is left
+// unchanged. The set of trusted keys and the current key ID are retained.
+func (k *KeyRing) LoadFile(path string, format KeyFileFormat) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return k.Load(f, format)
+}
+
+// Load parses keys from r in the requested format and replaces the key
+// ring's keys with them. On error, the key ring is left unchanged. The set
+// of trusted keys and the current key ID are retained.
+func (k *KeyRing) Load(r io.Reader, format KeyFileFormat) error {
+	keys, err := ParseKeys(r, format)
+	if err != nil {
+		return err
+	}
+
+	m := make(map[uint16]Key, len(keys))
+	for _, key := range keys {
+		m[key.ID] = key
+	}
+
+	k.mu.Lock()
+	k.keys = m
+	k.mu.Unlock()
+	return nil
+}
+
+// ParseKeys parses a key file in the requested format. Blank lines and
+// comments starting with '#' are ignored.
+func ParseKeys(r io.Reader, format KeyFileFormat) ([]Key, error) {
+	var keys []Key
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := s.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		key, err := parseKey(fields, format)
+		if err != nil {
+			return nil, fmt.Errorf("%w: line %d: %v", ErrInvalidKeyFile, n, err)
+		}
+		keys = append(keys, key)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func parseKey(fields []string, format KeyFileFormat) (Key, error) {
+	if format == KeyFileChrony && len(fields) == 2 {
+		fields = []string{fields[0], "MD5", fields[1]}
+	}
+	if len(fields) != 3 {
+		return Key{}, fmt.Errorf("expected 3 fields, found %d", len(fields))
+	}
+
+	id, err := strconv.ParseUint(fields[0], 10, 16)
+	if err != nil || id == 0 {
+		return Key{}, fmt.Errorf("invalid key ID %q", fields[0])
+	}
+
+	typ, ok := keyTypes[strings.ToUpper(fields[1])]
+	if !ok {
+		typ, ok = ParseAuthType(fields[1])
+	}
+	if !ok {
+		return Key{}, fmt.Errorf("unsupported key type %q", fields[1])
+	}
+
+	secret := fields[2]
+	if format == KeyFileChrony && !strings.HasPrefix(secret, "HEX:") &&
+		!strings.HasPrefix(secret, "ASCII:") {
+		secret = "ASCII:" + secret
+	}
+	b, err := decodeAuthKey(AuthOptions{Type: typ, Key: secret})
+	if err != nil {
+		return Key{}, fmt.Errorf("key %d: %v", id, err)
+	}
+
+	return Key{ID: uint16(id), Type: typ, Secret: b}, nil
+}
+
+// Add adds keys to the key ring, replacing any existing keys with the same
+// IDs.
+func (k *KeyRing) Add(keys ...Key) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for _, key := range keys {
+		k.keys[key.ID] = key
+	}
+}
+
+// Remove removes the keys with the requested IDs from the key ring.
+func (k *KeyRing) Remove(ids ...uint16) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for _, id := range ids {
+		delete(k.keys, id)
+	}
+}
+
+// Key returns the key with the requested ID.
+func (k *KeyRing) Key(id uint16) (Key, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	key, ok := k.keys[id]
+	return key, ok
+}
+
+// IDs returns the IDs of all keys in the key ring, in ascending order.
+func (k *KeyRing) IDs() []uint16 {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	ids := make([]uint16, 0, len(k.keys))
+	for id := range k.keys {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// SetTrusted replaces the set of trusted key IDs. Only trusted keys are
+// used to authenticate queries and responses. If no trusted keys are set,
+// all keys in the key ring are trusted.
+func (k *KeyRing) SetTrusted(ids ...uint16) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if len(ids) == 0 {
+		k.trusted = nil
+		return
+	}
+	k.trusted = make(map[uint16]bool, len(ids))
+	for _, id := range ids {
+		k.trusted[id] = true
+	}
+}
+
+// Trusted returns true if the key with the requested ID is present in the
+// key ring and trusted.
+func (k *KeyRing) Trusted(id uint16) bool {
+	_, ok := k.trustedKey(id)
+	return ok
+}
+
+// Use selects the key used to authenticate queries when AuthOptions.KeyID
+// is zero.
+func (k *KeyRing) Use(id uint16) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.current = id
+}
+
+// trustedKey returns the key with the requested ID if it is trusted. A key
+// ID of zero selects the current key.
+func (k *KeyRing) trustedKey(id uint16) (Key, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	if id == 0 {
+		id = k.current
+	}
+	key, ok := k.keys[id]
+	if !ok || (k.trusted != nil && !k.trusted[id]) {
+		return Key{}, false
+	}
+	return key, true
+}
+
+// verifyMAC authenticates the message in buf using the trusted key whose ID
+// appears in the message's MAC.
+func (k *KeyRing) verifyMAC(buf []byte) error {
+	_, err := k.authenticate(buf)
+	return err
+}
+
+// authenticate authenticates the message in buf using the trusted key whose
+// ID appears in the message's MAC, and returns the key.
+func (k *KeyRing) authenticate(buf []byte) (Key, error) {
+	sizes := digestSizes()
+	if err := checkMACLength(buf, 4+sizes[0]); err != nil {
+		return Key{}, err
+	}
+
+	// The length of the MAC depends on the key's algorithm, so try each
+	// possible digest size. The digest of a longer MAC may happen to hold a
+	// trusted key ID, so a failed verification doesn't end the search.
+	keyID := binary.BigEndian.Uint32(buf[len(buf)-4-sizes[0]:])
+	var firstErr error
+	for _, size := range sizes {
+		macLen := 4 + size
+		if len(buf)-48 < macLen {
+			continue
+		}
+		id := binary.BigEndian.Uint32(buf[len(buf)-macLen:])
+		if id == 0 || id > 0xffff {
+			continue
+		}
+		keyID = id // report the plausible key ID on failure
+		key, ok := k.trustedKey(uint16(id))
+		if !ok {
+			continue
+		}
+		if a, ok := key.Type.Algorithm(); !ok || a.DigestSize != size {
+			continue
+		}
+		opt := AuthOptions{Type: key.Type, KeyID: key.ID}
+		err := verifyMAC(buf, opt, key.Secret)
+		if err == nil {
+			return key, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr != nil {
+		return Key{}, firstErr
+	}
+	return Key{}, &AuthError{AuthWrongKeyID, keyID}
+}
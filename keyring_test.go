@@ -0,0 +1,198 @@
+// Copyright © 2015-2023 Brett Vickers.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ntp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testNtpdKeys = `
+# ntpd key file
+1 M     cvuZyN4C8HX8hNcAWDWp
+2 SHA1  6931564b4a5a5045766c55356b30656c7666316c  # SHA-1
+3 sha256 7133736e777057764256777739706a5533326164
+4 SHA512 597675555446585868494d447543425971526e74
+5 AES128CMAC 68663033736f77706568707164304049
+`
+
+const testChronyKeys = `
+1 cvuZyN4C8HX8hNcAWDWp
+2 SHA1 HEX:6931564b4a5a5045766c55356b30656c7666316c
+3 SHA256 ASCII:q3snwpWvBVww9pjU32ad
+5 AES128 HEX:68663033736f77706568707164304049
+6 AES256 HEX:47cb76a9a507cf26dc00eb0935f082f390f10308c3e0d58716273a63259a758a
+`
+
+func TestOfflineParseKeys(t *testing.T) {
+	ntpd, err := ParseKeys(strings.NewReader(testNtpdKeys), KeyFileNTPD)
+	assert.Nil(t, err)
+	chrony, err := ParseKeys(strings.NewReader(testChronyKeys), KeyFileChrony)
+	assert.Nil(t, err)
+
+	types := []AuthType{AuthMD5, AuthSHA1, AuthSHA256, AuthSHA512, AuthAES128}
+	if assert.Len(t, ntpd, len(types)) {
+		for i, key := range ntpd {
+			assert.Equal(t, uint16(i+1), key.ID)
+			assert.Equal(t, types[i], key.Type)
+		}
+	}
+
+	// Both formats decode to the same key material.
+	if assert.Len(t, chrony, 5) {
+		assert.Equal(t, AuthMD5, chrony[0].Type)
+		assert.Equal(t, ntpd[0].Secret, chrony[0].Secret)
+		assert.Equal(t, ntpd[1].Secret, chrony[1].Secret)
+		assert.Equal(t, ntpd[2].Secret, chrony[2].Secret)
+		assert.Equal(t, ntpd[4].Secret, chrony[3].Secret)
+		assert.Equal(t, AuthAES256, chrony[4].Type)
+		assert.Len(t, chrony[4].Secret, 32)
+	}
+
+	for _, bad := range []string{
+		"1 MD5",
+		"0 MD5 abcdefgh",
+		"70000 MD5 abcdefgh",
+		"1 RMD160 abcdefgh",
+		"1 MD5 abc",
+		"1 AES128CMAC 0011",
+		"1 SHA1 HEX:zz",
+	} {
+		_, err := ParseKeys(strings.NewReader(bad), KeyFileNTPD)
+		assert.True(t, errors.Is(err, ErrInvalidKeyFile), bad)
+	}
+}
+
+func TestOfflineKeyRing(t *testing.T) {
+	k := NewKeyRing()
+	assert.Nil(t, k.Load(strings.NewReader(testNtpdKeys), KeyFileNTPD))
+	assert.Equal(t, []uint16{1, 2, 3, 4, 5}, k.IDs())
+
+	// Select keys by ID, or use the current key.
+	opt, secret, err := resolveAuth(AuthOptions{KeyRing: k, KeyID: 2})
+	assert.Nil(t, err)
+	assert.Equal(t, AuthSHA1, opt.Type)
+	assert.Equal(t, uint16(2), opt.KeyID)
+	assert.Len(t, secret, 20)
+
+	_, _, err = resolveAuth(AuthOptions{KeyRing: k})
+	assert.Equal(t, ErrUnknownKey, err)
+	k.Use(5)
+	opt, _, err = resolveAuth(AuthOptions{KeyRing: k})
+	assert.Nil(t, err)
+	assert.Equal(t, AuthAES128, opt.Type)
+
+	// Only trusted keys are used.
+	k.SetTrusted(1, 2)
+	assert.True(t, k.Trusted(1))
+	assert.False(t, k.Trusted(3))
+	_, _, err = resolveAuth(AuthOptions{KeyRing: k, KeyID: 3})
+	assert.Equal(t, ErrUnknownKey, err)
+	k.SetTrusted()
+	assert.True(t, k.Trusted(3))
+
+	// Reloading replaces the keys but retains the current key.
+	assert.Nil(t, k.Load(strings.NewReader(testChronyKeys), KeyFileChrony))
+	assert.Equal(t, []uint16{1, 2, 3, 5, 6}, k.IDs())
+	key, ok := k.Key(1)
+	assert.True(t, ok)
+	assert.Equal(t, AuthMD5, key.Type)
+	opt, _, _ = resolveAuth(AuthOptions{KeyRing: k})
+	assert.Equal(t, uint16(5), opt.KeyID)
+
+	// A failed reload leaves the keys unchanged.
+	err = k.Load(strings.NewReader("1 BOGUS key"), KeyFileNTPD)
+	assert.True(t, errors.Is(err, ErrInvalidKeyFile))
+	assert.Equal(t, []uint16{1, 2, 3, 5, 6}, k.IDs())
+
+	k.Remove(6)
+	k.Add(Key{ID: 7, Type: AuthMD5, Secret: []byte("secret")})
+	assert.Equal(t, []uint16{1, 2, 3, 5, 7}, k.IDs())
+}
+
+func TestOfflineKeyRingVerifyMAC(t *testing.T) {
+	k := NewKeyRing()
+	assert.Nil(t, k.Load(strings.NewReader(testChronyKeys), KeyFileChrony))
+
+	for _, id := range k.IDs() {
+		key, _ := k.Key(id)
+		var buf bytes.Buffer
+		buf.Write(make([]byte, 48))
+		appendMAC(&buf, AuthOptions{Type: key.Type, KeyID: key.ID}, key.Secret)
+
+		// The response is verified using the key ID chosen by the server.
+		assert.Nil(t, verifyMAC(buf.Bytes(), AuthOptions{KeyRing: k, KeyID: 1}, nil), id)
+
+		// Untrusted keys are rejected.
+		k.SetTrusted(id + 1)
+		err := verifyMAC(buf.Bytes(), AuthOptions{KeyRing: k}, nil)
+		assert.Equal(t, &AuthError{AuthWrongKeyID, uint32(id)}, err, id)
+		k.SetTrusted()
+
+		// Tampered messages are rejected.
+		b := buf.Bytes()
+		b[0] ^= 1
+		err = verifyMAC(b, AuthOptions{KeyRing: k}, nil)
+		assert.Equal(t, &AuthError{AuthDigestMismatch, uint32(id)}, err, id)
+	}
+}
+
+func TestOfflineKeyRingVerifyMACSizes(t *testing.T) {
+	long := Key{ID: 9, Type: AuthHMACSHA256, Secret: []byte("0123456789abcdef")}
+
+	// Find a message whose 32-byte digest holds, where a 20-byte digest's
+	// key ID would be, a plausible key ID.
+	var buf bytes.Buffer
+	var id uint32
+	for i := uint32(0); ; i++ {
+		buf.Reset()
+		var hdr [48]byte
+		binary.BigEndian.PutUint32(hdr[44:], i)
+		buf.Write(hdr[:])
+		appendMAC(&buf, AuthOptions{Type: long.Type, KeyID: long.ID}, long.Secret)
+		b := buf.Bytes()
+		id = binary.BigEndian.Uint32(b[len(b)-24:])
+		if id != 0 && id <= 0xffff && id != uint32(long.ID) {
+			break
+		}
+	}
+
+	// The message is verified although the shorter key's MAC doesn't match.
+	short := Key{ID: uint16(id), Type: AuthSHA1, Secret: []byte("fedcba9876543210")}
+	k := NewKeyRing(short, long)
+	key, err := k.authenticate(buf.Bytes())
+	assert.Nil(t, err)
+	assert.Equal(t, long.ID, key.ID)
+}
+
+func TestOfflineKeyRingConcurrentReload(t *testing.T) {
+	k := NewKeyRing()
+	assert.Nil(t, k.Load(strings.NewReader(testNtpdKeys), KeyFileNTPD))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				k.Load(strings.NewReader(testNtpdKeys), KeyFileNTPD)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				_, _, err := resolveAuth(AuthOptions{KeyRing: k, KeyID: 2})
+				assert.Nil(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+}
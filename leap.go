@@ -0,0 +1,299 @@
+// Copyright © 2015-2023 Brett Vickers.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ntp
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// gpsToTAI is the constant offset between GPS time and TAI. GPS time was
+// aligned with UTC at its epoch (1980-01-06), when TAI-UTC was 19 seconds.
+const gpsToTAI = 19 * time.Second
+
+// CheckLeapTable verifies that the server's leap indicator agrees with a
+// leap second table. See LeapTable.ValidationCheck.
+const CheckLeapTable ValidationCheck = "leap table"
+
+// A LeapEntry records a change in the offset between TAI and UTC.
+type LeapEntry struct {
+	// Time is the UTC time at which the new offset takes effect. It is the
+	// first second of the day following the leap second.
+	Time time.Time
+
+	// TAIOffset is the value of TAI-UTC, in seconds, from Time onward.
+	TAIOffset int
+
+	// Leap indicates whether a second was inserted (LeapAddSecond) or
+	// deleted (LeapDelSecond) at the end of the day preceding Time. It is
+	// LeapNoWarning for the first entry of a table, which establishes the
+	// initial offset.
+	Leap LeapIndicator
+}
+
+// A LeapTable is a table of leap seconds, such as the one published by the
+// IERS and NIST in the leap-seconds.list file. The same file is used by the
+// ntpd "leapfile" and chrony "leapseclist" configuration directives.
+type LeapTable struct {
+	// Updated is the time the table was last updated.
+	Updated time.Time
+
+	// Expires is the time after which the table may no longer list all
+	// scheduled leap seconds.
+	Expires time.Time
+
+	// Entries lists the changes in TAI-UTC, sorted by time.
+	Entries []LeapEntry
+
+	// Verified is true if the table was parsed from a file containing a
+	// SHA-1 hash that matched the file's contents.
+	Verified bool
+}
+
+// LoadLeapSecondsFile reads and parses the leap-seconds.list file at path.
+// See ParseLeapSecondsList for details.
+func LoadLeapSecondsFile(path string) (*LeapTable, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseLeapSecondsList(f)
+}
+
+// ParseLeapSecondsList parses a leap second table in the IERS/NIST
+// leap-seconds.list format. If the file contains a SHA-1 hash ("#h" line),
+// the hash is verified and ErrLeapFileHash is returned if it does not match
+// the file's contents. The table's expiration time is not checked; use
+// LeapTable.Expired to do so.
+func ParseLeapSecondsList(r io.Reader) (*LeapTable, error) {
+	t := &LeapTable{}
+	h := sha1.New()
+	var hash []byte
+
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := s.Text()
+		fail := func() (*LeapTable, error) {
+			return nil, fmt.Errorf("%w: line %d: %q", ErrInvalidLeapFile, n, line)
+		}
+
+		switch {
+		case strings.HasPrefix(line, "#$"), strings.HasPrefix(line, "#@"):
+			sec, err := strconv.ParseUint(strings.TrimSpace(line[2:]), 10, 64)
+			if err != nil {
+				return fail()
+			}
+			h.Write(hashDigits(line[2:]))
+			if line[1] == '$' {
+				t.Updated = ntpSecondsToTime(sec)
+			} else {
+				t.Expires = ntpSecondsToTime(sec)
+			}
+
+		case strings.HasPrefix(line, "#h"):
+			words := strings.Fields(line[2:])
+			if len(words) != sha1.Size/4 {
+				return fail()
+			}
+			hash = make([]byte, 0, sha1.Size)
+			for _, w := range words {
+				v, err := strconv.ParseUint(w, 16, 32)
+				if err != nil {
+					return fail()
+				}
+				var b [4]byte
+				binary.BigEndian.PutUint32(b[:], uint32(v))
+				hash = append(hash, b[:]...)
+			}
+
+		case strings.HasPrefix(line, "#"), strings.TrimSpace(line) == "":
+			// Ignore comments and blank lines.
+
+		default:
+			data := line
+			if i := strings.IndexByte(data, '#'); i >= 0 {
+				data = data[:i]
+			}
+			fields := strings.Fields(data)
+			if len(fields) != 2 {
+				return fail()
+			}
+			sec, err := strconv.ParseUint(fields[0], 10, 64)
+			if err != nil {
+				return fail()
+			}
+			offset, err := strconv.Atoi(fields[1])
+			if err != nil {
+				return fail()
+			}
+			h.Write(hashDigits(data))
+
+			e := LeapEntry{Time: ntpSecondsToTime(sec), TAIOffset: offset}
+			if len(t.Entries) > 0 {
+				prev := t.Entries[len(t.Entries)-1]
+				switch {
+				case !e.Time.After(prev.Time):
+					return fail()
+				case e.TAIOffset > prev.TAIOffset:
+					e.Leap = LeapAddSecond
+				case e.TAIOffset < prev.TAIOffset:
+					e.Leap = LeapDelSecond
+				}
+			}
+			t.Entries = append(t.Entries, e)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(t.Entries) == 0 {
+		return nil, fmt.Errorf("%w: no leap second entries", ErrInvalidLeapFile)
+	}
+	if hash != nil {
+		if !bytes.Equal(hash, h.Sum(nil)) {
+			return nil, ErrLeapFileHash
+		}
+		t.Verified = true
+	}
+	return t, nil
+}
+
+// hashDigits returns the decimal digits contained in the data portion of a
+// leap-seconds.list line. The file's hash is computed over these digits
+// only, ignoring whitespace and comments.
+func hashDigits(s string) []byte {
+	var b []byte
+	for i := 0; i < len(s) && s[i] != '#'; i++ {
+		if s[i] >= '0' && s[i] <= '9' {
+			b = append(b, s[i])
+		}
+	}
+	return b
+}
+
+// ntpSecondsToTime converts a count of seconds since the start of NTP era
+// 0 into a UTC time.
+func ntpSecondsToTime(sec uint64) time.Time {
+	return time.Unix(int64(sec)-unixToNtp, 0).UTC()
+}
+
+// Expired returns true if the table has expired at time now.
+func (t *LeapTable) Expired(now time.Time) bool {
+	return !t.Expires.IsZero() && !now.Before(t.Expires)
+}
+
+// TAIOffset returns the value of TAI-UTC, in seconds, at the UTC time utc.
+// Zero is returned for times preceding the table's first entry.
+func (t *LeapTable) TAIOffset(utc time.Time) int {
+	i := sort.Search(len(t.Entries), func(i int) bool {
+		return t.Entries[i].Time.After(utc)
+	})
+	if i == 0 {
+		return 0
+	}
+	return t.Entries[i-1].TAIOffset
+}
+
+// NextLeap returns the first leap second scheduled after the UTC time utc.
+// It returns false if the table lists no such leap second.
+func (t *LeapTable) NextLeap(utc time.Time) (LeapEntry, bool) {
+	i := sort.Search(len(t.Entries), func(i int) bool {
+		return t.Entries[i].Time.After(utc)
+	})
+	for ; i < len(t.Entries); i++ {
+		if t.Entries[i].Leap != LeapNoWarning {
+			return t.Entries[i], true
+		}
+	}
+	return LeapEntry{}, false
+}
+
+// UTCToTAI converts the UTC time utc to TAI. The returned time.Time value
+// holds a TAI clock reading and should not be compared with UTC times.
+func (t *LeapTable) UTCToTAI(utc time.Time) time.Time {
+	return utc.Add(time.Duration(t.TAIOffset(utc)) * time.Second)
+}
+
+// TAIToUTC converts the TAI clock reading tai to UTC.
+func (t *LeapTable) TAIToUTC(tai time.Time) time.Time {
+	i := sort.Search(len(t.Entries), func(i int) bool {
+		e := t.Entries[i]
+		return e.Time.Add(time.Duration(e.TAIOffset) * time.Second).After(tai)
+	})
+	if i == 0 {
+		return tai
+	}
+	return tai.Add(-time.Duration(t.Entries[i-1].TAIOffset) * time.Second)
+}
+
+// UTCToGPS converts the UTC time utc to GPS time. The returned time.Time
+// value holds a GPS clock reading and should not be compared with UTC times.
+func (t *LeapTable) UTCToGPS(utc time.Time) time.Time {
+	return t.UTCToTAI(utc).Add(-gpsToTAI)
+}
+
+// GPSToUTC converts the GPS clock reading gps to UTC.
+func (t *LeapTable) GPSToUTC(gps time.Time) time.Time {
+	return t.TAIToUTC(gps.Add(gpsToTAI))
+}
+
+// LeapIndicator returns the leap indicator an NTP server should report at
+// the UTC time utc: LeapAddSecond or LeapDelSecond if the table schedules
+// a leap second at the end of the current month, and LeapNoWarning
+// otherwise.
+func (t *LeapTable) LeapIndicator(utc time.Time) LeapIndicator {
+	e, ok := t.NextLeap(utc)
+	if !ok {
+		return LeapNoWarning
+	}
+	y, m, _ := utc.UTC().Date()
+	if !e.Time.Equal(time.Date(y, m+1, 1, 0, 0, 0, 0, time.UTC)) {
+		return LeapNoWarning
+	}
+	return e.Leap
+}
+
+// ValidationCheck returns a function, suitable for use in
+// ValidationPolicy.Custom, that verifies a response's leap indicator agrees
+// with the table. A server announcing a leap second the table does not
+// schedule for the end of the current month fails the check, as does a
+// server that fails to announce a scheduled leap second during the final
+// day before it occurs. The check is skipped if the table has expired at
+// the response's transmit time, and for unsynchronized servers.
+//
+// A failure is reported as a *ValidationError whose Limit holds the leap
+// indicator expected by the table.
+func (t *LeapTable) ValidationCheck() func(r *Response) error {
+	return func(r *Response) error {
+		if r.Leap == LeapNotInSync || t.Expired(r.Time) {
+			return nil
+		}
+
+		expected := t.LeapIndicator(r.Time)
+		switch {
+		case r.Leap == expected:
+			return nil
+		case r.Leap == LeapNoWarning:
+			// Servers are not required to announce a leap second for the
+			// entire month, but should do so during its final day.
+			e, _ := t.NextLeap(r.Time)
+			if e.Time.Sub(r.Time) > 24*time.Hour {
+				return nil
+			}
+		}
+		return &ValidationError{CheckLeapTable, r.Leap, expected, ErrLeapMismatch}
+	}
+}
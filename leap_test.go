@@ -0,0 +1,154 @@
+// Copyright © 2015-2023 Brett Vickers.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ntp
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func loadTestLeapTable(t *testing.T) *LeapTable {
+	lt, err := LoadLeapSecondsFile("testdata/leap-seconds.list")
+	if err != nil {
+		t.Fatalf("failed to load leap table: %v", err)
+	}
+	return lt
+}
+
+func TestOfflineLeapTableParse(t *testing.T) {
+	lt := loadTestLeapTable(t)
+	assert.True(t, lt.Verified)
+	assert.Equal(t, time.Date(2025, 7, 7, 0, 0, 0, 0, time.UTC), lt.Updated)
+	assert.Equal(t, time.Date(2026, 6, 28, 0, 0, 0, 0, time.UTC), lt.Expires)
+	assert.Len(t, lt.Entries, 28)
+
+	first := lt.Entries[0]
+	assert.Equal(t, time.Date(1972, 1, 1, 0, 0, 0, 0, time.UTC), first.Time)
+	assert.Equal(t, 10, first.TAIOffset)
+	assert.Equal(t, LeapNoWarning, first.Leap)
+
+	last := lt.Entries[len(lt.Entries)-1]
+	assert.Equal(t, time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC), last.Time)
+	assert.Equal(t, 37, last.TAIOffset)
+	assert.Equal(t, LeapIndicator(LeapAddSecond), last.Leap)
+
+	assert.False(t, lt.Expired(time.Date(2026, 6, 27, 0, 0, 0, 0, time.UTC)))
+	assert.True(t, lt.Expired(time.Date(2026, 6, 28, 0, 0, 0, 0, time.UTC)))
+}
+
+func TestOfflineLeapTableHash(t *testing.T) {
+	b, err := os.ReadFile("testdata/leap-seconds.list")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := string(b)
+
+	// Tampering with an entry invalidates the hash.
+	tampered := strings.Replace(data, "3692217600      37", "3692217600      38", 1)
+	assert.NotEqual(t, data, tampered)
+	_, err = ParseLeapSecondsList(strings.NewReader(tampered))
+	assert.ErrorIs(t, err, ErrLeapFileHash)
+
+	// Comments are not covered by the hash.
+	commented := strings.Replace(data, "# 1 Jan 2017", "# New Year's Day 2017", 1)
+	lt, err := ParseLeapSecondsList(strings.NewReader(commented))
+	assert.Nil(t, err)
+	assert.True(t, lt.Verified)
+
+	// Files without a hash are accepted but not verified.
+	lines := strings.Split(data, "\n")
+	var unhashed []string
+	for _, l := range lines {
+		if !strings.HasPrefix(l, "#h") {
+			unhashed = append(unhashed, l)
+		}
+	}
+	lt, err = ParseLeapSecondsList(strings.NewReader(strings.Join(unhashed, "\n")))
+	assert.Nil(t, err)
+	assert.False(t, lt.Verified)
+
+	for _, bad := range []string{
+		"",
+		"# comments only\n",
+		"2272060800 10 5\n",
+		"2272060800 ten\n",
+		"2287785600 11\n2272060800 10\n",
+		"2272060800 10\n#h 1 2 3\n",
+	} {
+		_, err = ParseLeapSecondsList(strings.NewReader(bad))
+		assert.True(t, errors.Is(err, ErrInvalidLeapFile), bad)
+	}
+}
+
+func TestOfflineLeapTableOffsets(t *testing.T) {
+	lt := loadTestLeapTable(t)
+
+	leap := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	assert.Equal(t, 0, lt.TAIOffset(time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC)))
+	assert.Equal(t, 36, lt.TAIOffset(leap.Add(-time.Nanosecond)))
+	assert.Equal(t, 37, lt.TAIOffset(leap))
+
+	e, ok := lt.NextLeap(time.Date(2016, 6, 1, 0, 0, 0, 0, time.UTC))
+	assert.True(t, ok)
+	assert.Equal(t, leap, e.Time)
+	_, ok = lt.NextLeap(leap)
+	assert.False(t, ok)
+
+	utc := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	tai := lt.UTCToTAI(utc)
+	assert.Equal(t, utc.Add(37*time.Second), tai)
+	assert.Equal(t, utc, lt.TAIToUTC(tai))
+
+	gps := lt.UTCToGPS(utc)
+	assert.Equal(t, utc.Add(18*time.Second), gps)
+	assert.Equal(t, utc, lt.GPSToUTC(gps))
+
+	// TAI clock readings across a leap second.
+	before := leap.Add(-time.Second)
+	assert.Equal(t, before, lt.TAIToUTC(lt.UTCToTAI(before)))
+	assert.Equal(t, leap, lt.TAIToUTC(lt.UTCToTAI(leap)))
+	assert.Equal(t, 2*time.Second, lt.UTCToTAI(leap).Sub(lt.UTCToTAI(before)))
+}
+
+func TestOfflineLeapTableValidationCheck(t *testing.T) {
+	lt := loadTestLeapTable(t)
+	check := lt.ValidationCheck()
+
+	cases := []struct {
+		time  time.Time
+		leap  LeapIndicator
+		valid bool
+	}{
+		{time.Date(2016, 12, 1, 0, 0, 0, 0, time.UTC), LeapAddSecond, true},
+		{time.Date(2016, 12, 1, 0, 0, 0, 0, time.UTC), LeapNoWarning, true},
+		{time.Date(2016, 12, 31, 12, 0, 0, 0, time.UTC), LeapNoWarning, false},
+		{time.Date(2016, 12, 31, 12, 0, 0, 0, time.UTC), LeapDelSecond, false},
+		{time.Date(2016, 11, 30, 12, 0, 0, 0, time.UTC), LeapAddSecond, false},
+		{time.Date(2020, 6, 30, 12, 0, 0, 0, time.UTC), LeapAddSecond, false},
+		{time.Date(2020, 6, 30, 12, 0, 0, 0, time.UTC), LeapNotInSync, true},
+		{time.Date(2030, 6, 30, 12, 0, 0, 0, time.UTC), LeapAddSecond, true}, // expired
+	}
+	for _, c := range cases {
+		r := &Response{Time: c.time, Leap: c.leap}
+		err := check(r)
+		if c.valid {
+			assert.Nil(t, err, c.time)
+		} else {
+			assert.ErrorIs(t, err, ErrLeapMismatch, c.time)
+		}
+	}
+
+	r := &Response{Time: time.Date(2020, 6, 30, 12, 0, 0, 0, time.UTC), Leap: LeapAddSecond}
+	var verr *ValidationError
+	if assert.True(t, errors.As(check(r), &verr)) {
+		assert.Equal(t, CheckLeapTable, verr.Check)
+		assert.Equal(t, LeapNoWarning, verr.Limit)
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright © 2015-2023 Brett Vickers.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ntp
+
+// A Logger receives debug logs describing the packets exchanged by queries,
+// servers and relays. A *slog.Logger satisfies Logger, as does any logger
+// with a Debug method accepting a message followed by alternating attribute
+// keys and values.
+//
+// Logs use the following attribute keys consistently:
+//
+//	server           address of the server queried
+//	client           address of the client that sent a query
+//	op               query step that failed (see QueryError)
+//	err              error that caused a packet to be rejected
+//	reason           reason a server discarded a query
+//	leap, version, mode, stratum, poll, precision,
+//	root_delay, root_dispersion, reference_id, reference_time,
+//	origin_time, receive_time, transmit_time
+//	                 raw header fields of a received response
+//	len              length of a packet
+//	offset, rtt      computed clock offset and round-trip time
+//	root_distance    computed root distance
+//	kiss_code        kiss code sent or received
+//	key_id           ID of the key used to authenticate a packet
+type Logger interface {
+	Debug(msg string, args ...interface{})
+}
+
+// Log attribute keys.
+const (
+	logServer       = "server"
+	logClient       = "client"
+	logOp           = "op"
+	logErr          = "err"
+	logReason       = "reason"
+	logLen          = "len"
+	logOffset       = "offset"
+	logRTT          = "rtt"
+	logRootDistance = "root_distance"
+	logKissCode     = "kiss_code"
+	logKeyID        = "key_id"
+	logStratum      = "stratum"
+	logReferenceID  = "reference_id"
+)
+
+// headerAttrs returns the raw fields of the header h as log attributes.
+func headerAttrs(h *header, args ...interface{}) []interface{} {
+	return append(args,
+		"leap", uint8(h.getLeap()),
+		"version", h.getVersion(),
+		"mode", uint8(h.getMode()),
+		logStratum, h.Stratum,
+		"poll", h.Poll,
+		"precision", h.Precision,
+		"root_delay", ShortTimestamp(h.RootDelay),
+		"root_dispersion", ShortTimestamp(h.RootDispersion),
+		logReferenceID, h.ReferenceID,
+		"reference_time", Timestamp(h.ReferenceTime),
+		"origin_time", Timestamp(h.OriginTime),
+		"receive_time", Timestamp(h.ReceiveTime),
+		"transmit_time", Timestamp(h.TransmitTime),
+	)
+}
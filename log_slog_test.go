@@ -0,0 +1,32 @@
+// Copyright © 2015-2023 Brett Vickers.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package ntp
+
+import (
+	"bytes"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOfflineSlogLogger(t *testing.T) {
+	addr := startTestServer(t, NewServer(ServerState{Stratum: 1}))
+
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	_, err := QueryWithOptions(addr, QueryOptions{Timeout: time.Second, Logger: logger})
+	assert.Nil(t, err)
+
+	out := buf.String()
+	assert.Contains(t, out, `msg="ntp response received" server=`+addr)
+	assert.Contains(t, out, "stratum=1")
+	assert.Contains(t, out, `msg="ntp query complete"`)
+	assert.Contains(t, out, "offset=")
+}
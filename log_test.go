@@ -0,0 +1,129 @@
+// Copyright © 2015-2023 Brett Vickers.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ntp
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// A testLogger records the messages logged to it, along with their
+// attributes.
+type testLogger struct {
+	mu   sync.Mutex
+	logs []testLog
+}
+
+type testLog struct {
+	msg   string
+	attrs map[string]interface{}
+}
+
+func (l *testLogger) Debug(msg string, args ...interface{}) {
+	attrs := make(map[string]interface{})
+	for i := 0; i+1 < len(args); i += 2 {
+		attrs[fmt.Sprint(args[i])] = args[i+1]
+	}
+	l.mu.Lock()
+	l.logs = append(l.logs, testLog{msg, attrs})
+	l.mu.Unlock()
+}
+
+// find returns the attributes of the first message logged with msg.
+func (l *testLogger) find(msg string) (map[string]interface{}, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, log := range l.logs {
+		if log.msg == msg {
+			return log.attrs, true
+		}
+	}
+	return nil, false
+}
+
+func TestOfflineQueryLogging(t *testing.T) {
+	s := NewServer(ServerState{Stratum: 2, ReferenceID: 0xc0000201})
+	s.KeyRing = NewKeyRing(Key{ID: 1, Type: AuthSHA1, Secret: []byte("0123456789abcdef")})
+	s.KeyRing.SetTrusted(1)
+	s.RateLimit = &RateLimiter{Interval: time.Hour, Burst: 1, KissOfDeath: true}
+	serverLog := &testLogger{}
+	s.Logger = serverLog
+	addr := startTestServer(t, s)
+
+	log := &testLogger{}
+	opt := QueryOptions{Timeout: time.Second, Logger: log}
+	_, err := QueryWithOptions(addr, opt)
+	assert.Nil(t, err)
+
+	attrs, ok := log.find("ntp response received")
+	if assert.True(t, ok) {
+		assert.Equal(t, addr, attrs["server"])
+		assert.Equal(t, 48, attrs["len"])
+		assert.Equal(t, uint8(2), attrs["stratum"])
+		assert.Equal(t, uint32(0xc0000201), attrs["reference_id"])
+		assert.Equal(t, uint8(server), attrs["mode"])
+		assert.Contains(t, attrs, "transmit_time")
+		assert.Contains(t, attrs, "root_dispersion")
+	}
+	attrs, ok = log.find("ntp query complete")
+	if assert.True(t, ok) {
+		assert.IsType(t, time.Duration(0), attrs["offset"])
+		assert.IsType(t, time.Duration(0), attrs["rtt"])
+	}
+
+	// The second query is rate limited with a kiss of death.
+	_, err = QueryWithOptions(addr, opt)
+	assert.Nil(t, err)
+	attrs, ok = log.find("ntp kiss of death received")
+	if assert.True(t, ok) {
+		assert.Equal(t, "RATE", attrs["kiss_code"])
+	}
+	attrs, ok = serverLog.find("ntp kiss of death sent")
+	if assert.True(t, ok) {
+		assert.Equal(t, "RATE", attrs["kiss_code"])
+		assert.NotEqual(t, "", attrs["client"])
+	}
+}
+
+func TestOfflineServerLogging(t *testing.T) {
+	s := NewServer(ServerState{Stratum: 1})
+	s.KeyRing = NewKeyRing(Key{ID: 1, Type: AuthSHA1, Secret: []byte("0123456789abcdef")})
+	s.KeyRing.SetTrusted(1)
+	s.RequireAuth = true
+	log := &testLogger{}
+	s.Logger = log
+	addr := startTestServer(t, s)
+
+	clientLog := &testLogger{}
+	_, err := QueryWithOptions(addr, QueryOptions{Timeout: 50 * time.Millisecond, Logger: clientLog})
+	assert.NotNil(t, err)
+	attrs, ok := log.find("ntp packet discarded")
+	if assert.True(t, ok) {
+		assert.Equal(t, "notrust", attrs["reason"])
+	}
+	attrs, ok = clientLog.find("ntp query failed")
+	if assert.True(t, ok) {
+		assert.Equal(t, "read", attrs["op"])
+		assert.NotNil(t, attrs["err"])
+	}
+
+	// Queries signed with the wrong key are logged by both sides.
+	auth := AuthOptions{Type: AuthSHA1, Key: "ASCII:fedcba9876543210", KeyID: 1}
+	_, err = QueryWithOptions(addr, QueryOptions{Timeout: time.Second, Auth: auth, Logger: clientLog})
+	assert.Nil(t, err)
+	attrs, ok = log.find("ntp authentication failed")
+	if assert.True(t, ok) {
+		assert.Equal(t, uint32(1), attrs["key_id"])
+	}
+	attrs, ok = clientLog.find("ntp authentication failed")
+	if assert.True(t, ok) {
+		assert.Equal(t, uint16(1), attrs["key_id"])
+		assert.NotNil(t, attrs["err"])
+	}
+}
@@ -0,0 +1,270 @@
+// Copyright © 2015-2023 Brett Vickers.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ntp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Collector records the results of NTP queries and exposes them as
+// metrics in the Prometheus text exposition format, without depending on
+// the Prometheus client libraries. The last response from each server is
+// reported as a set of gauges, and kiss-of-death responses, validation
+// failures and query errors are counted. A Collector is an http.Handler, so
+// it may be registered directly on a metrics endpoint. A Collector is safe
+// for concurrent use.
+//
+// The exposed metrics, each labeled with the server address, are:
+//
+//	ntp_clock_offset_seconds             gauge
+//	ntp_rtt_seconds                      gauge
+//	ntp_root_distance_seconds            gauge
+//	ntp_root_delay_seconds               gauge
+//	ntp_root_dispersion_seconds          gauge
+//	ntp_precision_seconds                gauge
+//	ntp_stratum                          gauge
+//	ntp_leap                             gauge
+//	ntp_response_valid                   gauge
+//	ntp_last_response_timestamp_seconds  gauge
+//	ntp_queries_total                    counter
+//	ntp_query_errors_total               counter, labeled by op
+//	ntp_kiss_of_death_total              counter, labeled by code
+//	ntp_validation_failures_total        counter, labeled by check
+type Collector struct {
+	// Namespace replaces the "ntp" prefix of each metric name if not empty.
+	Namespace string
+
+	// Policy is used to validate the responses observed by the collector.
+	// If nil, the checks performed by Response.Validate are used.
+	Policy *ValidationPolicy
+
+	mu      sync.Mutex
+	servers map[string]*serverMetrics
+}
+
+// serverMetrics holds the metrics recorded for a single server.
+type serverMetrics struct {
+	queries  uint64
+	errors   map[string]uint64
+	kod      map[string]uint64
+	failures map[string]uint64
+	last     *Response
+	lastTime time.Time
+	valid    bool
+}
+
+// NewCollector returns a collector with no recorded results.
+func NewCollector() *Collector {
+	return &Collector{}
+}
+
+// Query queries the server at address with QueryWithOptions and records
+// the result.
+func (c *Collector) Query(address string, opt QueryOptions) (*Response, error) {
+	r, err := QueryWithOptions(address, opt)
+	c.Observe(address, r, err)
+	return r, err
+}
+
+// Observe records the result of a query of server, as returned by
+// QueryWithOptions. If err is not nil, the query error is counted by the
+// step of the query that failed. Otherwise the response is validated, its
+// failed checks are counted, and unless it is a kiss of death, it replaces
+// the server's last response.
+func (c *Collector) Observe(server string, r *Response, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.servers == nil {
+		c.servers = make(map[string]*serverMetrics)
+	}
+	m, ok := c.servers[server]
+	if !ok {
+		m = &serverMetrics{
+			errors:   make(map[string]uint64),
+			kod:      make(map[string]uint64),
+			failures: make(map[string]uint64),
+		}
+		c.servers[server] = m
+	}
+	m.queries++
+
+	if err != nil || r == nil {
+		op := "unknown"
+		var qerr *QueryError
+		if errors.As(err, &qerr) {
+			op = qerr.Op
+		}
+		m.errors[op]++
+		return
+	}
+
+	failures := r.ValidateWithPolicy(c.Policy).Failures
+	for _, f := range failures {
+		m.failures[failureReason(f)]++
+	}
+	if r.IsKissOfDeath() {
+		m.kod[r.KissCode]++
+		return
+	}
+	m.last = r
+	m.lastTime = time.Now()
+	m.valid = len(failures) == 0
+}
+
+// failureReason returns the name of the validation check that produced the
+// error err.
+func failureReason(err error) string {
+	var verr *ValidationError
+	var kerr *KissOfDeathError
+	var aerr *AuthError
+	switch {
+	case errors.As(err, &verr):
+		return string(verr.Check)
+	case errors.As(err, &kerr):
+		return "kiss of death"
+	case errors.As(err, &aerr):
+		return string(CheckAuth)
+	}
+	return "custom"
+}
+
+// collectorGauges lists the gauges reported for the last response from each
+// server.
+var collectorGauges = []struct {
+	name  string
+	help  string
+	value func(m *serverMetrics) float64
+}{
+	{"clock_offset_seconds", "Estimated offset of the local clock relative to the server's clock.",
+		func(m *serverMetrics) float64 { return m.last.ClockOffset.Seconds() }},
+	{"rtt_seconds", "Measured round-trip time to the server.",
+		func(m *serverMetrics) float64 { return m.last.RTT.Seconds() }},
+	{"root_distance_seconds", "Estimated synchronization distance to the stratum 1 server.",
+		func(m *serverMetrics) float64 { return m.last.RootDistance.Seconds() }},
+	{"root_delay_seconds", "Round-trip delay to the stratum 1 server reported by the server.",
+		func(m *serverMetrics) float64 { return m.last.RootDelay.Seconds() }},
+	{"root_dispersion_seconds", "Dispersion relative to the stratum 1 server reported by the server.",
+		func(m *serverMetrics) float64 { return m.last.RootDispersion.Seconds() }},
+	{"precision_seconds", "Precision of the server's clock.",
+		func(m *serverMetrics) float64 { return m.last.Precision.Seconds() }},
+	{"stratum", "Stratum of the server.",
+		func(m *serverMetrics) float64 { return float64(m.last.Stratum) }},
+	{"leap", "Leap indicator reported by the server.",
+		func(m *serverMetrics) float64 { return float64(m.last.Leap) }},
+	{"response_valid", "Whether the last response passed validation.",
+		func(m *serverMetrics) float64 {
+			if m.valid {
+				return 1
+			}
+			return 0
+		}},
+	{"last_response_timestamp_seconds", "Unix time at which the last response was received.",
+		func(m *serverMetrics) float64 { return float64(m.lastTime.UnixNano()) / 1e9 }},
+}
+
+// WriteTo writes the collector's metrics to w in the Prometheus text
+// exposition format.
+func (c *Collector) WriteTo(w io.Writer) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cw := &countWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	ns := c.Namespace
+	if ns == "" {
+		ns = "ntp"
+	}
+	servers := make([]string, 0, len(c.servers))
+	for s := range c.servers {
+		servers = append(servers, s)
+	}
+	sort.Strings(servers)
+
+	header := func(name, typ, help string) {
+		fmt.Fprintf(bw, "# HELP %s_%s %s\n# TYPE %s_%s %s\n", ns, name, help, ns, name, typ)
+	}
+	sample := func(name string, v float64, labels ...string) {
+		fmt.Fprintf(bw, "%s_%s{", ns, name)
+		for i := 0; i < len(labels); i += 2 {
+			if i > 0 {
+				bw.WriteByte(',')
+			}
+			fmt.Fprintf(bw, "%s=\"%s\"", labels[i], escapeLabel(labels[i+1]))
+		}
+		fmt.Fprintf(bw, "} %s\n", strconv.FormatFloat(v, 'g', -1, 64))
+	}
+	counters := func(name, label, help string, values func(m *serverMetrics) map[string]uint64) {
+		header(name, "counter", help)
+		for _, s := range servers {
+			vals := values(c.servers[s])
+			keys := make([]string, 0, len(vals))
+			for k := range vals {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				sample(name, float64(vals[k]), "server", s, label, k)
+			}
+		}
+	}
+
+	for _, g := range collectorGauges {
+		header(g.name, "gauge", g.help)
+		for _, s := range servers {
+			if m := c.servers[s]; m.last != nil {
+				sample(g.name, g.value(m), "server", s)
+			}
+		}
+	}
+
+	header("queries_total", "counter", "Queries made to the server.")
+	for _, s := range servers {
+		sample("queries_total", float64(c.servers[s].queries), "server", s)
+	}
+	counters("query_errors_total", "op", "Queries that failed, by the step of the query that failed.",
+		func(m *serverMetrics) map[string]uint64 { return m.errors })
+	counters("kiss_of_death_total", "code", "Kiss-of-death responses received, by kiss code.",
+		func(m *serverMetrics) map[string]uint64 { return m.kod })
+	counters("validation_failures_total", "check", "Responses that failed validation, by failed check.",
+		func(m *serverMetrics) map[string]uint64 { return m.failures })
+
+	err := bw.Flush()
+	return cw.n, err
+}
+
+// ServeHTTP writes the collector's metrics in response to a scrape.
+func (c *Collector) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	c.WriteTo(w)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// escapeLabel escapes a label value for the text exposition format.
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+// A countWriter counts the bytes written to an underlying writer.
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	w.n += int64(n)
+	return n, err
+}
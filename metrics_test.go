@@ -0,0 +1,104 @@
+// Copyright © 2015-2023 Brett Vickers.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ntp
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func scrape(t *testing.T, url string) string {
+	t.Helper()
+	resp, err := http.Get(url)
+	if !assert.Nil(t, err) {
+		return ""
+	}
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.True(t, strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain; version=0.0.4"))
+	body, err := io.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	return string(body)
+}
+
+func TestOfflineCollectorScrape(t *testing.T) {
+	s := NewServer(ServerState{Stratum: 2, Precision: -20, RootDelay: 125 * time.Millisecond})
+	s.Clock = &offsetClock{time.Second}
+	addr := startTestServer(t, s)
+
+	c := NewCollector()
+	ts := httptest.NewServer(c)
+	defer ts.Close()
+
+	// Nothing is reported before any queries are made.
+	body := scrape(t, ts.URL)
+	assert.Contains(t, body, "# TYPE ntp_clock_offset_seconds gauge\n")
+	assert.NotContains(t, body, "server=")
+
+	r, err := c.Query(addr, QueryOptions{Timeout: time.Second})
+	if !assert.Nil(t, err) {
+		return
+	}
+	c.Observe("203.0.113.1", &Response{Stratum: 0, KissCode: "RATE"}, nil)
+	c.Observe("203.0.113.1", nil, &QueryError{Server: "203.0.113.1", Op: "read", Err: ErrServerClosed})
+	c.Observe("203.0.113.1", &Response{Stratum: 16, Time: time.Now(), ReferenceTime: time.Now()}, nil)
+
+	body = scrape(t, ts.URL)
+	lines := make(map[string]string)
+	for _, l := range strings.Split(body, "\n") {
+		if i := strings.LastIndexByte(l, ' '); i > 0 && !strings.HasPrefix(l, "#") {
+			lines[l[:i]] = l[i+1:]
+		}
+	}
+
+	label := `{server="` + addr + `"}`
+	assert.Equal(t, "2", lines["ntp_stratum"+label])
+	assert.Equal(t, "0", lines["ntp_leap"+label])
+	assert.Equal(t, "0.125", lines["ntp_root_delay_seconds"+label])
+	assert.Equal(t, "1", lines["ntp_response_valid"+label])
+	assert.Equal(t, "1", lines["ntp_queries_total"+label])
+	assert.Contains(t, lines, "ntp_clock_offset_seconds"+label)
+	assert.Contains(t, lines, "ntp_rtt_seconds"+label)
+	assert.Contains(t, lines, "ntp_root_distance_seconds"+label)
+	assert.Contains(t, lines, "ntp_precision_seconds"+label)
+	assert.True(t, r.ClockOffset > 900*time.Millisecond)
+
+	assert.Equal(t, "3", lines[`ntp_queries_total{server="203.0.113.1"}`])
+	assert.Equal(t, "1", lines[`ntp_kiss_of_death_total{server="203.0.113.1",code="RATE"}`])
+	assert.Equal(t, "1", lines[`ntp_query_errors_total{server="203.0.113.1",op="read"}`])
+	assert.Equal(t, "1", lines[`ntp_validation_failures_total{server="203.0.113.1",check="kiss of death"}`])
+	assert.Equal(t, "1", lines[`ntp_validation_failures_total{server="203.0.113.1",check="stratum"}`])
+	assert.Equal(t, "16", lines[`ntp_stratum{server="203.0.113.1"}`])
+	assert.Equal(t, "0", lines[`ntp_response_valid{server="203.0.113.1"}`])
+}
+
+func TestOfflineCollectorFormat(t *testing.T) {
+	c := NewCollector()
+	c.Namespace = "time"
+	c.Policy = &ValidationPolicy{MaxClockOffset: time.Millisecond}
+	c.Observe("a\"b\\c\n", &Response{
+		ClockOffset:   -1500 * time.Millisecond,
+		Stratum:       1,
+		Time:          time.Now(),
+		ReferenceTime: time.Now(),
+	}, nil)
+
+	var buf bytes.Buffer
+	n, err := c.WriteTo(&buf)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(buf.Len()), n)
+	out := buf.String()
+	assert.Contains(t, out, "# HELP time_clock_offset_seconds ")
+	assert.Contains(t, out, `time_clock_offset_seconds{server="a\"b\\c\n"} -1.5`+"\n")
+	assert.Contains(t, out, `time_validation_failures_total{server="a\"b\\c\n",check="clock offset"} 1`+"\n")
+	assert.Contains(t, out, `time_query_errors_total`)
+}
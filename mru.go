@@ -0,0 +1,217 @@
+// Copyright © 2015-2023 Brett Vickers.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ntp
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// MRU list defaults. The memory cap matches ntpd's default "mru maxmem".
+const (
+	defaultMRUMaxMemory = 1 << 20
+
+	// mruEntrySize is the approximate memory used by each MRU list entry,
+	// including its map and list overhead.
+	mruEntrySize = 256
+)
+
+// A ClientInfo holds statistics about a client that has sent packets to a
+// Server.
+type ClientInfo struct {
+	// Addr is the client's address, including its port.
+	Addr net.Addr
+
+	// First and Last are the times the first and most recent packets were
+	// received from the client.
+	First time.Time
+	Last  time.Time
+
+	// Count is the number of packets received from the client.
+	Count uint64
+
+	// Mode and Version are the NTP mode and version of the client's most
+	// recent packet.
+	Mode    uint8
+	Version int
+
+	// Restrict holds the access restrictions applied to the client's most
+	// recent packet.
+	Restrict RestrictFlag
+
+	// Limited is true if the client's most recent packet exceeded its rate
+	// limit, and KissOfDeath is true if it was answered with a
+	// kiss-of-death packet.
+	Limited     bool
+	KissOfDeath bool
+}
+
+// AvgInterval returns the average interval between the client's packets.
+func (c *ClientInfo) AvgInterval() time.Duration {
+	if c.Count < 2 {
+		return 0
+	}
+	return c.Last.Sub(c.First) / time.Duration(c.Count-1)
+}
+
+// An MRUList tracks the clients that have most recently sent packets to a
+// Server, like ntpd's MRU list. Its memory use is bounded by MaxMemory;
+// when the limit is reached, the least recently seen client is evicted. It
+// is safe for concurrent use.
+type MRUList struct {
+	// MaxMemory is the approximate maximum number of bytes used by the
+	// list. Each client uses about 256 bytes. Defaults to 1 MiB.
+	MaxMemory int
+
+	// MaxAge, if not zero, causes clients not seen for longer than MaxAge
+	// to be evicted as new clients are added, even if the memory limit has
+	// not been reached.
+	MaxAge time.Duration
+
+	mu      sync.Mutex
+	clients map[string]*list.Element // of *ClientInfo
+	order   list.List                // most recently seen first
+}
+
+// NewMRUList returns an MRU list using at most maxMemory bytes. If maxMemory
+// is zero, the default of 1 MiB is used.
+func NewMRUList(maxMemory int) *MRUList {
+	return &MRUList{MaxMemory: maxMemory}
+}
+
+// record records a packet received from addr at time now.
+func (m *MRUList) record(addr net.Addr, md uint8, version int, flags RestrictFlag, now time.Time) {
+	if addr == nil {
+		return
+	}
+	key := addr.String()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if e, ok := m.clients[key]; ok {
+		c := e.Value.(*ClientInfo)
+		c.Last, c.Mode, c.Version, c.Restrict = now, md, version, flags
+		c.Limited, c.KissOfDeath = false, false
+		c.Count++
+		m.order.MoveToFront(e)
+		return
+	}
+
+	m.evict(now)
+	if m.clients == nil {
+		m.clients = make(map[string]*list.Element)
+	}
+	c := &ClientInfo{
+		Addr:     addr,
+		First:    now,
+		Last:     now,
+		Count:    1,
+		Mode:     md,
+		Version:  version,
+		Restrict: flags,
+	}
+	m.clients[key] = m.order.PushFront(c)
+}
+
+// limit marks the most recent packet from addr as rate limited.
+func (m *MRUList) limit(addr net.Addr, kod bool) {
+	if addr == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if e, ok := m.clients[addr.String()]; ok {
+		c := e.Value.(*ClientInfo)
+		c.Limited, c.KissOfDeath = true, kod
+	}
+}
+
+// evict makes room for a new client.
+func (m *MRUList) evict(now time.Time) {
+	capacity := intOrDefault(m.MaxMemory, defaultMRUMaxMemory) / mruEntrySize
+	if capacity < 1 {
+		capacity = 1
+	}
+	for m.order.Len() > 0 {
+		e := m.order.Back()
+		c := e.Value.(*ClientInfo)
+		stale := m.MaxAge > 0 && now.Sub(c.Last) > m.MaxAge
+		if m.order.Len() < capacity && !stale {
+			return
+		}
+		m.order.Remove(e)
+		delete(m.clients, c.Addr.String())
+	}
+}
+
+// Len returns the number of clients in the list.
+func (m *MRUList) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.order.Len()
+}
+
+// Client returns the statistics of the client with the requested address.
+func (m *MRUList) Client(addr net.Addr) (ClientInfo, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if e, ok := m.clients[addr.String()]; ok {
+		return *e.Value.(*ClientInfo), true
+	}
+	return ClientInfo{}, false
+}
+
+// Clients returns the statistics of all clients in the list, from most to
+// least recently seen.
+func (m *MRUList) Clients() []ClientInfo {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	clients := make([]ClientInfo, 0, m.order.Len())
+	for e := m.order.Front(); e != nil; e = e.Next() {
+		clients = append(clients, *e.Value.(*ClientInfo))
+	}
+	return clients
+}
+
+// Format writes the list to w in the format of the "ntpq -c mrulist"
+// command, from most to least recently seen, with intervals relative to
+// now. The rstr column holds the client's RestrictFlag bits in
+// hexadecimal, and the r column holds 'L' for rate-limited packets, 'K'
+// for packets answered with a kiss-of-death, and '.' otherwise.
+func (m *MRUList) Format(w io.Writer, now time.Time) error {
+	_, err := fmt.Fprintf(w, "lstint avgint rstr r m v  count rport remote address\n%s\n",
+		"==============================================================================")
+	if err != nil {
+		return err
+	}
+
+	for _, c := range m.Clients() {
+		r := '.'
+		switch {
+		case c.KissOfDeath:
+			r = 'K'
+		case c.Limited:
+			r = 'L'
+		}
+
+		host, port := c.Addr.String(), "0"
+		if h, p, err := net.SplitHostPort(host); err == nil {
+			host, port = h, p
+		}
+
+		_, err := fmt.Fprintf(w, "%6d %6d %4x %c %d %d %6d %5s %s\n",
+			int64(now.Sub(c.Last)/time.Second), int64(c.AvgInterval()/time.Second),
+			uint(c.Restrict), r, c.Mode, c.Version, c.Count, port, host)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+// Copyright © 2015-2023 Brett Vickers.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ntp
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOfflineMRUList(t *testing.T) {
+	m := NewMRUList(3 * mruEntrySize)
+	now := time.Unix(1700000000, 0)
+	addr := func(i int) net.Addr {
+		return &net.UDPAddr{IP: net.IPv4(192, 0, 2, byte(i)), Port: 40000 + i}
+	}
+
+	m.record(addr(1), 3, 4, 0, now)
+	m.record(addr(2), 3, 3, RestrictLimited, now.Add(time.Second))
+	m.record(addr(1), 3, 4, 0, now.Add(10*time.Second))
+	m.record(addr(1), 3, 4, 0, now.Add(20*time.Second))
+	m.record(addr(3), 3, 4, 0, now.Add(21*time.Second))
+	m.limit(addr(3), true)
+	assert.Equal(t, 3, m.Len())
+
+	c, ok := m.Client(addr(1))
+	if assert.True(t, ok) {
+		assert.Equal(t, uint64(3), c.Count)
+		assert.Equal(t, now, c.First)
+		assert.Equal(t, 10*time.Second, c.AvgInterval())
+	}
+
+	// Adding a fourth client evicts the least recently seen.
+	m.record(addr(4), 3, 4, 0, now.Add(22*time.Second))
+	_, ok = m.Client(addr(2))
+	assert.False(t, ok)
+
+	clients := m.Clients()
+	if assert.Len(t, clients, 3) {
+		assert.Equal(t, addr(4), clients[0].Addr)
+		assert.Equal(t, addr(3), clients[1].Addr)
+		assert.True(t, clients[1].KissOfDeath)
+		assert.Equal(t, addr(1), clients[2].Addr)
+	}
+
+	var b strings.Builder
+	assert.Nil(t, m.Format(&b, now.Add(30*time.Second)))
+	expected := "" +
+		"lstint avgint rstr r m v  count rport remote address\n" +
+		"==============================================================================\n" +
+		"     8      0    0 . 3 4      1 40004 192.0.2.4\n" +
+		"     9      0    0 K 3 4      1 40003 192.0.2.3\n" +
+		"    10     10    0 . 3 4      3 40001 192.0.2.1\n"
+	assert.Equal(t, expected, b.String())
+
+	// Stale clients are evicted when MaxAge is set.
+	m.MaxAge = 5 * time.Second
+	m.record(addr(5), 3, 4, 0, now.Add(26500*time.Millisecond))
+	assert.Equal(t, 2, m.Len())
+}
+
+func TestOfflineServerMRU(t *testing.T) {
+	s := NewServer(ServerState{Stratum: 1})
+	s.MRU = NewMRUList(0)
+	s.RateLimit = &RateLimiter{Interval: time.Minute, Burst: 1}
+	addr := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 123}
+	now := time.Now()
+
+	query := make([]byte, 48)
+	query[0] = 3<<3 | byte(client)
+	s.Respond(query, addr, now)
+	s.Respond(query, addr, now.Add(time.Second))
+
+	c, ok := s.MRU.Client(addr)
+	if assert.True(t, ok) {
+		assert.Equal(t, uint64(2), c.Count)
+		assert.Equal(t, 3, c.Version)
+		assert.Equal(t, uint8(client), c.Mode)
+		assert.True(t, c.Limited)
+		assert.False(t, c.KissOfDeath)
+	}
+}
@@ -27,17 +27,34 @@ import (
 var (
 	ErrAuthFailed             = errors.New("authentication failed")
 	ErrInvalidAuthKey         = errors.New("invalid authentication key")
+	ErrInvalidAuthType        = errors.New("invalid authentication type")
+	ErrExcessiveClockOffset   = errors.New("clock offset exceeds limit")
+	ErrExcessiveRootDistance  = errors.New("root distance exceeds limit")
+	ErrExcessiveRTT           = errors.New("round-trip time exceeds limit")
+	ErrInvalidCapture         = errors.New("invalid packet capture")
 	ErrInvalidDispersion      = errors.New("invalid dispersion in response")
+	ErrInvalidKeyFile         = errors.New("invalid key file")
+	ErrInvalidLeapFile        = errors.New("invalid leap second file")
 	ErrInvalidLeapSecond      = errors.New("invalid leap second in response")
 	ErrInvalidMode            = errors.New("invalid mode in response")
 	ErrInvalidProtocolVersion = errors.New("invalid protocol version requested")
+	ErrInvalidRecording       = errors.New("invalid exchange recording")
+	ErrInvalidReferenceTime   = errors.New("invalid reference time in response")
+	ErrInvalidResponseVersion = errors.New("invalid protocol version in response")
+	ErrInvalidRestriction     = errors.New("invalid access restriction")
 	ErrInvalidStratum         = errors.New("invalid stratum in response")
 	ErrInvalidTime            = errors.New("invalid time reported")
 	ErrInvalidTransmitTime    = errors.New("invalid transmit time in response")
 	ErrKissOfDeath            = errors.New("kiss of death received")
+	ErrLeapFileHash           = errors.New("leap second file hash mismatch")
+	ErrLeapMismatch           = errors.New("leap indicator disagrees with leap table")
+	ErrNoTimeSource           = errors.New("no valid time source")
 	ErrServerClockFreshness   = errors.New("server clock not fresh")
+	ErrServerClosed           = errors.New("server closed")
 	ErrServerResponseMismatch = errors.New("server response didn't match request")
 	ErrServerTickedBackwards  = errors.New("server clock ticked backwards")
+	ErrUnauthenticated        = errors.New("response not authenticated")
+	ErrUnknownKey             = errors.New("unknown or untrusted authentication key")
 )
 
 // The LeapIndicator is used to warn if a leap second should be inserted
@@ -69,15 +86,10 @@ const (
 	maxDispersion     = 16 * time.Second
 )
 
-// Internal variables
-var (
-	ntpEra0 = time.Date(1900, 1, 1, 0, 0, 0, 0, time.UTC)
-	ntpEra1 = time.Date(2036, 2, 7, 6, 28, 16, 0, time.UTC)
-)
-
 type mode uint8
 
-// NTP modes. This package uses only client mode.
+// NTP modes. This package's client uses only client mode, and its server
+// answers only client mode queries.
 const (
 	reserved mode = 0 + iota
 	symmetricActive
@@ -112,24 +124,13 @@ func (t ntpTime) Time() time.Time {
 	// before 1970. Otherwise assume NTP era 0. This allows the function to
 	// report an accurate time value both before and after the 0-to-1 era
 	// rollover.
-	const t1970 = 0x83aa7e8000000000
-	if uint64(t) < t1970 {
-		return ntpEra1.Add(t.Duration())
-	}
-	return ntpEra0.Add(t.Duration())
+	return Timestamp(t).Time(defaultPivot)
 }
 
 // toNtpTime converts the time.Time value t into its 64-bit fixed-point
 // ntpTime representation.
 func toNtpTime(t time.Time) ntpTime {
-	nsec := uint64(t.Sub(ntpEra0))
-	sec := nsec / nanoPerSec
-	nsec = uint64(nsec-sec*nanoPerSec) << 32
-	frac := uint64(nsec / nanoPerSec)
-	if nsec%nanoPerSec >= nanoPerSec/2 {
-		frac++
-	}
-	return ntpTime(sec<<32 | frac)
+	return ntpTime(NewTimestamp(t))
 }
 
 // An ntpTimeShort is a 32-bit fixed-point (Q16.16) representation of the
@@ -193,6 +194,41 @@ func (h *header) getLeap() LeapIndicator {
 	return LeapIndicator((h.LiVnMode >> 6) & 0x03)
 }
 
+// appendTo appends the header's 48-byte wire encoding to b. The encoding is
+// identical to that produced by binary.Write, but avoids reflection.
+func (h *header) appendTo(b []byte) []byte {
+	var w [48]byte
+	w[0] = h.LiVnMode
+	w[1] = h.Stratum
+	w[2] = uint8(h.Poll)
+	w[3] = uint8(h.Precision)
+	binary.BigEndian.PutUint32(w[4:], uint32(h.RootDelay))
+	binary.BigEndian.PutUint32(w[8:], uint32(h.RootDispersion))
+	binary.BigEndian.PutUint32(w[12:], h.ReferenceID)
+	binary.BigEndian.PutUint64(w[16:], uint64(h.ReferenceTime))
+	binary.BigEndian.PutUint64(w[24:], uint64(h.OriginTime))
+	binary.BigEndian.PutUint64(w[32:], uint64(h.ReceiveTime))
+	binary.BigEndian.PutUint64(w[40:], uint64(h.TransmitTime))
+	return append(b, w[:]...)
+}
+
+// unmarshal decodes the header from b, which must be at least 48 bytes
+// long.
+func (h *header) unmarshal(b []byte) {
+	_ = b[47] // bounds check hint
+	h.LiVnMode = b[0]
+	h.Stratum = b[1]
+	h.Poll = int8(b[2])
+	h.Precision = int8(b[3])
+	h.RootDelay = ntpTimeShort(binary.BigEndian.Uint32(b[4:]))
+	h.RootDispersion = ntpTimeShort(binary.BigEndian.Uint32(b[8:]))
+	h.ReferenceID = binary.BigEndian.Uint32(b[12:])
+	h.ReferenceTime = ntpTime(binary.BigEndian.Uint64(b[16:]))
+	h.OriginTime = ntpTime(binary.BigEndian.Uint64(b[24:]))
+	h.ReceiveTime = ntpTime(binary.BigEndian.Uint64(b[32:]))
+	h.TransmitTime = ntpTime(binary.BigEndian.Uint64(b[40:]))
+}
+
 // An Extension adds custom behaviors capable of modifying NTP packets before
 // being sent to the server and processing packets after being received by the
 // server.
@@ -236,6 +272,22 @@ type QueryOptions struct {
 	// transmitted and to process NTP responses after they arrive.
 	Extensions []Extension
 
+	// Clock, if not nil, supplies the local times at which the query is
+	// transmitted and the response received, in place of the system clock.
+	// It is intended for simulations that drive queries over a virtual
+	// transport. The connection's deadline is always set using the system
+	// clock.
+	Clock Clock
+
+	// Trace, if not nil, is called at each stage of the query. See
+	// ClientTrace.
+	Trace *ClientTrace
+
+	// Logger, if not nil, receives debug logs of the query: the raw header
+	// fields of the response, the computed offset and delay, and the
+	// reasons responses are rejected. A *slog.Logger may be used.
+	Logger Logger
+
 	// Dialer is a callback used to override the default UDP network dialer.
 	// The localAddress is directly copied from the LocalAddress field
 	// specified in QueryOptions. It may be the empty string or a host address
@@ -331,7 +383,17 @@ type Response struct {
 	// the server.
 	Poll time.Duration
 
-	authErr error
+	authErr       error
+	authenticated bool
+	zeroRefTime   bool // the header's reference time field was zero
+}
+
+// AuthErr returns the error that occurred while authenticating the server's
+// response using symmetric key authentication, or nil if authentication
+// succeeded or was not requested. Authentication failures are reported as
+// an *AuthError describing the cause.
+func (r *Response) AuthErr() error {
+	return r.authErr
 }
 
 // IsKissOfDeath returns true if the response is a "kiss of death" from the
@@ -376,47 +438,14 @@ func (r *Response) ReferenceString() string {
 }
 
 // Validate checks if the response is valid for the purposes of time
-// synchronization.
+// synchronization. A kiss of death is reported as a *KissOfDeathError, and
+// other failed checks are reported as a *ValidationError. Both may be
+// compared against the package's sentinel errors using errors.Is. To apply
+// stricter checks or to obtain a list of every failed check, use
+// ValidateWithPolicy.
 func (r *Response) Validate() error {
-	// Forward authentication errors.
-	if r.authErr != nil {
-		return r.authErr
-	}
-
-	// Handle invalid stratum values.
-	if r.Stratum == 0 {
-		return ErrKissOfDeath
-	}
-	if r.Stratum >= maxStratum {
-		return ErrInvalidStratum
-	}
-
-	// Estimate the "freshness" of the time. If it exceeds the maximum
-	// polling interval (~36 hours), then it cannot be considered "fresh".
-	freshness := r.Time.Sub(r.ReferenceTime)
-	if freshness > maxPollInterval {
-		return ErrServerClockFreshness
-	}
-
-	// Calculate the peer synchronization distance, lambda:
-	//  	lambda := RootDelay/2 + RootDispersion
-	// If this value exceeds MAXDISP (16s), then the time is not suitable
-	// for synchronization purposes.
-	// https://tools.ietf.org/html/rfc5905#appendix-A.5.1.1.
-	lambda := r.RootDelay/2 + r.RootDispersion
-	if lambda > maxDispersion {
-		return ErrInvalidDispersion
-	}
-
-	// If the server's transmit time is before its reference time, the
-	// response is invalid.
-	if r.Time.Before(r.ReferenceTime) {
-		return ErrInvalidTime
-	}
-
-	// Handle invalid leap second indicator.
-	if r.Leap == LeapNotInSync {
-		return ErrInvalidLeapSecond
+	if errs := r.validate(nil, false); len(errs) > 0 {
+		return errs[0]
 	}
 
 	// nil means the response is valid.
@@ -440,11 +469,24 @@ func Query(address string) (*Response, error) {
 // QueryOptions for further details.
 func QueryWithOptions(address string, opt QueryOptions) (*Response, error) {
 	h, now, err := getTime(address, &opt)
-	if err != nil && err != ErrAuthFailed {
+	if err != nil && !errors.Is(err, ErrAuthFailed) {
 		return nil, err
 	}
 
-	return generateResponse(h, now, err), nil
+	r := generateResponse(h, now, err)
+	r.authenticated = opt.Auth.enabled() && err == nil
+	if opt.Trace != nil {
+		opt.Trace.validated(r.Validate())
+	}
+	if opt.Logger != nil {
+		if r.IsKissOfDeath() {
+			opt.Logger.Debug("ntp kiss of death received", logServer, address, logKissCode, r.KissCode)
+		} else {
+			opt.Logger.Debug("ntp query complete", logServer, address,
+				logOffset, r.ClockOffset, logRTT, r.RTT, logRootDistance, r.RootDistance)
+		}
+	}
+	return r, nil
 }
 
 // Time returns the current, corrected local time using information returned
@@ -472,8 +514,16 @@ func Time(address string) (time.Time, error) {
 }
 
 // getTime performs the NTP server query and returns the response header
-// along with the local system time it was received.
+// along with the local system time it was received. Errors that prevent a
+// header from being returned are reported as a *QueryError.
 func getTime(address string, opt *QueryOptions) (*header, ntpTime, error) {
+	fail := func(op string, err error) (*header, ntpTime, error) {
+		if opt.Logger != nil {
+			opt.Logger.Debug("ntp query failed", logServer, address, logOp, op, logErr, err)
+		}
+		return nil, 0, &QueryError{Server: address, Op: op, Err: err}
+	}
+
 	if opt.Timeout == 0 {
 		opt.Timeout = defaultTimeout
 	}
@@ -481,7 +531,7 @@ func getTime(address string, opt *QueryOptions) (*header, ntpTime, error) {
 		opt.Version = defaultNtpVersion
 	}
 	if opt.Version < 2 || opt.Version > 4 {
-		return nil, 0, ErrInvalidProtocolVersion
+		return fail(opConfigure, ErrInvalidProtocolVersion)
 	}
 	if opt.Port == 0 {
 		opt.Port = defaultNtpPort
@@ -501,26 +551,38 @@ func getTime(address string, opt *QueryOptions) (*header, ntpTime, error) {
 	// string doesn't already contain a port.
 	remoteAddress, err := fixHostPort(address, opt.Port)
 	if err != nil {
-		return nil, 0, err
+		return fail(opDial, err)
+	}
+
+	// Resolve the server's host name here when tracing, so that the
+	// resolution may be reported. Custom dialers resolve names themselves.
+	if useDefaultDialer && opt.Trace != nil {
+		remoteAddress, err = opt.Trace.resolve(remoteAddress, opt.LocalAddress)
+		if err != nil {
+			return fail(opDial, err)
+		}
 	}
 
 	// Connect to the remote server.
 	con, err := opt.Dialer(opt.LocalAddress, remoteAddress)
+	opt.Trace.dialDone(con, err)
 	if err != nil {
-		return nil, 0, err
+		return fail(opDial, err)
 	}
 
-	// Only close connection if dialer not overridden
-	if useDefaultDialer {
+	// Only close connection if dialer not overridden, or if it was opened
+	// by the default dialer on behalf of a dialer wrapping it.
+	raw, owned := unwrapConn(con)
+	if useDefaultDialer || owned {
 		defer con.Close()
 	}
 
 	// Set a TTL for the packet if requested.
 	if opt.TTL != 0 {
-		ipcon := ipv4.NewConn(con)
+		ipcon := ipv4.NewConn(raw)
 		err = ipcon.SetTTL(opt.TTL)
 		if err != nil {
-			return nil, 0, err
+			return fail(opDial, err)
 		}
 	}
 
@@ -544,7 +606,7 @@ func getTime(address string, opt *QueryOptions) (*header, ntpTime, error) {
 	bits := make([]byte, 8)
 	_, err = rand.Read(bits)
 	if err != nil {
-		return nil, 0, err
+		return fail(opEncode, err)
 	}
 	xmitHdr.TransmitTime = ntpTime(binary.BigEndian.Uint64(bits))
 
@@ -555,38 +617,51 @@ func getTime(address string, opt *QueryOptions) (*header, ntpTime, error) {
 	// Allow extensions to process the query and add to the transmit buffer.
 	for _, e := range opt.Extensions {
 		err = e.ProcessQuery(&xmitBuf)
+		opt.Trace.extensionDone(e, false, err)
 		if err != nil {
-			return nil, 0, err
+			return fail(opEncode, err)
 		}
 	}
 
+	// Check the response against the transmit timestamp actually sent,
+	// which an extension may have replaced.
+	if xmitBuf.Len() >= 48 {
+		xmitHdr.TransmitTime = ntpTime(binary.BigEndian.Uint64(xmitBuf.Bytes()[40:]))
+	}
+
 	// If using symmetric key authentication, decode and validate the auth key
-	// string.
-	authKey, err := decodeAuthKey(opt.Auth)
+	// string or select the key from the key ring.
+	auth, authKey, err := resolveAuth(opt.Auth)
 	if err != nil {
-		return nil, 0, err
+		return fail(opConfigure, err)
 	}
 
 	// Append a MAC if authentication is being used.
-	appendMAC(&xmitBuf, opt.Auth, authKey)
+	appendMAC(&xmitBuf, auth, authKey)
 
 	// Transmit the query and keep track of when it was transmitted.
-	xmitTime := time.Now()
+	now := time.Now
+	if opt.Clock != nil {
+		now = opt.Clock.Now
+	}
+	xmitTime := now()
 	_, err = con.Write(xmitBuf.Bytes())
+	opt.Trace.wroteQuery(xmitBuf.Len(), err)
 	if err != nil {
-		return nil, 0, err
+		return fail(opWrite, err)
 	}
 
 	// Receive the response.
 	recvBytes, err := con.Read(recvBuf)
+	opt.Trace.readResponse(recvBytes, err)
 	if err != nil {
-		return nil, 0, err
+		return fail(opRead, err)
 	}
 
 	// Keep track of the time the response was received. As of go 1.9, the
 	// time package uses a monotonic clock, so delta will never be less than
 	// zero for go version 1.9 or higher.
-	delta := time.Since(xmitTime)
+	delta := now().Sub(xmitTime)
 	if delta < 0 {
 		delta = 0
 	}
@@ -597,29 +672,25 @@ func getTime(address string, opt *QueryOptions) (*header, ntpTime, error) {
 	recvReader := bytes.NewReader(recvBuf)
 	err = binary.Read(recvReader, binary.BigEndian, recvHdr)
 	if err != nil {
-		return nil, 0, err
+		return fail(opDecode, err)
+	}
+	if opt.Logger != nil {
+		opt.Logger.Debug("ntp response received", headerAttrs(recvHdr, logServer, address, logLen, recvBytes)...)
 	}
 
 	// Allow extensions to process the response.
 	for i := len(opt.Extensions) - 1; i >= 0; i-- {
 		err = opt.Extensions[i].ProcessResponse(recvBuf)
+		opt.Trace.extensionDone(opt.Extensions[i], true, err)
 		if err != nil {
-			return nil, 0, err
+			return fail(opDecode, err)
 		}
 	}
 
 	// Check for invalid fields.
-	if recvHdr.getMode() != server {
-		return nil, 0, ErrInvalidMode
-	}
-	if recvHdr.TransmitTime == ntpTime(0) {
-		return nil, 0, ErrInvalidTransmitTime
-	}
-	if recvHdr.OriginTime != xmitHdr.TransmitTime {
-		return nil, 0, ErrServerResponseMismatch
-	}
-	if recvHdr.ReceiveTime > recvHdr.TransmitTime {
-		return nil, 0, ErrServerTickedBackwards
+	if err := checkResponse(recvHdr, xmitHdr.TransmitTime); err != nil {
+		opt.Trace.validated(err)
+		return fail(opVerify, err)
 	}
 
 	// Correct the received message's origin time using the actual
@@ -627,11 +698,33 @@ func getTime(address string, opt *QueryOptions) (*header, ntpTime, error) {
 	recvHdr.OriginTime = toNtpTime(xmitTime)
 
 	// Perform authentication of the server response.
-	authErr := verifyMAC(recvBuf, opt.Auth, authKey)
+	authErr := verifyMAC(recvBuf, auth, authKey)
+	if opt.Auth.enabled() {
+		opt.Trace.authDone(auth, authErr)
+	}
+	if authErr != nil && opt.Logger != nil {
+		opt.Logger.Debug("ntp authentication failed", logServer, address, logKeyID, auth.KeyID, logErr, authErr)
+	}
 
 	return recvHdr, toNtpTime(recvTime), authErr
 }
 
+// checkResponse checks the header of a response to a query transmitted with
+// the transmit timestamp xmt.
+func checkResponse(h *header, xmt ntpTime) error {
+	switch {
+	case h.getMode() != server:
+		return ErrInvalidMode
+	case h.TransmitTime == ntpTime(0):
+		return ErrInvalidTransmitTime
+	case h.OriginTime != xmt:
+		return ErrServerResponseMismatch
+	case h.ReceiveTime > h.TransmitTime:
+		return ErrServerTickedBackwards
+	}
+	return nil
+}
+
 // defaultDialer provides a UDP dialer based on Go's built-in net stack.
 func defaultDialer(localAddress, remoteAddress string) (net.Conn, error) {
 	var laddr *net.UDPAddr
@@ -651,6 +744,30 @@ func defaultDialer(localAddress, remoteAddress string) (net.Conn, error) {
 	return net.DialUDP("udp", laddr, raddr)
 }
 
+// A wrappedConn is a connection returned by a dialer that wraps another
+// dialer, such as the one installed by Recorder.Options.
+type wrappedConn interface {
+	// unwrap returns the wrapped connection, and true if it was opened by
+	// the default dialer.
+	unwrap() (con net.Conn, owned bool)
+}
+
+// unwrapConn returns the connection underlying any wrappers of con. It also
+// returns true if the connection was opened by the default dialer, in which
+// case QueryWithOptions must close con.
+func unwrapConn(con net.Conn) (net.Conn, bool) {
+	owned := false
+	for {
+		w, ok := con.(wrappedConn)
+		if !ok {
+			return con, owned
+		}
+		var o bool
+		con, o = w.unwrap()
+		owned = owned || o
+	}
+}
+
 // dialWrapper is used to wrap the deprecated Dial callback in QueryOptions.
 func dialWrapper(la, ra string,
 	dial func(la string, lp int, ra string, rp int) (net.Conn, error)) (net.Conn, error) {
@@ -725,6 +842,7 @@ func generateResponse(h *header, recvTime ntpTime, authErr error) *Response {
 		MinError:       minError(h.OriginTime, h.ReceiveTime, h.TransmitTime, recvTime),
 		Poll:           toInterval(h.Poll),
 		authErr:        authErr,
+		zeroRefTime:    h.ReferenceTime == 0,
 	}
 
 	// Calculate values depending on other calculated values
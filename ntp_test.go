@@ -35,7 +35,7 @@ func isNil(t *testing.T, host string, err error) bool {
 	switch {
 	case err == nil:
 		return true
-	case err == ErrKissOfDeath:
+	case errors.Is(err, ErrKissOfDeath):
 		// log instead of error, so test isn't failed
 		t.Logf("[%s] Query kiss of death (ignored)", host)
 		return false
@@ -205,7 +205,7 @@ func TestOfflineCustomDialer(t *testing.T) {
 	}
 	r, err := QueryWithOptions(raddr, opt)
 	assert.Nil(t, r)
-	assert.Equal(t, notDialingErr, err)
+	assert.ErrorIs(t, err, notDialingErr)
 	assert.True(t, dialerCalled)
 }
 
@@ -233,7 +233,7 @@ func TestOfflineCustomDialerDeprecated(t *testing.T) {
 	}
 	r, err := QueryWithOptions(raddr, opt)
 	assert.Nil(t, r)
-	assert.Equal(t, notDialingErr, err)
+	assert.ErrorIs(t, err, notDialingErr)
 	assert.True(t, dialerCalled)
 }
 
@@ -0,0 +1,397 @@
+// Copyright © 2015-2023 Brett Vickers.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package ntpsim provides a deterministic simulation of NTP servers, network
+// paths and clocks, for testing clock synchronization logic without real
+// sockets or real time.
+//
+// A Network holds a virtual clock measuring true time, a client clock, and
+// a set of simulated servers. Each server has its own clock, with an
+// offset, frequency drift and scheduled step events, and a network path
+// with asymmetric delays, jitter and packet loss. Queries are made with
+// ntp.QueryWithOptions over a simulated transport, so hours of simulated
+// polling take milliseconds of wall time. Random delays and losses are
+// drawn from a seeded source, so simulations are repeatable.
+//
+//	n := ntpsim.NewNetwork(start, 1)
+//	s := n.AddServer("192.0.2.1", ntp.ServerState{Stratum: 1})
+//	s.Clock.Offset = 250 * time.Millisecond
+//	s.Path = ntpsim.Path{Outbound: 10 * time.Millisecond, Return: 30 * time.Millisecond}
+//	for i := 0; i < 100; i++ {
+//		r, err := n.Query("192.0.2.1")
+//		...
+//		n.Advance(64 * time.Second)
+//	}
+//
+// A simulation is not safe for concurrent use; it should be driven from a
+// single goroutine.
+package ntpsim
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/jocelyndb/ntp"
+)
+
+// defaultTimeout is the query timeout used by Network.Query.
+const defaultTimeout = 5 * time.Second
+
+// A Network simulates NTP servers, the network paths leading to them, and
+// the clock of the client querying them.
+type Network struct {
+	// Client is the clock of the simulated client. It supplies the local
+	// times of queries made with the network's QueryOptions.
+	Client *Clock
+
+	start   time.Time
+	now     time.Time
+	rand    *rand.Rand
+	servers map[string]*Server
+	port    int
+}
+
+// NewNetwork returns a network whose true time starts at start, using seed
+// to generate random delays and losses.
+func NewNetwork(start time.Time, seed int64) *Network {
+	n := &Network{
+		start:   start,
+		now:     start,
+		rand:    rand.New(rand.NewSource(seed)),
+		servers: make(map[string]*Server),
+		port:    50000,
+	}
+	n.Client = n.NewClock()
+	return n
+}
+
+// Now returns the network's true time.
+func (n *Network) Now() time.Time {
+	return n.now
+}
+
+// Elapsed returns the true time elapsed since the start of the simulation.
+func (n *Network) Elapsed() time.Duration {
+	return n.now.Sub(n.start)
+}
+
+// Advance advances the network's true time by d.
+func (n *Network) Advance(d time.Duration) {
+	if d > 0 {
+		n.now = n.now.Add(d)
+	}
+}
+
+// NewClock returns a clock that matches the network's true time until its
+// offset, drift or steps are configured.
+func (n *Network) NewClock() *Clock {
+	return &Clock{net: n}
+}
+
+// AddServer adds a server at addr advertising the requested state. If addr
+// holds no port, the NTP port 123 is used. The server's clock and path may
+// be configured before it is queried.
+func (n *Network) AddServer(addr string, state ntp.ServerState) *Server {
+	addr = hostPort(addr)
+	s := &Server{
+		Addr:   addr,
+		Server: ntp.NewServer(state),
+		Clock:  n.NewClock(),
+	}
+	s.Server.Clock = s.Clock
+	n.servers[addr] = s
+	return s
+}
+
+// Dial returns a simulated connection to the server at remoteAddress. It
+// has the signature of ntp.QueryOptions.Dialer.
+func (n *Network) Dial(localAddress, remoteAddress string) (net.Conn, error) {
+	s, ok := n.servers[hostPort(remoteAddress)]
+	if !ok {
+		return nil, fmt.Errorf("ntpsim: no server at %s", remoteAddress)
+	}
+	if localAddress == "" {
+		localAddress = "192.0.2.254"
+	}
+	n.port++
+	return &conn{
+		net:    n,
+		server: s,
+		local:  &net.UDPAddr{IP: net.ParseIP(localAddress), Port: n.port},
+		remote: &net.UDPAddr{IP: net.ParseIP(s.host()), Port: s.port()},
+	}, nil
+}
+
+// QueryOptions returns query options that make queries over the simulated
+// network, timestamped by the client's clock.
+func (n *Network) QueryOptions() ntp.QueryOptions {
+	return ntp.QueryOptions{
+		Timeout: defaultTimeout,
+		Clock:   n.Client,
+		Dialer:  n.Dial,
+	}
+}
+
+// Query queries the server at addr using the network's QueryOptions.
+func (n *Network) Query(addr string) (*ntp.Response, error) {
+	return ntp.QueryWithOptions(addr, n.QueryOptions())
+}
+
+// hostPort adds the NTP port to addr if it holds no port.
+func hostPort(addr string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	return net.JoinHostPort(addr, "123")
+}
+
+// A Clock is a simulated clock. It reports the network's true time plus an
+// offset that changes with the clock's frequency drift and step events.
+type Clock struct {
+	// Offset is the clock's offset from true time at the start of the
+	// simulation.
+	Offset time.Duration
+
+	// Drift is the clock's frequency error, as a fraction of true time.
+	// For example, 10e-6 describes a clock running 10 ppm fast.
+	Drift float64
+
+	net   *Network
+	steps []step
+}
+
+// A step is a scheduled change of a clock's offset.
+type step struct {
+	at time.Time
+	d  time.Duration
+}
+
+// Now returns the clock's current time.
+func (c *Clock) Now() time.Time {
+	return c.At(c.net.now)
+}
+
+// At returns the clock's time at the true time t.
+func (c *Clock) At(t time.Time) time.Time {
+	return t.Add(c.offsetAt(t))
+}
+
+// Error returns the clock's current offset from true time.
+func (c *Clock) Error() time.Duration {
+	return c.offsetAt(c.net.now)
+}
+
+// Step schedules the clock to step by d at the true time at.
+func (c *Clock) Step(at time.Time, d time.Duration) {
+	c.steps = append(c.steps, step{at, d})
+}
+
+// Adjust immediately changes the clock's offset by d, as a client
+// correcting its clock would.
+func (c *Clock) Adjust(d time.Duration) {
+	c.Offset += d
+}
+
+func (c *Clock) offsetAt(t time.Time) time.Duration {
+	elapsed := t.Sub(c.net.start)
+	offset := c.Offset + time.Duration(c.Drift*float64(elapsed))
+	for _, s := range c.steps {
+		if !t.Before(s.at) {
+			offset += s.d
+		}
+	}
+	return offset
+}
+
+// A Distribution draws a random, non-negative delay.
+type Distribution func(r *rand.Rand) time.Duration
+
+// Constant returns a distribution that always draws d.
+func Constant(d time.Duration) Distribution {
+	return func(*rand.Rand) time.Duration { return d }
+}
+
+// Uniform returns a distribution drawing delays uniformly from [lo, hi). If
+// hi is not greater than lo, the distribution always draws lo.
+func Uniform(lo, hi time.Duration) Distribution {
+	if hi <= lo {
+		return Constant(lo)
+	}
+	return func(r *rand.Rand) time.Duration {
+		return lo + time.Duration(r.Int63n(int64(hi-lo)))
+	}
+}
+
+// Exponential returns a distribution drawing exponentially distributed
+// delays with the requested mean, typical of queueing delay.
+func Exponential(mean time.Duration) Distribution {
+	return func(r *rand.Rand) time.Duration {
+		return time.Duration(r.ExpFloat64() * float64(mean))
+	}
+}
+
+// Normal returns a distribution drawing normally distributed delays with the
+// requested mean and standard deviation. Negative draws are clamped to zero.
+func Normal(mean, stddev time.Duration) Distribution {
+	return func(r *rand.Rand) time.Duration {
+		d := mean + time.Duration(r.NormFloat64()*float64(stddev))
+		if d < 0 {
+			return 0
+		}
+		return d
+	}
+}
+
+// A Path describes the network path between the client and a server.
+type Path struct {
+	// Outbound and Return are the fixed one-way delays of the query and
+	// response. Unequal delays bias the client's offset measurements by
+	// half their difference.
+	Outbound time.Duration
+	Return   time.Duration
+
+	// Jitter, if not nil, draws an additional delay for each packet in each
+	// direction.
+	Jitter Distribution
+
+	// Loss is the probability that each packet is lost, in each direction.
+	Loss float64
+}
+
+// delay returns the delay of a packet sent with the base delay d, or false
+// if the packet is lost.
+func (p *Path) delay(r *rand.Rand, d time.Duration) (time.Duration, bool) {
+	if p.Loss > 0 && r.Float64() < p.Loss {
+		return 0, false
+	}
+	if p.Jitter != nil {
+		d += p.Jitter(r)
+	}
+	return d, true
+}
+
+// A Server is a simulated NTP server.
+type Server struct {
+	// Addr is the server's address, in "host:port" form.
+	Addr string
+
+	// Server answers the queries received by the simulated server. Its
+	// advertised state, keys and restrictions may be configured.
+	Server *ntp.Server
+
+	// Clock is the server's clock.
+	Clock *Clock
+
+	// Path is the network path to the server.
+	Path Path
+}
+
+func (s *Server) host() string {
+	host, _, _ := net.SplitHostPort(s.Addr)
+	return host
+}
+
+func (s *Server) port() int {
+	_, port, _ := net.SplitHostPort(s.Addr)
+	p, _ := strconv.Atoi(port)
+	return p
+}
+
+// A conn is a simulated UDP connection to a server. Each write delivers a
+// query to the server at the true time it arrives, and queues the response
+// for delivery at the true time it returns. Reads advance the network's
+// true time to the arrival of the next response, or to the deadline.
+type conn struct {
+	net     *Network
+	server  *Server
+	local   *net.UDPAddr
+	remote  *net.UDPAddr
+	timeout time.Duration
+	pending []packet
+}
+
+// A packet is a response in flight to the client.
+type packet struct {
+	data    []byte
+	arrival time.Time
+}
+
+func (c *conn) Write(b []byte) (int, error) {
+	n, s := c.net, c.server
+	out, ok := s.Path.delay(n.rand, s.Path.Outbound)
+	if !ok {
+		return len(b), nil
+	}
+
+	// The server answers at the instant the query arrives.
+	sent := n.now
+	n.now = sent.Add(out)
+	resp := s.Server.Respond(b, c.local, s.Clock.Now())
+	n.now = sent
+	if resp == nil {
+		return len(b), nil
+	}
+
+	back, ok := s.Path.delay(n.rand, s.Path.Return)
+	if !ok {
+		return len(b), nil
+	}
+	c.pending = append(c.pending, packet{resp, sent.Add(out + back)})
+	return len(b), nil
+}
+
+func (c *conn) Read(b []byte) (int, error) {
+	deadline := c.net.now.Add(c.timeout)
+	next := -1
+	for i, p := range c.pending {
+		if !p.arrival.After(deadline) && (next < 0 || p.arrival.Before(c.pending[next].arrival)) {
+			next = i
+		}
+	}
+	if next < 0 {
+		c.net.Advance(c.timeout)
+		return 0, os.ErrDeadlineExceeded
+	}
+
+	p := c.pending[next]
+	c.pending = append(c.pending[:next], c.pending[next+1:]...)
+	c.net.Advance(p.arrival.Sub(c.net.now))
+	return copy(b, p.data), nil
+}
+
+func (c *conn) Close() error {
+	c.pending = nil
+	return nil
+}
+
+func (c *conn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *conn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// SetDeadline records the time remaining until t, measured by the system
+// clock and rounded to the millisecond, as the simulated timeout of
+// subsequent reads.
+func (c *conn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *conn) SetReadDeadline(t time.Time) error {
+	c.timeout = 0
+	if !t.IsZero() {
+		c.timeout = time.Until(t).Round(time.Millisecond)
+	}
+	return nil
+}
+
+func (c *conn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,170 @@
+// Copyright © 2015-2023 Brett Vickers.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ntpsim
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/jocelyndb/ntp"
+	"github.com/stretchr/testify/assert"
+)
+
+var start = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func assertDuration(t *testing.T, expected, actual, delta time.Duration) {
+	t.Helper()
+	assert.InDelta(t, float64(expected), float64(actual), float64(delta))
+}
+
+func TestOfflineSimulatedQuery(t *testing.T) {
+	n := NewNetwork(start, 1)
+	s := n.AddServer("192.0.2.1", ntp.ServerState{Stratum: 1})
+	s.Clock.Offset = time.Second
+	s.Path = Path{Outbound: 20 * time.Millisecond, Return: 20 * time.Millisecond}
+
+	r, err := n.Query("192.0.2.1")
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Nil(t, r.Validate())
+	assertDuration(t, time.Second, r.ClockOffset, time.Microsecond)
+	assertDuration(t, 40*time.Millisecond, r.RTT, time.Microsecond)
+	assert.Equal(t, 40*time.Millisecond, n.Elapsed())
+
+	// Asymmetric paths bias the offset by half the difference in delays.
+	s.Path = Path{Outbound: 10 * time.Millisecond, Return: 30 * time.Millisecond}
+	r, err = n.Query("192.0.2.1:123")
+	if assert.Nil(t, err) {
+		assertDuration(t, 990*time.Millisecond, r.ClockOffset, time.Microsecond)
+	}
+
+	// The client's clock error is measured too.
+	n.Client.Offset = -time.Second
+	r, err = n.Query("192.0.2.1")
+	if assert.Nil(t, err) {
+		assertDuration(t, 1990*time.Millisecond, r.ClockOffset, time.Microsecond)
+	}
+
+	_, err = n.Query("192.0.2.2")
+	assert.NotNil(t, err)
+}
+
+func TestOfflineSimulatedDriftAndSteps(t *testing.T) {
+	n := NewNetwork(start, 1)
+	s := n.AddServer("192.0.2.1", ntp.ServerState{Stratum: 1})
+	s.Clock.Drift = 10e-6
+	s.Clock.Step(start.Add(2*time.Hour), 2*time.Second)
+
+	n.Advance(time.Hour)
+	r, err := n.Query("192.0.2.1")
+	if assert.Nil(t, err) {
+		assertDuration(t, 36*time.Millisecond, r.ClockOffset, time.Microsecond)
+	}
+
+	n.Advance(time.Hour)
+	r, err = n.Query("192.0.2.1")
+	if assert.Nil(t, err) {
+		assertDuration(t, 2072*time.Millisecond, r.ClockOffset, time.Microsecond)
+	}
+	assertDuration(t, 2072*time.Millisecond, s.Clock.Error(), time.Microsecond)
+}
+
+func TestOfflineSimulatedLoss(t *testing.T) {
+	n := NewNetwork(start, 1)
+	s := n.AddServer("192.0.2.1", ntp.ServerState{Stratum: 1})
+	s.Path.Loss = 1
+
+	opt := n.QueryOptions()
+	opt.Timeout = 2 * time.Second
+	_, err := ntp.QueryWithOptions("192.0.2.1", opt)
+	assert.True(t, errors.Is(err, os.ErrDeadlineExceeded))
+	assert.Equal(t, 2*time.Second, n.Elapsed())
+
+	// Packets are lost in each direction.
+	s.Path.Loss = 0.5
+	var lost int
+	for i := 0; i < 100; i++ {
+		if _, err := ntp.QueryWithOptions("192.0.2.1", opt); err != nil {
+			lost++
+		}
+	}
+	assert.InDelta(t, 75, lost, 15)
+	stats := s.Server.Stats()
+	assert.True(t, stats.Received >= uint64(100-lost))
+	assert.True(t, stats.Received < 100)
+}
+
+// simulate disciplines the client's clock against three servers for six
+// simulated hours, stepping it by the median measured offset at each poll.
+// It returns the client's clock error after each poll.
+func simulate(seed int64) []time.Duration {
+	n := NewNetwork(start, seed)
+	n.Client.Offset = -500 * time.Millisecond
+	n.Client.Drift = 20e-6
+
+	addrs := []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"}
+	for i, addr := range addrs {
+		s := n.AddServer(addr, ntp.ServerState{Stratum: 1})
+		s.Clock.Offset = time.Duration(i-1) * time.Millisecond
+		s.Path = Path{
+			Outbound: 5 * time.Millisecond,
+			Return:   8 * time.Millisecond,
+			Jitter:   Exponential(2 * time.Millisecond),
+			Loss:     0.1,
+		}
+	}
+
+	var errs []time.Duration
+	for n.Elapsed() < 6*time.Hour {
+		var offsets []time.Duration
+		for _, addr := range addrs {
+			if r, err := n.Query(addr); err == nil {
+				offsets = append(offsets, r.ClockOffset)
+			}
+		}
+		if len(offsets) > 0 {
+			sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+			n.Client.Adjust(offsets[len(offsets)/2])
+		}
+		errs = append(errs, n.Client.Error())
+		n.Advance(64 * time.Second)
+	}
+	return errs
+}
+
+func TestOfflineSimulatedConvergence(t *testing.T) {
+	begin := time.Now()
+	errs := simulate(1)
+	assert.True(t, len(errs) > 300)
+
+	// After the first poll, the client's clock stays within the bounds set
+	// by the path asymmetry, jitter and drift between polls.
+	var worst float64
+	for _, e := range errs[1:] {
+		worst = math.Max(worst, math.Abs(float64(e)))
+	}
+	assert.True(t, worst < float64(10*time.Millisecond), "worst error %v", time.Duration(worst))
+
+	// Simulations are repeatable, and quick.
+	assert.Equal(t, errs, simulate(1))
+	assert.NotEqual(t, errs, simulate(2))
+	assert.True(t, time.Since(begin) < 5*time.Second)
+}
+
+func TestOfflineUniform(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 100; i++ {
+		d := Uniform(time.Millisecond, 2*time.Millisecond)(r)
+		assert.True(t, d >= time.Millisecond && d < 2*time.Millisecond, d)
+	}
+	assert.Equal(t, time.Millisecond, Uniform(time.Millisecond, time.Millisecond)(r))
+	assert.Equal(t, 2*time.Millisecond, Uniform(2*time.Millisecond, time.Millisecond)(r))
+}
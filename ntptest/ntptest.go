@@ -0,0 +1,374 @@
+// Copyright © 2015-2023 Brett Vickers.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package ntptest provides an in-process NTP server for end-to-end tests of
+// NTP clients, in the manner of net/http/httptest.
+//
+// A Server listens on a loopback UDP port and answers each query with the
+// Reply returned by its Handler. Replies control the advertised stratum,
+// leap indicator, reference ID and precision, and may be delayed, dropped,
+// duplicated, malformed, signed with a symmetric key or replaced by
+// kiss-of-death packets.
+//
+//	srv := ntptest.NewServer(ntptest.Script(
+//		&ntptest.Reply{Stratum: 2},
+//		&ntptest.Reply{KissCode: "RATE"},
+//	))
+//	defer srv.Close()
+//	resp, err := ntp.Query(srv.Addr)
+package ntptest
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/jocelyndb/ntp"
+)
+
+// A Request is an NTP query received by a Server.
+type Request struct {
+	// Packet holds the raw query, including any extension fields and MAC.
+	Packet []byte
+
+	// RemoteAddr is the client's address.
+	RemoteAddr net.Addr
+
+	// ReceiveTime is the time the query was received, according to the
+	// server's clock.
+	ReceiveTime time.Time
+
+	// Seq is the request's sequence number, starting from 1 for the first
+	// query received by the server.
+	Seq int
+}
+
+// Version returns the NTP version of the query.
+func (r *Request) Version() int {
+	return int(r.Packet[0]>>3) & 0x7
+}
+
+// Mode returns the NTP mode of the query.
+func (r *Request) Mode() uint8 {
+	return r.Packet[0] & 0x7
+}
+
+// TransmitTime returns the query's transmit timestamp, which is echoed in
+// the origin timestamp of the reply.
+func (r *Request) TransmitTime() ntp.Timestamp {
+	return ntp.Timestamp(binary.BigEndian.Uint64(r.Packet[40:]))
+}
+
+// A Reply describes how a Server answers a request.
+type Reply struct {
+	// Leap, Stratum, Poll, Precision and ReferenceID are copied to the
+	// reply's header. A zero Stratum is sent as stratum 1.
+	Leap        ntp.LeapIndicator
+	Stratum     uint8
+	Poll        int8
+	Precision   int8
+	ReferenceID uint32
+
+	// RootDelay and RootDispersion are copied to the reply's header.
+	RootDelay      time.Duration
+	RootDispersion time.Duration
+
+	// ReferenceTime is the reply's reference time. If zero, the reply's
+	// receive time is used.
+	ReferenceTime time.Time
+
+	// Version and Mode are the NTP version and mode of the reply. If zero,
+	// the query's version and server mode (4) are used.
+	Version int
+	Mode    uint8
+
+	// KissCode, if not empty, causes a kiss-of-death packet with the code
+	// (e.g., "RATE" or "DENY") to be sent. Stratum is ignored.
+	KissCode string
+
+	// ProcessingTime is added to the receive time to produce the transmit
+	// time. If zero, the transmit time is read from the server's clock as
+	// the reply is built.
+	ProcessingTime time.Duration
+
+	// OriginTime, if not zero, replaces the origin timestamp copied from
+	// the query, simulating a spoofed or stale reply.
+	OriginTime ntp.Timestamp
+
+	// Auth, if its Type or KeyRing is set, holds the key used to sign the
+	// reply. With a key ring, KeyID selects the signing key.
+	Auth ntp.AuthOptions
+
+	// CryptoNAK causes a crypto-NAK (a MAC holding only a zero key ID) to
+	// be appended to the reply in place of a signature.
+	CryptoNAK bool
+
+	// Malform, if not nil, is called with the encoded reply just before it
+	// is sent and returns the packet to send in its place.
+	Malform func(packet []byte) []byte
+
+	// Delay is how long the server waits after building the reply before
+	// sending it, simulating delay on the return path.
+	Delay time.Duration
+
+	// Drop causes the query to go unanswered.
+	Drop bool
+
+	// Duplicates is the number of extra copies of the reply to send.
+	Duplicates int
+}
+
+// A Handler chooses the reply to a request. Returning nil drops the
+// request.
+type Handler interface {
+	ServeNTP(req *Request) *Reply
+}
+
+// HandlerFunc adapts an ordinary function to the Handler interface.
+type HandlerFunc func(req *Request) *Reply
+
+// ServeNTP returns f(req).
+func (f HandlerFunc) ServeNTP(req *Request) *Reply {
+	return f(req)
+}
+
+// Script returns a handler answering successive requests with successive
+// replies. Once the replies are exhausted, the last is repeated. A nil
+// reply drops its request.
+func Script(replies ...*Reply) Handler {
+	return HandlerFunc(func(req *Request) *Reply {
+		if len(replies) == 0 {
+			return nil
+		}
+		i := req.Seq - 1
+		if i >= len(replies) {
+			i = len(replies) - 1
+		}
+		return replies[i]
+	})
+}
+
+// A clockFunc adapts a function to the ntp.Clock interface.
+type clockFunc func() time.Time
+
+func (f clockFunc) Now() time.Time {
+	return f()
+}
+
+// FixedClock returns a clock that always reports the time t.
+func FixedClock(t time.Time) ntp.Clock {
+	return clockFunc(func() time.Time { return t })
+}
+
+// SkewedClock returns a clock that reports the local system time plus
+// offset.
+func SkewedClock(offset time.Duration) ntp.Clock {
+	return clockFunc(func() time.Time { return time.Now().Add(offset) })
+}
+
+// A Server is an NTP server listening on a loopback UDP port.
+type Server struct {
+	// Addr is the server's address, in the form "127.0.0.1:port".
+	Addr string
+
+	// Handler chooses the reply to each request.
+	Handler Handler
+
+	// Clock supplies the server's time. Defaults to the local system clock.
+	Clock ntp.Clock
+
+	conn      net.PacketConn
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+	mu        sync.Mutex
+	requests  []*Request
+}
+
+// NewServer starts and returns a server answering requests using handler.
+// The caller should call Close when finished, to shut it down.
+func NewServer(handler Handler) *Server {
+	s := NewUnstartedServer(handler)
+	s.Start()
+	return s
+}
+
+// NewUnstartedServer returns a server that listens on a loopback port but
+// does not answer requests until Start is called. Its Clock may be set
+// before starting it.
+func NewUnstartedServer(handler Handler) *Server {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		panic("ntptest: failed to listen on a port: " + err.Error())
+	}
+	return &Server{
+		Addr:    conn.LocalAddr().String(),
+		Handler: handler,
+		conn:    conn,
+		done:    make(chan struct{}),
+	}
+}
+
+// Start starts answering requests.
+func (s *Server) Start() {
+	s.wg.Add(1)
+	go s.serve()
+}
+
+// Close shuts down the server and waits for pending replies to be sent or
+// abandoned. It may be called more than once.
+func (s *Server) Close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		s.conn.Close()
+	})
+	s.wg.Wait()
+}
+
+// Requests returns the requests received by the server so far.
+func (s *Server) Requests() []*Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*Request(nil), s.requests...)
+}
+
+func (s *Server) now() time.Time {
+	if s.Clock != nil {
+		return s.Clock.Now()
+	}
+	return time.Now()
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	buf := make([]byte, 1024)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		rxTime := s.now()
+		if n < 48 {
+			continue
+		}
+
+		s.mu.Lock()
+		req := &Request{
+			Packet:      append([]byte(nil), buf[:n]...),
+			RemoteAddr:  addr,
+			ReceiveTime: rxTime,
+			Seq:         len(s.requests) + 1,
+		}
+		s.requests = append(s.requests, req)
+		s.mu.Unlock()
+
+		reply := s.Handler.ServeNTP(req)
+		if reply == nil || reply.Drop {
+			continue
+		}
+		packet, err := s.build(req, reply)
+		if err != nil {
+			continue
+		}
+		if reply.Malform != nil {
+			packet = reply.Malform(packet)
+		}
+
+		s.wg.Add(1)
+		go s.send(packet, addr, reply)
+	}
+}
+
+// send sends the reply and its duplicates to addr after the reply's delay.
+func (s *Server) send(packet []byte, addr net.Addr, reply *Reply) {
+	defer s.wg.Done()
+	if reply.Delay > 0 {
+		t := time.NewTimer(reply.Delay)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-s.done:
+			return
+		}
+	}
+	for i := 0; i <= reply.Duplicates; i++ {
+		if _, err := s.conn.WriteTo(packet, addr); err != nil {
+			return
+		}
+	}
+}
+
+// build encodes the reply to req.
+func (s *Server) build(req *Request, reply *Reply) ([]byte, error) {
+	version := reply.Version
+	if version == 0 {
+		version = req.Version()
+	}
+	md := reply.Mode
+	if md == 0 {
+		md = 4
+	}
+	stratum, refID := reply.Stratum, reply.ReferenceID
+	switch {
+	case reply.KissCode != "":
+		var code [4]byte
+		copy(code[:], reply.KissCode)
+		stratum, refID = 0, binary.BigEndian.Uint32(code[:])
+	case stratum == 0:
+		stratum = 1
+	}
+
+	rxTime := req.ReceiveTime
+	xmtTime := rxTime.Add(reply.ProcessingTime)
+	if reply.ProcessingTime == 0 {
+		xmtTime = s.now()
+	}
+	refTime := reply.ReferenceTime
+	if refTime.IsZero() {
+		refTime = rxTime
+	}
+	origin := req.TransmitTime()
+	if reply.OriginTime != 0 {
+		origin = reply.OriginTime
+	}
+
+	b := make([]byte, 48, 48+4+64)
+	b[0] = uint8(reply.Leap)<<6 | uint8(version)<<3 | md
+	b[1] = stratum
+	b[2] = uint8(reply.Poll)
+	b[3] = uint8(reply.Precision)
+	binary.BigEndian.PutUint32(b[4:], uint32(ntp.NewShortTimestamp(reply.RootDelay)))
+	binary.BigEndian.PutUint32(b[8:], uint32(ntp.NewShortTimestamp(reply.RootDispersion)))
+	binary.BigEndian.PutUint32(b[12:], refID)
+	binary.BigEndian.PutUint64(b[16:], uint64(ntp.NewTimestamp(refTime)))
+	binary.BigEndian.PutUint64(b[24:], uint64(origin))
+	binary.BigEndian.PutUint64(b[32:], uint64(ntp.NewTimestamp(rxTime)))
+	binary.BigEndian.PutUint64(b[40:], uint64(ntp.NewTimestamp(xmtTime)))
+
+	switch {
+	case reply.CryptoNAK:
+		b = append(b, 0, 0, 0, 0)
+	case reply.Auth.Type != ntp.AuthNone || reply.Auth.KeyRing != nil:
+		return sign(b, reply.Auth)
+	}
+	return b, nil
+}
+
+// sign appends a MAC computed with the key described by opt to packet.
+func sign(packet []byte, opt ntp.AuthOptions) ([]byte, error) {
+	key, err := opt.SigningKey()
+	if err != nil {
+		return nil, err
+	}
+	a, ok := key.Type.Algorithm()
+	if !ok {
+		return nil, ntp.ErrInvalidAuthType
+	}
+	digest := a.CalcDigest(packet, key.Secret)
+	var kid [4]byte
+	binary.BigEndian.PutUint32(kid[:], uint32(key.ID))
+	packet = append(packet, kid[:]...)
+	return append(packet, digest...), nil
+}
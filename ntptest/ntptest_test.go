@@ -0,0 +1,190 @@
+// Copyright © 2015-2023 Brett Vickers.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ntptest
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jocelyndb/ntp"
+	"github.com/stretchr/testify/assert"
+)
+
+var opt = ntp.QueryOptions{Timeout: time.Second}
+
+func TestOfflineServer(t *testing.T) {
+	s := NewUnstartedServer(Script(&Reply{
+		Leap:           ntp.LeapAddSecond,
+		Stratum:        2,
+		Precision:      -20,
+		ReferenceID:    0xc0000201,
+		RootDelay:      10 * time.Millisecond,
+		RootDispersion: 20 * time.Millisecond,
+	}))
+	s.Clock = SkewedClock(time.Hour)
+	s.Start()
+	defer s.Close()
+
+	r, err := ntp.QueryWithOptions(s.Addr, opt)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Nil(t, r.Validate())
+	assert.Equal(t, ntp.LeapIndicator(ntp.LeapAddSecond), r.Leap)
+	assert.Equal(t, uint8(2), r.Stratum)
+	assert.Equal(t, "192.0.2.1", r.ReferenceString())
+	assert.Equal(t, time.Duration(953), r.Precision)
+	assert.InDelta(t, float64(10*time.Millisecond), float64(r.RootDelay), float64(20*time.Microsecond))
+	assert.InDelta(t, float64(20*time.Millisecond), float64(r.RootDispersion), float64(20*time.Microsecond))
+	assert.InDelta(t, float64(time.Hour), float64(r.ClockOffset), float64(10*time.Millisecond))
+
+	reqs := s.Requests()
+	if assert.Len(t, reqs, 1) {
+		assert.Equal(t, 1, reqs[0].Seq)
+		assert.Equal(t, 4, reqs[0].Version())
+		assert.Equal(t, uint8(3), reqs[0].Mode())
+	}
+}
+
+func TestOfflineFixedClock(t *testing.T) {
+	now := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := NewUnstartedServer(Script(&Reply{ProcessingTime: time.Millisecond}))
+	s.Clock = FixedClock(now)
+	s.Start()
+	defer s.Close()
+
+	r, err := ntp.QueryWithOptions(s.Addr, opt)
+	if assert.Nil(t, err) {
+		assert.True(t, r.Time.Equal(now.Add(time.Millisecond)))
+		assert.True(t, r.ReferenceTime.Equal(now))
+	}
+}
+
+func TestOfflineKissOfDeath(t *testing.T) {
+	s := NewServer(Script(&Reply{KissCode: "RATE"}))
+	defer s.Close()
+
+	r, err := ntp.QueryWithOptions(s.Addr, opt)
+	if assert.Nil(t, err) {
+		assert.True(t, r.IsKissOfDeath())
+		assert.Equal(t, "RATE", r.KissCode)
+		assert.True(t, errors.Is(r.Validate(), ntp.ErrKissOfDeath))
+	}
+}
+
+func TestOfflineDropAndDelay(t *testing.T) {
+	s := NewServer(Script(
+		&Reply{Drop: true},
+		nil,
+		&Reply{Delay: 50 * time.Millisecond, Duplicates: 2},
+	))
+	defer s.Close()
+
+	short := ntp.QueryOptions{Timeout: 100 * time.Millisecond}
+	for i := 0; i < 2; i++ {
+		_, err := ntp.QueryWithOptions(s.Addr, short)
+		assert.NotNil(t, err)
+	}
+
+	r, err := ntp.QueryWithOptions(s.Addr, opt)
+	if assert.Nil(t, err) {
+		assert.True(t, r.RTT >= 50*time.Millisecond)
+	}
+	assert.Len(t, s.Requests(), 3)
+}
+
+func TestOfflineMalformed(t *testing.T) {
+	s := NewServer(Script(
+		&Reply{Malform: func(b []byte) []byte { return b[:20] }},
+		&Reply{Mode: 5},
+		&Reply{OriginTime: ntp.Timestamp(1)},
+		&Reply{Version: 3},
+	))
+	defer s.Close()
+
+	_, err := ntp.QueryWithOptions(s.Addr, opt)
+	assert.NotNil(t, err)
+	_, err = ntp.QueryWithOptions(s.Addr, opt)
+	assert.True(t, errors.Is(err, ntp.ErrInvalidMode))
+	_, err = ntp.QueryWithOptions(s.Addr, opt)
+	assert.True(t, errors.Is(err, ntp.ErrServerResponseMismatch))
+	r, err := ntp.QueryWithOptions(s.Addr, opt)
+	if assert.Nil(t, err) {
+		assert.Equal(t, 3, r.Version)
+		policy := &ntp.ValidationPolicy{MinVersion: 4}
+		assert.True(t, errors.Is(r.ValidateWithPolicy(policy).Err(), ntp.ErrInvalidResponseVersion))
+	}
+}
+
+func TestOfflineAuth(t *testing.T) {
+	auth := ntp.AuthOptions{Type: ntp.AuthSHA1, Key: "HEX:6931564b4a5a5045766c55356b30656c7666316c", KeyID: 7}
+	wrong := auth
+	wrong.Key = "ASCII:cvuZyN4C8HX8hNcAWDWp"
+
+	s := NewServer(Script(
+		&Reply{Auth: auth},
+		&Reply{Auth: wrong},
+		&Reply{CryptoNAK: true},
+		&Reply{},
+	))
+	defer s.Close()
+
+	o := opt
+	o.Auth = auth
+	var authErr *ntp.AuthError
+
+	r, err := ntp.QueryWithOptions(s.Addr, o)
+	if assert.Nil(t, err) {
+		assert.Nil(t, r.AuthErr())
+	}
+	r, err = ntp.QueryWithOptions(s.Addr, o)
+	if assert.Nil(t, err) && assert.True(t, errors.As(r.AuthErr(), &authErr)) {
+		assert.Equal(t, ntp.AuthDigestMismatch, authErr.Failure)
+	}
+	r, err = ntp.QueryWithOptions(s.Addr, o)
+	if assert.Nil(t, err) && assert.True(t, errors.As(r.AuthErr(), &authErr)) {
+		assert.Equal(t, ntp.AuthCryptoNAK, authErr.Failure)
+	}
+	r, err = ntp.QueryWithOptions(s.Addr, o)
+	if assert.Nil(t, err) && assert.True(t, errors.As(r.AuthErr(), &authErr)) {
+		assert.Equal(t, ntp.AuthMissingMAC, authErr.Failure)
+	}
+
+	// Replies may be signed using a key ring.
+	ring := ntp.NewKeyRing(ntp.Key{ID: 9, Type: ntp.AuthHMACSHA256, Secret: []byte("0123456789abcdef")})
+	s2 := NewServer(Script(&Reply{Auth: ntp.AuthOptions{KeyRing: ring, KeyID: 9}}))
+	defer s2.Close()
+
+	o.Auth = ntp.AuthOptions{KeyRing: ring, KeyID: 9}
+	r, err = ntp.QueryWithOptions(s2.Addr, o)
+	if assert.Nil(t, err) {
+		assert.Nil(t, r.AuthErr())
+	}
+
+	// A zero key ID selects the key ring's current key.
+	ring.Use(9)
+	s3 := NewServer(Script(&Reply{Auth: ntp.AuthOptions{KeyRing: ring}}))
+	defer s3.Close()
+	r, err = ntp.QueryWithOptions(s3.Addr, o)
+	if assert.Nil(t, err) {
+		assert.Nil(t, r.AuthErr())
+	}
+
+	// Keys too short for their algorithm are rejected, so the reply is not
+	// sent.
+	short := ntp.AuthOptions{Type: ntp.AuthAES128, Key: "ASCII:short", KeyID: 1}
+	s4 := NewServer(Script(&Reply{Auth: short}))
+	defer s4.Close()
+	o.Timeout = 100 * time.Millisecond
+	_, err = ntp.QueryWithOptions(s4.Addr, o)
+	assert.NotNil(t, err)
+}
+
+func TestOfflineCloseTwice(t *testing.T) {
+	s := NewServer(Script(&Reply{}))
+	defer s.Close()
+	s.Close()
+}
@@ -0,0 +1,683 @@
+// Copyright © 2015-2023 Brett Vickers.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ntp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PcapFormat selects the file format written by a PcapWriter.
+type PcapFormat int
+
+const (
+	// PcapClassic is the libpcap file format, with nanosecond timestamps.
+	PcapClassic PcapFormat = iota
+
+	// PcapNG is the pcapng file format.
+	PcapNG
+)
+
+// Link-layer header types. See https://www.tcpdump.org/linktypes.html.
+const (
+	linkNull      = 0
+	linkEthernet  = 1
+	linkRaw       = 101
+	linkLoop      = 108
+	linkLinuxSLL  = 113
+	linkIPv4      = 228
+	linkIPv6      = 229
+	linkLinuxSLL2 = 276
+)
+
+// Packet capture file constants.
+const (
+	pcapMagicMicro  = 0xa1b2c3d4
+	pcapMagicNano   = 0xa1b23c4d
+	pcapSnapLen     = 65535
+	pcapMaxRecord   = 1 << 18
+	pcapngSHB       = 0x0a0d0d0a
+	pcapngIDB       = 1
+	pcapngSPB       = 3
+	pcapngEPB       = 6
+	pcapngByteOrder = 0x1a2b3c4d
+	pcapngTSResol   = 9
+)
+
+// A PcapWriter writes NTP packets to a packet capture file readable by
+// tcpdump and Wireshark. Since the packets are captured above the network
+// layer, their IP and UDP headers are synthesized.
+type PcapWriter struct {
+	w       io.Writer
+	format  PcapFormat
+	started bool
+	ipID    uint16
+}
+
+// NewPcapWriter returns a writer of packet capture files in the requested
+// format. The file header is written with the first packet.
+func NewPcapWriter(w io.Writer, format PcapFormat) *PcapWriter {
+	return &PcapWriter{w: w, format: format}
+}
+
+// NewPcapRecorder returns a recorder writing each exchange to w as a pair of
+// packets in a packet capture file of the requested format.
+func NewPcapRecorder(w io.Writer, format PcapFormat) *Recorder {
+	pw := NewPcapWriter(w, format)
+	return &Recorder{write: pw.WriteExchange}
+}
+
+// WritePacket writes a UDP packet sent from src to dst at time t, holding
+// payload.
+func (pw *PcapWriter) WritePacket(t time.Time, src, dst *net.UDPAddr, payload []byte) error {
+	var b []byte
+	if !pw.started {
+		b = pw.appendFileHeader(b)
+		pw.started = true
+	}
+
+	pw.ipID++
+	pkt := appendUDPPacket(nil, src, dst, payload, pw.ipID)
+	le := binary.LittleEndian
+	ns := t.UnixNano()
+	if t.IsZero() {
+		ns = 0
+	}
+	switch pw.format {
+	case PcapNG:
+		padded := (len(pkt) + 3) &^ 3
+		blockLen := uint32(32 + padded)
+		var h [28]byte
+		le.PutUint32(h[0:], pcapngEPB)
+		le.PutUint32(h[4:], blockLen)
+		le.PutUint32(h[8:], 0) // interface ID
+		le.PutUint32(h[12:], uint32(uint64(ns)>>32))
+		le.PutUint32(h[16:], uint32(ns))
+		le.PutUint32(h[20:], uint32(len(pkt)))
+		le.PutUint32(h[24:], uint32(len(pkt)))
+		b = append(b, h[:]...)
+		b = append(b, pkt...)
+		b = append(b, make([]byte, padded-len(pkt))...)
+		b = appendUint32(b, le, blockLen)
+	default:
+		var h [16]byte
+		le.PutUint32(h[0:], uint32(ns/1e9))
+		le.PutUint32(h[4:], uint32(ns%1e9))
+		le.PutUint32(h[8:], uint32(len(pkt)))
+		le.PutUint32(h[12:], uint32(len(pkt)))
+		b = append(b, h[:]...)
+		b = append(b, pkt...)
+	}
+
+	_, err := pw.w.Write(b)
+	return err
+}
+
+// WriteExchange writes the query of an exchange, sent at its SendTime from
+// its Local address to its Server, followed by the response, if any,
+// received at its RecvTime. Unknown addresses are written as unspecified
+// addresses.
+func (pw *PcapWriter) WriteExchange(e *Exchange) error {
+	server := parseUDPAddr(e.Server)
+	local := parseUDPAddr(e.Local)
+	if err := pw.WritePacket(e.SendTime, local, server, e.Request); err != nil {
+		return err
+	}
+	if e.Response == nil {
+		return nil
+	}
+	return pw.WritePacket(e.RecvTime, server, local, e.Response)
+}
+
+func (pw *PcapWriter) appendFileHeader(b []byte) []byte {
+	le := binary.LittleEndian
+	switch pw.format {
+	case PcapNG:
+		// Section header block.
+		b = appendUint32(b, le, pcapngSHB)
+		b = appendUint32(b, le, 28)
+		b = appendUint32(b, le, pcapngByteOrder)
+		b = append(b, 1, 0, 0, 0) // version 1.0
+		b = append(b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff)
+		b = appendUint32(b, le, 28)
+
+		// Interface description block, with nanosecond timestamps.
+		b = appendUint32(b, le, pcapngIDB)
+		b = appendUint32(b, le, 32)
+		b = append(b, linkRaw, 0, 0, 0)
+		b = appendUint32(b, le, pcapSnapLen)
+		b = append(b, pcapngTSResol, 0, 1, 0, 9, 0, 0, 0)
+		b = append(b, 0, 0, 0, 0) // end of options
+		b = appendUint32(b, le, 32)
+	default:
+		b = appendUint32(b, le, pcapMagicNano)
+		b = append(b, 2, 0, 4, 0) // version 2.4
+		b = append(b, 0, 0, 0, 0, 0, 0, 0, 0)
+		b = appendUint32(b, le, pcapSnapLen)
+		b = appendUint32(b, le, linkRaw)
+	}
+	return b
+}
+
+func appendUint32(b []byte, order binary.ByteOrder, v uint32) []byte {
+	var w [4]byte
+	order.PutUint32(w[:], v)
+	return append(b, w[:]...)
+}
+
+// parseUDPAddr parses a "host:port" address holding an IP address. It
+// returns an unspecified address if s is empty or holds a host name.
+func parseUDPAddr(s string) *net.UDPAddr {
+	addr := &net.UDPAddr{IP: net.IPv4zero}
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return addr
+	}
+	zone := ""
+	if i := strings.LastIndexByte(host, '%'); i >= 0 {
+		host, zone = host[:i], host[i+1:]
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		addr.IP, addr.Zone = ip, zone
+	}
+	addr.Port, _ = strconv.Atoi(port)
+	return addr
+}
+
+// appendUDPPacket appends an IPv4 or IPv6 packet holding a UDP datagram to
+// b. IPv6 is used unless both addresses are IPv4 addresses.
+func appendUDPPacket(b []byte, src, dst *net.UDPAddr, payload []byte, id uint16) []byte {
+	be := binary.BigEndian
+	udpLen := 8 + len(payload)
+	var pseudo []byte
+
+	src4, dst4 := src.IP.To4(), dst.IP.To4()
+	if src4 != nil && dst4 != nil {
+		var h [20]byte
+		h[0] = 0x45
+		be.PutUint16(h[2:], uint16(20+udpLen))
+		be.PutUint16(h[4:], id)
+		h[8] = 64 // TTL
+		h[9] = 17 // UDP
+		copy(h[12:], src4)
+		copy(h[16:], dst4)
+		be.PutUint16(h[10:], checksum(h[:]))
+		b = append(b, h[:]...)
+
+		pseudo = append(append(pseudo, src4...), dst4...)
+		pseudo = append(pseudo, 0, 17, byte(udpLen>>8), byte(udpLen))
+	} else {
+		var h [40]byte
+		h[0] = 0x60
+		be.PutUint16(h[4:], uint16(udpLen))
+		h[6] = 17 // UDP
+		h[7] = 64 // hop limit
+		copy(h[8:], ipOrZero(src.IP).To16())
+		copy(h[24:], ipOrZero(dst.IP).To16())
+		b = append(b, h[:]...)
+
+		pseudo = append(pseudo, h[8:40]...)
+		pseudo = appendUint32(pseudo, be, uint32(udpLen))
+		pseudo = append(pseudo, 0, 0, 0, 17)
+	}
+
+	var u [8]byte
+	be.PutUint16(u[0:], uint16(src.Port))
+	be.PutUint16(u[2:], uint16(dst.Port))
+	be.PutUint16(u[4:], uint16(udpLen))
+	sum := checksum(append(append(pseudo, u[:]...), payload...))
+	if sum == 0 {
+		sum = 0xffff
+	}
+	be.PutUint16(u[6:], sum)
+	b = append(b, u[:]...)
+	return append(b, payload...)
+}
+
+func ipOrZero(ip net.IP) net.IP {
+	if ip == nil {
+		return net.IPv6zero
+	}
+	return ip
+}
+
+// checksum returns the Internet checksum of data. See RFC 1071.
+func checksum(data []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(data[i])<<8 | uint32(data[i+1])
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+// A CapturedPacket is an NTP packet read from a packet capture file.
+type CapturedPacket struct {
+	// Time is the time the packet was captured. It is zero if the capture
+	// file did not record it.
+	Time time.Time
+
+	// Src and Dst are the packet's source and destination addresses.
+	Src *net.UDPAddr
+	Dst *net.UDPAddr
+
+	// Payload holds the NTP packet, including any extension fields and MAC.
+	Payload []byte
+
+	// The remaining fields are decoded from the NTP packet header.
+	Leap           LeapIndicator
+	Version        int
+	Mode           uint8
+	Stratum        uint8
+	Poll           int8
+	Precision      int8
+	RootDelay      time.Duration
+	RootDispersion time.Duration
+	ReferenceID    uint32
+	ReferenceTime  Timestamp
+	OriginTime     Timestamp
+	ReceiveTime    Timestamp
+	TransmitTime   Timestamp
+}
+
+// ReadPcap reads the NTP packets in a packet capture file in the pcap or
+// pcapng format. Only UDP packets sent to or from one of the listed ports
+// are read; if no ports are listed, the NTP port 123 is used. Ethernet
+// (with VLAN tags), raw IP, loopback and Linux cooked captures of IPv4 and
+// IPv6 are supported. Fragmented packets are skipped.
+func ReadPcap(r io.Reader, ports ...int) ([]CapturedPacket, error) {
+	if len(ports) == 0 {
+		ports = []int{defaultNtpPort}
+	}
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(4)
+	if err != nil {
+		return nil, ErrInvalidCapture
+	}
+
+	c := &pcapReader{r: br, ports: ports}
+	if binary.LittleEndian.Uint32(magic) == pcapngSHB {
+		err = c.readPcapNG()
+	} else {
+		err = c.readPcap()
+	}
+	return c.packets, err
+}
+
+// A pcapReader reads NTP packets from a packet capture file.
+type pcapReader struct {
+	r       *bufio.Reader
+	ports   []int
+	packets []CapturedPacket
+}
+
+// pcapInterface describes a pcapng capture interface.
+type pcapInterface struct {
+	link  int
+	units uint64 // timestamp units per second
+}
+
+func (c *pcapReader) read(n int) ([]byte, error) {
+	if n < 0 || n > pcapMaxRecord {
+		return nil, ErrInvalidCapture
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(c.r, b); err != nil {
+		return nil, ErrInvalidCapture
+	}
+	return b, nil
+}
+
+func (c *pcapReader) readPcap() error {
+	h, err := c.read(24)
+	if err != nil {
+		return err
+	}
+
+	var order binary.ByteOrder
+	var units uint64
+	for _, o := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		switch o.Uint32(h) {
+		case pcapMagicMicro:
+			order, units = o, 1e6
+		case pcapMagicNano:
+			order, units = o, 1e9
+		}
+		if order != nil {
+			break
+		}
+	}
+	if order == nil {
+		return ErrInvalidCapture
+	}
+	link := int(order.Uint32(h[20:]) & 0xffff)
+
+	for {
+		if _, err := c.r.Peek(1); err == io.EOF {
+			return nil
+		}
+		rh, err := c.read(16)
+		if err != nil {
+			return err
+		}
+		data, err := c.read(int(order.Uint32(rh[8:])))
+		if err != nil {
+			return err
+		}
+		sec, frac := uint64(order.Uint32(rh[0:])), uint64(order.Uint32(rh[4:]))
+		c.decode(link, pcapTime(sec*units+frac, units), data)
+	}
+}
+
+func (c *pcapReader) readPcapNG() error {
+	var order binary.ByteOrder
+	var ifaces []pcapInterface
+	for {
+		if _, err := c.r.Peek(1); err == io.EOF {
+			return nil
+		}
+		h, err := c.read(8)
+		if err != nil {
+			return err
+		}
+
+		blockType := binary.LittleEndian.Uint32(h)
+		if blockType == pcapngSHB {
+			bom, err := c.read(4)
+			if err != nil {
+				return err
+			}
+			switch {
+			case binary.LittleEndian.Uint32(bom) == pcapngByteOrder:
+				order = binary.LittleEndian
+			case binary.BigEndian.Uint32(bom) == pcapngByteOrder:
+				order = binary.BigEndian
+			default:
+				return ErrInvalidCapture
+			}
+			if _, err := c.read(int(order.Uint32(h[4:])) - 12); err != nil {
+				return err
+			}
+			ifaces = nil
+			continue
+		}
+		if order == nil {
+			return ErrInvalidCapture
+		}
+
+		blockType = order.Uint32(h)
+		block, err := c.read(int(order.Uint32(h[4:])) - 8)
+		if err != nil || len(block) < 4 {
+			return ErrInvalidCapture
+		}
+		body := block[:len(block)-4]
+
+		switch blockType {
+		case pcapngIDB:
+			if len(body) < 8 {
+				return ErrInvalidCapture
+			}
+			ifaces = append(ifaces, pcapInterface{
+				link:  int(order.Uint16(body)),
+				units: pcapngUnits(order, body[8:]),
+			})
+		case pcapngEPB:
+			if len(body) < 20 {
+				return ErrInvalidCapture
+			}
+			id := order.Uint32(body)
+			capLen := int(order.Uint32(body[12:]))
+			if int(id) >= len(ifaces) || capLen > len(body)-20 {
+				return ErrInvalidCapture
+			}
+			ts := uint64(order.Uint32(body[4:]))<<32 | uint64(order.Uint32(body[8:]))
+			iface := ifaces[id]
+			c.decode(iface.link, pcapTime(ts, iface.units), body[20:20+capLen])
+		case pcapngSPB:
+			if len(body) < 4 || len(ifaces) == 0 {
+				return ErrInvalidCapture
+			}
+			data := body[4:]
+			if n := int(order.Uint32(body)); n < len(data) {
+				data = data[:n]
+			}
+			c.decode(ifaces[0].link, time.Time{}, data)
+		}
+	}
+}
+
+// pcapngUnits returns the number of timestamp units per second described
+// by the options of an interface description block.
+func pcapngUnits(order binary.ByteOrder, opts []byte) uint64 {
+	for len(opts) >= 4 {
+		code, n := order.Uint16(opts), int(order.Uint16(opts[2:]))
+		if code == 0 || 4+n > len(opts) {
+			break
+		}
+		if code == pcapngTSResol && n >= 1 {
+			v := opts[4]
+			if v&0x80 != 0 {
+				return 1 << (v & 0x7f)
+			}
+			units := uint64(1)
+			for i := 0; i < int(v); i++ {
+				units *= 10
+			}
+			return units
+		}
+		opts = opts[4+(n+3)&^3:]
+	}
+	return 1e6
+}
+
+// pcapTime converts a timestamp in units per second to a time.
+func pcapTime(ts, units uint64) time.Time {
+	if units == 0 {
+		return time.Time{}
+	}
+	sec, frac := ts/units, ts%units
+	var ns uint64
+	if units <= 1e9 {
+		ns = frac * 1e9 / units
+	} else {
+		ns = frac / (units / 1e9)
+	}
+	return time.Unix(int64(sec), int64(ns))
+}
+
+// decode decodes the NTP packet in a captured frame, if any.
+func (c *pcapReader) decode(link int, t time.Time, frame []byte) {
+	pkt, ok := linkPayload(link, frame)
+	if !ok {
+		return
+	}
+	src, dst, payload, ok := decodeUDP(pkt)
+	if !ok || len(payload) < 48 || !c.ntpPort(src.Port, dst.Port) {
+		return
+	}
+
+	var h header
+	h.unmarshal(payload)
+	c.packets = append(c.packets, CapturedPacket{
+		Time:           t,
+		Src:            src,
+		Dst:            dst,
+		Payload:        append([]byte(nil), payload...),
+		Leap:           h.getLeap(),
+		Version:        h.getVersion(),
+		Mode:           uint8(h.getMode()),
+		Stratum:        h.Stratum,
+		Poll:           h.Poll,
+		Precision:      h.Precision,
+		RootDelay:      h.RootDelay.Duration(),
+		RootDispersion: h.RootDispersion.Duration(),
+		ReferenceID:    h.ReferenceID,
+		ReferenceTime:  Timestamp(h.ReferenceTime),
+		OriginTime:     Timestamp(h.OriginTime),
+		ReceiveTime:    Timestamp(h.ReceiveTime),
+		TransmitTime:   Timestamp(h.TransmitTime),
+	})
+}
+
+func (c *pcapReader) ntpPort(src, dst int) bool {
+	for _, p := range c.ports {
+		if src == p || dst == p {
+			return true
+		}
+	}
+	return false
+}
+
+// linkPayload returns the IP packet held by a link-layer frame.
+func linkPayload(link int, frame []byte) ([]byte, bool) {
+	be := binary.BigEndian
+	isIP := func(etherType uint16) bool {
+		return etherType == 0x0800 || etherType == 0x86dd
+	}
+
+	switch link {
+	case linkNull, linkLoop:
+		if len(frame) < 4 {
+			return nil, false
+		}
+		return frame[4:], true
+	case linkEthernet:
+		off := 14
+		if len(frame) < off {
+			return nil, false
+		}
+		etherType := be.Uint16(frame[12:])
+		for etherType == 0x8100 || etherType == 0x88a8 {
+			if len(frame) < off+4 {
+				return nil, false
+			}
+			etherType = be.Uint16(frame[off+2:])
+			off += 4
+		}
+		return frame[off:], isIP(etherType)
+	case linkRaw, linkIPv4, linkIPv6:
+		return frame, true
+	case linkLinuxSLL:
+		if len(frame) < 16 {
+			return nil, false
+		}
+		return frame[16:], isIP(be.Uint16(frame[14:]))
+	case linkLinuxSLL2:
+		if len(frame) < 20 {
+			return nil, false
+		}
+		return frame[20:], isIP(be.Uint16(frame))
+	}
+	return nil, false
+}
+
+// decodeUDP decodes an unfragmented IPv4 or IPv6 packet holding a UDP
+// datagram.
+func decodeUDP(pkt []byte) (src, dst *net.UDPAddr, payload []byte, ok bool) {
+	be := binary.BigEndian
+	if len(pkt) < 1 {
+		return nil, nil, nil, false
+	}
+
+	var srcIP, dstIP net.IP
+	var udp []byte
+	switch pkt[0] >> 4 {
+	case 4:
+		if len(pkt) < 20 {
+			return nil, nil, nil, false
+		}
+		ihl := int(pkt[0]&0x0f) * 4
+		total := int(be.Uint16(pkt[2:]))
+		frag := be.Uint16(pkt[6:])
+		if ihl < 20 || total < ihl || total > len(pkt) || pkt[9] != 17 || frag&0x3fff != 0 {
+			return nil, nil, nil, false
+		}
+		srcIP, dstIP = net.IP(pkt[12:16]), net.IP(pkt[16:20])
+		udp = pkt[ihl:total]
+	case 6:
+		if len(pkt) < 40 {
+			return nil, nil, nil, false
+		}
+		end := 40 + int(be.Uint16(pkt[4:]))
+		if end > len(pkt) {
+			end = len(pkt)
+		}
+		next, off := pkt[6], 40
+		for next != 17 {
+			// Skip hop-by-hop, routing and destination options headers.
+			if (next != 0 && next != 43 && next != 60) || off+8 > end {
+				return nil, nil, nil, false
+			}
+			next = pkt[off]
+			off += (int(pkt[off+1]) + 1) * 8
+		}
+		if off > end {
+			return nil, nil, nil, false
+		}
+		srcIP, dstIP = net.IP(pkt[8:24]), net.IP(pkt[24:40])
+		udp = pkt[off:end]
+	default:
+		return nil, nil, nil, false
+	}
+
+	if len(udp) < 8 {
+		return nil, nil, nil, false
+	}
+	n := int(be.Uint16(udp[4:]))
+	if n < 8 || n > len(udp) {
+		return nil, nil, nil, false
+	}
+	src = &net.UDPAddr{IP: append(net.IP(nil), srcIP...), Port: int(be.Uint16(udp[0:]))}
+	dst = &net.UDPAddr{IP: append(net.IP(nil), dstIP...), Port: int(be.Uint16(udp[2:]))}
+	return src, dst, udp[8:n], true
+}
+
+// MatchPackets pairs the client queries in a capture with the server
+// responses to them, returning an exchange for each query in the order
+// captured. A response matches a query if it was sent between the same
+// addresses and its origin timestamp equals the query's transmit timestamp.
+// Queries without a response are returned with a nil Response. The
+// exchanges' times are capture times, so the offsets decoded from them are
+// relative to the clock of the capturing host.
+func MatchPackets(packets []CapturedPacket) []Exchange {
+	type key struct {
+		client, server string
+		xmt            Timestamp
+	}
+	pending := make(map[key]int)
+
+	var exchanges []Exchange
+	for i := range packets {
+		p := &packets[i]
+		switch mode(p.Mode) {
+		case client:
+			pending[key{p.Src.String(), p.Dst.String(), p.TransmitTime}] = len(exchanges)
+			exchanges = append(exchanges, Exchange{
+				Server:   p.Dst.String(),
+				Local:    p.Src.String(),
+				Request:  p.Payload,
+				SendTime: p.Time,
+			})
+		case server:
+			k := key{p.Dst.String(), p.Src.String(), p.OriginTime}
+			if j, ok := pending[k]; ok {
+				exchanges[j].Response = p.Payload
+				exchanges[j].RecvTime = p.Time
+				delete(pending, k)
+			}
+		}
+	}
+	return exchanges
+}
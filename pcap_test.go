@@ -0,0 +1,173 @@
+// Copyright © 2015-2023 Brett Vickers.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ntp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOfflinePcapRecord(t *testing.T) {
+	s := NewServer(ServerState{Stratum: 2})
+	s.Clock = &offsetClock{time.Hour}
+	addr := startTestServer(t, s)
+	serverPort := parseUDPAddr(addr).Port
+
+	for _, format := range []PcapFormat{PcapClassic, PcapNG} {
+		var buf bytes.Buffer
+		rec := NewPcapRecorder(&buf, format)
+		opt := rec.Options(QueryOptions{Timeout: time.Second})
+		for i := 0; i < 2; i++ {
+			_, err := QueryWithOptions(addr, opt)
+			assert.Nil(t, err)
+		}
+		if !assert.Nil(t, rec.Err()) {
+			continue
+		}
+
+		// Packets on other ports are skipped.
+		packets, err := ReadPcap(bytes.NewReader(buf.Bytes()))
+		assert.Nil(t, err)
+		assert.Len(t, packets, 0)
+
+		packets, err = ReadPcap(bytes.NewReader(buf.Bytes()), serverPort)
+		if !assert.Nil(t, err) || !assert.Len(t, packets, 4) {
+			continue
+		}
+		recorded := rec.Exchanges()
+		q, r := packets[0], packets[1]
+		assert.Equal(t, recorded[0].Local, q.Src.String())
+		assert.Equal(t, addr, q.Dst.String())
+		assert.Equal(t, uint8(client), q.Mode)
+		assert.Equal(t, 4, q.Version)
+		assert.True(t, q.Time.Equal(recorded[0].SendTime))
+		assert.Equal(t, uint8(server), r.Mode)
+		assert.Equal(t, uint8(2), r.Stratum)
+		assert.Equal(t, q.TransmitTime, r.OriginTime)
+		assert.True(t, r.Time.Equal(recorded[0].RecvTime))
+
+		// Matched exchanges decode to the same offsets as the recording.
+		exchanges := MatchPackets(packets)
+		if assert.Len(t, exchanges, 2) {
+			for i, e := range exchanges {
+				r1, err1 := e.Decode()
+				r2, err2 := recorded[i].Decode()
+				if assert.Nil(t, err1) && assert.Nil(t, err2) {
+					assert.Equal(t, r2.ClockOffset, r1.ClockOffset)
+					assert.Equal(t, r2.RTT, r1.RTT)
+					assert.InDelta(t, float64(time.Hour), float64(r1.ClockOffset), float64(10*time.Millisecond))
+				}
+			}
+		}
+	}
+}
+
+func TestOfflinePcapSynthesizedHeaders(t *testing.T) {
+	payload := make([]byte, 48)
+	payload[0] = 4<<3 | byte(client)
+
+	// IPv4 header and UDP checksums verify.
+	src := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 40000}
+	dst := &net.UDPAddr{IP: net.ParseIP("192.0.2.2"), Port: 123}
+	pkt := appendUDPPacket(nil, src, dst, payload, 1)
+	assert.Len(t, pkt, 20+8+48)
+	assert.Equal(t, uint16(0), checksum(pkt[:20]))
+	pseudo := append(append([]byte{}, pkt[12:20]...), 0, 17, 0, 56)
+	assert.Equal(t, uint16(0), checksum(append(pseudo, pkt[20:]...)))
+
+	// IPv6 is used if either address is an IPv6 address.
+	src6 := &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 40000}
+	dst6 := &net.UDPAddr{IP: net.ParseIP("2001:db8::2"), Port: 123}
+	pkt6 := appendUDPPacket(nil, src6, dst6, payload, 1)
+	assert.Len(t, pkt6, 40+8+48)
+	pseudo = append(append([]byte{}, pkt6[8:40]...), 0, 0, 0, 56, 0, 0, 0, 17)
+	assert.Equal(t, uint16(0), checksum(append(pseudo, pkt6[40:]...)))
+
+	s, d, p, ok := decodeUDP(pkt6)
+	if assert.True(t, ok) {
+		assert.Equal(t, src6.String(), s.String())
+		assert.Equal(t, dst6.String(), d.String())
+		assert.Equal(t, payload, p)
+	}
+}
+
+func TestOfflinePcapRead(t *testing.T) {
+	// Build a big-endian, microsecond-resolution capture of VLAN-tagged
+	// Ethernet frames, as written by tcpdump on some platforms.
+	be := binary.BigEndian
+	var b []byte
+	b = appendUint32(b, be, pcapMagicMicro)
+	b = append(b, 0, 2, 0, 4, 0, 0, 0, 0, 0, 0, 0, 0)
+	b = appendUint32(b, be, pcapSnapLen)
+	b = appendUint32(b, be, linkEthernet)
+
+	src := &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 40000}
+	dst := &net.UDPAddr{IP: net.ParseIP("2001:db8::2"), Port: 123}
+	send := time.Unix(1700000000, 250000000)
+	query := (&header{LiVnMode: 4<<3 | byte(client), TransmitTime: 0xabcd}).appendTo(nil)
+	resp := (&header{
+		LiVnMode:     4<<3 | byte(server),
+		Stratum:      1,
+		ReferenceID:  kissCodeID("GPS"),
+		OriginTime:   0xabcd,
+		ReceiveTime:  toNtpTime(send.Add(-time.Second + 5*time.Millisecond)),
+		TransmitTime: toNtpTime(send.Add(-time.Second + 5*time.Millisecond)),
+	}).appendTo(nil)
+	frames := []struct {
+		t        time.Time
+		src, dst *net.UDPAddr
+		payload  []byte
+	}{
+		{send, src, dst, query},
+		{send.Add(time.Millisecond), src, &net.UDPAddr{IP: dst.IP, Port: 53}, query},
+		{send.Add(10 * time.Millisecond), dst, src, resp},
+		{send.Add(20 * time.Millisecond), src, dst, query[:40]},
+	}
+	for _, f := range frames {
+		frame := make([]byte, 12, 18)
+		frame = append(frame, 0x81, 0x00, 0x00, 0x05, 0x86, 0xdd)
+		frame = appendUDPPacket(frame, f.src, f.dst, f.payload, 0)
+		b = appendUint32(b, be, uint32(f.t.Unix()))
+		b = appendUint32(b, be, uint32(f.t.Nanosecond()/1000))
+		b = appendUint32(b, be, uint32(len(frame)))
+		b = appendUint32(b, be, uint32(len(frame)))
+		b = append(b, frame...)
+	}
+
+	packets, err := ReadPcap(bytes.NewReader(b))
+	if !assert.Nil(t, err) || !assert.Len(t, packets, 2) {
+		return
+	}
+	assert.True(t, packets[0].Time.Equal(send))
+	assert.Equal(t, "[2001:db8::1]:40000", packets[0].Src.String())
+	assert.Equal(t, kissCodeID("GPS"), packets[1].ReferenceID)
+	assert.Equal(t, uint8(1), packets[1].Stratum)
+
+	exchanges := MatchPackets(packets)
+	if assert.Len(t, exchanges, 1) {
+		r, err := exchanges[0].Decode()
+		if assert.Nil(t, err) {
+			assert.InDelta(t, float64(-time.Second), float64(r.ClockOffset), float64(time.Microsecond))
+			assert.InDelta(t, float64(10*time.Millisecond), float64(r.RTT), float64(time.Microsecond))
+		}
+	}
+
+	// Unanswered queries are matched with no response.
+	exchanges = MatchPackets(packets[:1])
+	if assert.Len(t, exchanges, 1) {
+		assert.Nil(t, exchanges[0].Response)
+	}
+
+	// Malformed captures are rejected.
+	_, err = ReadPcap(bytes.NewReader([]byte("not a capture file")))
+	assert.ErrorIs(t, err, ErrInvalidCapture)
+	_, err = ReadPcap(bytes.NewReader(b[:len(b)-10]))
+	assert.ErrorIs(t, err, ErrInvalidCapture)
+}
@@ -0,0 +1,288 @@
+// Copyright © 2015-2023 Brett Vickers.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ntp
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Additional checks performed by Response.ValidateWithPolicy.
+const (
+	// CheckReferenceTime verifies that the server's reference time is not
+	// zero.
+	CheckReferenceTime ValidationCheck = "reference time"
+
+	// CheckVersion verifies that the server's protocol version is at least
+	// the policy's minimum version.
+	CheckVersion ValidationCheck = "version"
+
+	// CheckRootDistance verifies that the root distance does not exceed the
+	// policy's limit.
+	CheckRootDistance ValidationCheck = "root distance"
+
+	// CheckRTT verifies that the round-trip time does not exceed the
+	// policy's limit.
+	CheckRTT ValidationCheck = "rtt"
+
+	// CheckClockOffset verifies that the absolute clock offset does not
+	// exceed the policy's limit.
+	CheckClockOffset ValidationCheck = "clock offset"
+
+	// CheckAuth verifies that the response was authenticated using
+	// symmetric key authentication.
+	CheckAuth ValidationCheck = "auth"
+)
+
+// A ValidationPolicy configures the checks performed by
+// Response.ValidateWithPolicy. The zero value applies the same checks as
+// Response.Validate. Limits left at zero use the default value used by
+// Validate, or disable the check if Validate does not perform it.
+type ValidationPolicy struct {
+	// MaxStratum is the maximum acceptable server stratum. Defaults to 15,
+	// which is also the largest permitted value.
+	MaxStratum uint8
+
+	// MaxFreshness is the maximum acceptable time elapsed between the
+	// server's reference time and its transmit time. Defaults to the
+	// maximum NTP polling interval (~36 hours).
+	MaxFreshness time.Duration
+
+	// MaxDispersion is the maximum acceptable root synchronization distance
+	// reported by the server (RootDelay/2 + RootDispersion). Defaults to 16
+	// seconds.
+	MaxDispersion time.Duration
+
+	// MaxRootDistance is the maximum acceptable Response.RootDistance. If
+	// zero, the root distance is not checked.
+	MaxRootDistance time.Duration
+
+	// MaxRTT is the maximum acceptable Response.RTT. If zero, the RTT is
+	// not checked.
+	MaxRTT time.Duration
+
+	// MaxClockOffset is the maximum acceptable absolute value of
+	// Response.ClockOffset. If zero, the clock offset is not checked.
+	MaxClockOffset time.Duration
+
+	// MinVersion is the minimum acceptable NTP protocol version reported by
+	// the server. If zero, the version is not checked.
+	MinVersion int
+
+	// RequireAuth causes responses that were not verified using symmetric
+	// key authentication to fail validation.
+	RequireAuth bool
+
+	// RejectZeroReferenceTime causes responses whose reference time is zero
+	// to fail validation. Servers that have never synchronized typically
+	// report a zero reference time.
+	RejectZeroReferenceTime bool
+
+	// Custom contains additional checks to perform. Each function returns a
+	// non-nil error if the response fails its check. Returning a
+	// *ValidationError allows a custom check to report its name and the
+	// offending value.
+	Custom []func(r *Response) error
+}
+
+// A ValidationReport lists the checks failed by a response when validated
+// with Response.ValidateWithPolicy.
+type ValidationReport struct {
+	// Failures contains one error for each failed check, in the order the
+	// checks were performed. Each error is either an authentication error,
+	// a *KissOfDeathError, a *ValidationError or an error returned by one
+	// of the policy's custom checks.
+	Failures []error
+}
+
+// Valid returns true if the response passed every check.
+func (v *ValidationReport) Valid() bool {
+	return len(v.Failures) == 0
+}
+
+// Err returns nil if the response passed every check. Otherwise it returns
+// the report itself as an error.
+func (v *ValidationReport) Err() error {
+	if v.Valid() {
+		return nil
+	}
+	return v
+}
+
+func (v *ValidationReport) Error() string {
+	switch len(v.Failures) {
+	case 0:
+		return "response is valid"
+	case 1:
+		return v.Failures[0].Error()
+	}
+
+	msgs := make([]string, len(v.Failures))
+	for i, err := range v.Failures {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("%d validation checks failed: %s", len(v.Failures), strings.Join(msgs, "; "))
+}
+
+// Is returns true if any of the report's failures matches the target error.
+func (v *ValidationReport) Is(target error) bool {
+	for _, err := range v.Failures {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// As finds the first of the report's failures that matches target and, if
+// one is found, sets target to that error value and returns true.
+func (v *ValidationReport) As(target interface{}) bool {
+	for _, err := range v.Failures {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateWithPolicy checks the response against every check configured
+// by the policy and returns a report listing all failed checks. A nil
+// policy performs the same checks as Validate.
+func (r *Response) ValidateWithPolicy(p *ValidationPolicy) *ValidationReport {
+	return &ValidationReport{Failures: r.validate(p, true)}
+}
+
+// validate performs the checks configured by the policy p, which may be
+// nil. If all is false, validation stops at the first failed check.
+func (r *Response) validate(p *ValidationPolicy, all bool) []error {
+	if p == nil {
+		p = &ValidationPolicy{}
+	}
+
+	var errs []error
+	fail := func(err error) bool {
+		errs = append(errs, err)
+		return !all
+	}
+
+	// Forward authentication errors.
+	if r.authErr != nil && fail(r.authErr) {
+		return errs
+	}
+
+	// Handle invalid stratum values.
+	limit := p.maxStratum()
+	switch {
+	case r.Stratum == 0:
+		if fail(&KissOfDeathError{Code: r.KissCode}) {
+			return errs
+		}
+	case r.Stratum > limit:
+		if fail(&ValidationError{CheckStratum, r.Stratum, limit, ErrInvalidStratum}) {
+			return errs
+		}
+	}
+
+	// Estimate the "freshness" of the time. If it exceeds the maximum
+	// polling interval (~36 hours), then it cannot be considered "fresh".
+	freshness := r.Time.Sub(r.ReferenceTime)
+	maxFreshness := durationOrDefault(p.MaxFreshness, maxPollInterval)
+	if freshness > maxFreshness {
+		if fail(&ValidationError{CheckFreshness, freshness, maxFreshness, ErrServerClockFreshness}) {
+			return errs
+		}
+	}
+
+	// Calculate the peer synchronization distance, lambda:
+	//  	lambda := RootDelay/2 + RootDispersion
+	// If this value exceeds MAXDISP (16s), then the time is not suitable
+	// for synchronization purposes.
+	// https://tools.ietf.org/html/rfc5905#appendix-A.5.1.1.
+	lambda := r.RootDelay/2 + r.RootDispersion
+	maxLambda := durationOrDefault(p.MaxDispersion, maxDispersion)
+	if lambda > maxLambda {
+		if fail(&ValidationError{CheckDispersion, lambda, maxLambda, ErrInvalidDispersion}) {
+			return errs
+		}
+	}
+
+	// If the server's transmit time is before its reference time, the
+	// response is invalid.
+	if r.Time.Before(r.ReferenceTime) {
+		if fail(&ValidationError{CheckTime, r.Time, r.ReferenceTime, ErrInvalidTime}) {
+			return errs
+		}
+	}
+
+	// Handle invalid leap second indicator.
+	if r.Leap == LeapNotInSync {
+		if fail(&ValidationError{CheckLeap, r.Leap, nil, ErrInvalidLeapSecond}) {
+			return errs
+		}
+	}
+
+	// The remaining checks are performed only when requested by the policy.
+	if p.RejectZeroReferenceTime && (r.zeroRefTime || r.ReferenceTime.IsZero()) {
+		if fail(&ValidationError{CheckReferenceTime, r.ReferenceTime, nil, ErrInvalidReferenceTime}) {
+			return errs
+		}
+	}
+	if p.MinVersion != 0 && r.Version < p.MinVersion {
+		if fail(&ValidationError{CheckVersion, r.Version, p.MinVersion, ErrInvalidResponseVersion}) {
+			return errs
+		}
+	}
+	if p.MaxRootDistance != 0 && r.RootDistance > p.MaxRootDistance {
+		if fail(&ValidationError{CheckRootDistance, r.RootDistance, p.MaxRootDistance, ErrExcessiveRootDistance}) {
+			return errs
+		}
+	}
+	if p.MaxRTT != 0 && r.RTT > p.MaxRTT {
+		if fail(&ValidationError{CheckRTT, r.RTT, p.MaxRTT, ErrExcessiveRTT}) {
+			return errs
+		}
+	}
+	if p.MaxClockOffset != 0 && abs(r.ClockOffset) > p.MaxClockOffset {
+		if fail(&ValidationError{CheckClockOffset, r.ClockOffset, p.MaxClockOffset, ErrExcessiveClockOffset}) {
+			return errs
+		}
+	}
+	if p.RequireAuth && !r.authenticated {
+		if fail(&ValidationError{CheckAuth, false, nil, ErrUnauthenticated}) {
+			return errs
+		}
+	}
+
+	for _, check := range p.Custom {
+		if err := check(r); err != nil && fail(err) {
+			return errs
+		}
+	}
+
+	return errs
+}
+
+func (p *ValidationPolicy) maxStratum() uint8 {
+	if p.MaxStratum == 0 || p.MaxStratum >= maxStratum {
+		return maxStratum - 1
+	}
+	return p.MaxStratum
+}
+
+func durationOrDefault(d, def time.Duration) time.Duration {
+	if d == 0 {
+		return def
+	}
+	return d
+}
+
+func abs(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
@@ -0,0 +1,104 @@
+// Copyright © 2015-2023 Brett Vickers.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ntp
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOfflineValidateWithPolicy(t *testing.T) {
+	h := &header{
+		Stratum:       3,
+		ReferenceID:   refID,
+		ReferenceTime: 10 << 32,
+		OriginTime:    10 << 32,
+		ReceiveTime:   12 << 32,
+		TransmitTime:  12 << 32,
+	}
+	h.setVersion(3)
+	r := generateResponse(h, 12<<32, nil)
+
+	// The default policy matches Validate.
+	assert.Nil(t, r.Validate())
+	report := r.ValidateWithPolicy(nil)
+	assert.True(t, report.Valid())
+	assert.Nil(t, report.Err())
+
+	errCustom := errors.New("custom check failed")
+	policy := &ValidationPolicy{
+		MaxStratum:     2,
+		MaxRTT:         time.Second,
+		MaxClockOffset: 100 * time.Millisecond,
+		MinVersion:     4,
+		RequireAuth:    true,
+		Custom: []func(r *Response) error{
+			func(r *Response) error { return nil },
+			func(r *Response) error { return errCustom },
+		},
+	}
+	report = r.ValidateWithPolicy(policy)
+	assert.False(t, report.Valid())
+
+	var checks []ValidationCheck
+	for _, err := range report.Failures {
+		var verr *ValidationError
+		if errors.As(err, &verr) {
+			checks = append(checks, verr.Check)
+		}
+	}
+	assert.Equal(t, []ValidationCheck{CheckStratum, CheckVersion, CheckRTT, CheckClockOffset, CheckAuth}, checks)
+	assert.Len(t, report.Failures, 6)
+
+	err := report.Err()
+	assert.ErrorIs(t, err, ErrInvalidStratum)
+	assert.ErrorIs(t, err, ErrExcessiveRTT)
+	assert.ErrorIs(t, err, ErrExcessiveClockOffset)
+	assert.ErrorIs(t, err, ErrUnauthenticated)
+	assert.ErrorIs(t, err, errCustom)
+	assert.NotErrorIs(t, err, ErrExcessiveRootDistance)
+
+	var verr *ValidationError
+	if assert.True(t, errors.As(err, &verr)) {
+		assert.Equal(t, CheckStratum, verr.Check)
+		assert.Equal(t, uint8(3), verr.Value)
+		assert.Equal(t, uint8(2), verr.Limit)
+	}
+
+	// Passing policy.
+	r.authenticated = true
+	policy = &ValidationPolicy{
+		MaxStratum:      3,
+		MaxRootDistance: 2 * time.Second,
+		MaxRTT:          2 * time.Second,
+		MaxClockOffset:  time.Second,
+		MinVersion:      3,
+		RequireAuth:     true,
+	}
+	assert.True(t, r.ValidateWithPolicy(policy).Valid())
+}
+
+func TestOfflineValidateWithPolicyReferenceTime(t *testing.T) {
+	h := &header{
+		Stratum:      2,
+		ReferenceID:  refID,
+		OriginTime:   10 << 32,
+		ReceiveTime:  10 << 32,
+		TransmitTime: 10 << 32,
+	}
+	r := generateResponse(h, 10<<32, nil)
+
+	policy := &ValidationPolicy{RejectZeroReferenceTime: true}
+	report := r.ValidateWithPolicy(policy)
+	assert.ErrorIs(t, report.Err(), ErrInvalidReferenceTime)
+
+	// Only a zero field is rejected, not the start of an era.
+	h.ReferenceTime = 1
+	r = generateResponse(h, 10<<32, nil)
+	assert.Nil(t, r.ValidateWithPolicy(policy).Err())
+}
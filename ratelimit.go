@@ -0,0 +1,175 @@
+// Copyright © 2015-2023 Brett Vickers.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ntp
+
+import (
+	"container/list"
+	"net"
+	"sync"
+	"time"
+)
+
+// Rate limiter defaults, matching ntpd's "discard average 3" and the burst
+// of 8 packets sent by clients using "iburst".
+const (
+	defaultRateInterval   = 8 * time.Second
+	defaultRateBurst      = 8
+	defaultRateIPv4Prefix = 32
+	defaultRateIPv6Prefix = 64
+	defaultRateMaxClients = 100000
+)
+
+// A RateLimiter limits the rate at which a Server answers queries from each
+// client, like ntpd's "limited" and "kod" restrictions. Each client network
+// is given a token bucket holding up to Burst tokens and refilled at one
+// token per Interval. Queries arriving when the bucket is empty are dropped
+// or, if KissOfDeath is set, answered with a RATE kiss-of-death packet. It
+// is safe for concurrent use.
+type RateLimiter struct {
+	// Interval is the average interval between queries permitted for each
+	// client. Defaults to 8 seconds.
+	Interval time.Duration
+
+	// Burst is the number of queries a client may send in quick succession
+	// after a quiet period. Defaults to 8.
+	Burst int
+
+	// IPv4Prefix and IPv6Prefix determine the size of the networks treated
+	// as a single client. They default to 32 (a single IPv4 address) and 64
+	// (a single IPv6 subnet).
+	IPv4Prefix int
+	IPv6Prefix int
+
+	// KissOfDeath causes excess queries to be answered with a RATE
+	// kiss-of-death packet instead of being dropped. To prevent the server
+	// from being used to flood a spoofed address, at most one
+	// kiss-of-death packet is sent to each client per Interval. A Server
+	// also sends them to networks restricted with RestrictKoD.
+	KissOfDeath bool
+
+	// MaxClients limits the number of clients tracked, bounding memory use.
+	// When the limit is reached, the least recently seen client is
+	// forgotten. Defaults to 100000.
+	MaxClients int
+
+	mu      sync.Mutex
+	buckets map[string]*list.Element // of *bucket
+	order   list.List                // most recently seen first
+}
+
+// A bucket is the token bucket of a single client network.
+type bucket struct {
+	key     string
+	tokens  float64
+	last    time.Time
+	lastKoD time.Time
+}
+
+// rateVerdict is the outcome of checking a query against a rate limiter.
+type rateVerdict int
+
+const (
+	rateAllow rateVerdict = iota
+	rateDrop
+	rateKoD
+)
+
+// Allow reports whether a query received from addr at time now is within
+// the client's rate limit, consuming a token if so.
+func (l *RateLimiter) Allow(addr net.Addr, now time.Time) bool {
+	return l.check(addrIP(addr), now, l.KissOfDeath) == rateAllow
+}
+
+// check applies the rate limit to a query received from ip at time now. If
+// kod is true, excess queries may be answered with a kiss-of-death packet.
+func (l *RateLimiter) check(ip net.IP, now time.Time, kod bool) rateVerdict {
+	if ip == nil {
+		return rateAllow
+	}
+	interval := durationOrDefault(l.Interval, defaultRateInterval)
+	burst := float64(intOrDefault(l.Burst, defaultRateBurst))
+	key := l.prefix(ip)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var b *bucket
+	if e, ok := l.buckets[key]; ok {
+		b = e.Value.(*bucket)
+		l.order.MoveToFront(e)
+	} else {
+		l.evict()
+		b = &bucket{key: key, tokens: burst, last: now}
+		if l.buckets == nil {
+			l.buckets = make(map[string]*list.Element)
+		}
+		l.buckets[key] = l.order.PushFront(b)
+	}
+
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += float64(elapsed) / float64(interval)
+		if b.tokens > burst {
+			b.tokens = burst
+		}
+		b.last = now
+	}
+
+	switch {
+	case b.tokens >= 1:
+		b.tokens--
+		return rateAllow
+	case kod && (b.lastKoD.IsZero() || now.Sub(b.lastKoD) >= interval):
+		b.lastKoD = now
+		return rateKoD
+	default:
+		return rateDrop
+	}
+}
+
+// prefix returns the key identifying the client network containing ip.
+func (l *RateLimiter) prefix(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		bits := intOrDefault(l.IPv4Prefix, defaultRateIPv4Prefix)
+		return string(ip4.Mask(net.CIDRMask(bits, 32)))
+	}
+	bits := intOrDefault(l.IPv6Prefix, defaultRateIPv6Prefix)
+	return string(ip.Mask(net.CIDRMask(bits, 128)))
+}
+
+// evict makes room for a new client when the limit on tracked clients has
+// been reached, by forgetting the least recently seen client.
+func (l *RateLimiter) evict() {
+	for l.order.Len() > 0 && l.order.Len() >= intOrDefault(l.MaxClients, defaultRateMaxClients) {
+		e := l.order.Back()
+		l.order.Remove(e)
+		delete(l.buckets, e.Value.(*bucket).key)
+	}
+}
+
+// addrIP returns the IP address of a network address, or nil if it has
+// none.
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case nil:
+		return nil
+	case *net.UDPAddr:
+		if a == nil {
+			return nil
+		}
+		return a.IP
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+	return net.ParseIP(host)
+}
+
+func intOrDefault(v, def int) int {
+	if v == 0 {
+		return def
+	}
+	return v
+}
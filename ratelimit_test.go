@@ -0,0 +1,109 @@
+// Copyright © 2015-2023 Brett Vickers.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ntp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOfflineRateLimiter(t *testing.T) {
+	l := &RateLimiter{Interval: time.Second, Burst: 3, IPv4Prefix: 24}
+	now := time.Unix(1700000000, 0)
+	a := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 123}
+	b := &net.UDPAddr{IP: net.ParseIP("192.0.2.200"), Port: 123}
+	c := &net.UDPAddr{IP: net.ParseIP("198.51.100.1"), Port: 123}
+
+	// Clients in the same /24 share a bucket.
+	assert.True(t, l.Allow(a, now))
+	assert.True(t, l.Allow(b, now))
+	assert.True(t, l.Allow(a, now))
+	assert.False(t, l.Allow(b, now))
+	assert.True(t, l.Allow(c, now))
+
+	// Tokens are refilled at one per interval.
+	now = now.Add(1500 * time.Millisecond)
+	assert.True(t, l.Allow(a, now))
+	assert.False(t, l.Allow(a, now))
+	now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		assert.True(t, l.Allow(b, now))
+	}
+	assert.False(t, l.Allow(b, now))
+
+	// IPv6 clients are grouped by /64 by default.
+	x := &net.UDPAddr{IP: net.ParseIP("2001:db8::1")}
+	y := &net.UDPAddr{IP: net.ParseIP("2001:db8::2")}
+	for i := 0; i < 3; i++ {
+		assert.True(t, l.Allow(x, now))
+	}
+	assert.False(t, l.Allow(y, now))
+}
+
+func TestOfflineRateLimiterKissOfDeath(t *testing.T) {
+	l := &RateLimiter{Interval: time.Second, Burst: 1, KissOfDeath: true}
+	ip := net.ParseIP("192.0.2.1")
+	now := time.Unix(1700000000, 0)
+
+	assert.Equal(t, rateAllow, l.check(ip, now, true))
+	assert.Equal(t, rateKoD, l.check(ip, now, true))
+	assert.Equal(t, rateDrop, l.check(ip, now.Add(100*time.Millisecond), true))
+	assert.Equal(t, rateAllow, l.check(ip, now.Add(1100*time.Millisecond), true))
+	assert.Equal(t, rateKoD, l.check(ip, now.Add(1200*time.Millisecond), true))
+}
+
+func TestOfflineRateLimiterMaxClients(t *testing.T) {
+	l := &RateLimiter{Interval: time.Second, Burst: 1, MaxClients: 2}
+	now := time.Unix(1700000000, 0)
+	ips := []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2"), net.ParseIP("192.0.2.3")}
+
+	assert.Equal(t, rateAllow, l.check(ips[0], now, false))
+	assert.Equal(t, rateAllow, l.check(ips[1], now.Add(time.Millisecond), false))
+	assert.Equal(t, rateAllow, l.check(ips[2], now.Add(2*time.Millisecond), false))
+	assert.Len(t, l.buckets, 2)
+
+	// The least recently seen client was forgotten.
+	assert.Equal(t, rateAllow, l.check(ips[0], now.Add(3*time.Millisecond), false))
+	assert.Equal(t, rateDrop, l.check(ips[2], now.Add(4*time.Millisecond), false))
+
+	// Seeing a client again makes it the most recently seen.
+	assert.Equal(t, rateAllow, l.check(ips[1], now.Add(5*time.Millisecond), false))
+	assert.Equal(t, rateDrop, l.check(ips[2], now.Add(6*time.Millisecond), false))
+	assert.Equal(t, 2, l.order.Len())
+}
+
+func TestOfflineServerRateLimit(t *testing.T) {
+	s := NewServer(ServerState{Stratum: 1})
+	s.RateLimit = &RateLimiter{Interval: time.Minute, Burst: 1, KissOfDeath: true}
+	addr := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 123}
+	now := time.Now()
+
+	query := make([]byte, 48)
+	query[0] = 4<<3 | byte(client)
+	binary.BigEndian.PutUint64(query[40:], 0x0123456789abcdef)
+
+	resp := s.Respond(query, addr, now)
+	if assert.Len(t, resp, 48) {
+		assert.Equal(t, uint8(1), resp[1])
+	}
+
+	resp = s.Respond(query, addr, now)
+	if assert.Len(t, resp, 48) {
+		h := new(header)
+		binary.Read(bytes.NewReader(resp), binary.BigEndian, h)
+		r := generateResponse(h, toNtpTime(now), nil)
+		assert.True(t, r.IsKissOfDeath())
+		assert.Equal(t, "RATE", r.KissCode)
+		assert.Equal(t, ntpTime(0x0123456789abcdef), h.OriginTime)
+		assert.Equal(t, &KissOfDeathError{Code: "RATE"}, r.Validate())
+	}
+
+	assert.Nil(t, s.Respond(query, addr, now))
+}
@@ -0,0 +1,470 @@
+// Copyright © 2015-2023 Brett Vickers.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ntp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// recordingMagic begins every exchange recording, followed by the format
+// version.
+const (
+	recordingMagic   = "NTPX"
+	recordingVersion = 1
+)
+
+// errReplayExhausted is returned when a Replayer has no exchanges left.
+var errReplayExhausted = errors.New("no recorded exchanges remain")
+
+// An Exchange is a recorded NTP query and the server's response.
+type Exchange struct {
+	// Server is the address of the queried server, and Local the address
+	// from which it was queried, if known.
+	Server string
+	Local  string
+
+	// Request and Response hold the query and response packets, including
+	// any extension fields and MACs. Response is nil if no response was
+	// received.
+	Request  []byte
+	Response []byte
+
+	// SendTime and RecvTime are the local times at which the query was sent
+	// and the response received.
+	SendTime time.Time
+	RecvTime time.Time
+}
+
+// Decode returns the response QueryWithOptions generates from the
+// exchange. The response is not authenticated. An exchange without a
+// response is reported as a timeout.
+func (e *Exchange) Decode() (*Response, error) {
+	fail := func(op string, err error) (*Response, error) {
+		return nil, &QueryError{Server: e.Server, Op: op, Err: err}
+	}
+	switch {
+	case len(e.Request) < 48:
+		return fail(opEncode, ErrInvalidRecording)
+	case e.Response == nil:
+		return fail(opRead, os.ErrDeadlineExceeded)
+	case len(e.Response) < 48:
+		return fail(opDecode, io.ErrUnexpectedEOF)
+	}
+
+	var req, h header
+	req.unmarshal(e.Request)
+	h.unmarshal(e.Response)
+	if err := checkResponse(&h, req.TransmitTime); err != nil {
+		return fail(opVerify, err)
+	}
+	h.OriginTime = toNtpTime(e.SendTime)
+	return generateResponse(&h, toNtpTime(e.RecvTime), nil), nil
+}
+
+// WriteExchanges writes the exchanges to w in a compact binary format, which
+// may be read using ReadExchanges.
+func WriteExchanges(w io.Writer, exchanges []Exchange) error {
+	b := appendRecordingHeader(nil)
+	for i := range exchanges {
+		b = appendExchange(b, &exchanges[i])
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+// ReadExchanges reads exchanges written by WriteExchanges or a Recorder.
+func ReadExchanges(r io.Reader) ([]Exchange, error) {
+	br := bufio.NewReader(r)
+	var hdr [len(recordingMagic) + 1]byte
+	if _, err := io.ReadFull(br, hdr[:]); err != nil {
+		return nil, ErrInvalidRecording
+	}
+	if string(hdr[:4]) != recordingMagic || hdr[4] != recordingVersion {
+		return nil, ErrInvalidRecording
+	}
+
+	var exchanges []Exchange
+	for {
+		if _, err := br.Peek(1); err == io.EOF {
+			return exchanges, nil
+		}
+		e, err := readExchange(br)
+		if err != nil {
+			return nil, err
+		}
+		exchanges = append(exchanges, e)
+	}
+}
+
+func appendRecordingHeader(b []byte) []byte {
+	return append(append(b, recordingMagic...), recordingVersion)
+}
+
+// appendExchange appends the encoding of an exchange to b: the server and
+// local addresses, the send and receive times in Unix nanoseconds (zero if
+// unset), and the request and response packets, each preceded by its
+// length.
+func appendExchange(b []byte, e *Exchange) []byte {
+	var w [8]byte
+	appendBytes := func(p []byte) {
+		binary.BigEndian.PutUint16(w[:2], uint16(len(p)))
+		b = append(append(b, w[:2]...), p...)
+	}
+	appendTime := func(t time.Time) {
+		var ns int64
+		if !t.IsZero() {
+			ns = t.UnixNano()
+		}
+		binary.BigEndian.PutUint64(w[:], uint64(ns))
+		b = append(b, w[:]...)
+	}
+
+	appendBytes([]byte(e.Server))
+	appendBytes([]byte(e.Local))
+	appendTime(e.SendTime)
+	appendTime(e.RecvTime)
+	appendBytes(e.Request)
+	appendBytes(e.Response)
+	return b
+}
+
+func readExchange(r io.Reader) (Exchange, error) {
+	var w [8]byte
+	var err error
+	readBytes := func() []byte {
+		if err != nil {
+			return nil
+		}
+		if _, err = io.ReadFull(r, w[:2]); err != nil {
+			return nil
+		}
+		n := binary.BigEndian.Uint16(w[:2])
+		if n == 0 {
+			return nil
+		}
+		p := make([]byte, n)
+		_, err = io.ReadFull(r, p)
+		return p
+	}
+	readTime := func() time.Time {
+		if err != nil {
+			return time.Time{}
+		}
+		if _, err = io.ReadFull(r, w[:]); err != nil {
+			return time.Time{}
+		}
+		ns := int64(binary.BigEndian.Uint64(w[:]))
+		if ns == 0 {
+			return time.Time{}
+		}
+		return time.Unix(0, ns)
+	}
+
+	var e Exchange
+	e.Server = string(readBytes())
+	e.Local = string(readBytes())
+	e.SendTime = readTime()
+	e.RecvTime = readTime()
+	e.Request = readBytes()
+	e.Response = readBytes()
+	if err != nil {
+		return Exchange{}, ErrInvalidRecording
+	}
+	return e, nil
+}
+
+// A Recorder records the exchanges made by queries using the options it
+// returns. Each exchange is written to the recorder's writer as it
+// completes, and may later be replayed using a Replayer. A Recorder is safe
+// for concurrent use.
+type Recorder struct {
+	mu        sync.Mutex
+	write     func(e *Exchange) error
+	exchanges []Exchange
+	err       error
+}
+
+// NewRecorder returns a recorder writing exchanges to w in the format read
+// by ReadExchanges. If w is nil, exchanges are only kept in memory.
+func NewRecorder(w io.Writer) *Recorder {
+	rec := &Recorder{}
+	if w != nil {
+		started := false
+		rec.write = func(e *Exchange) error {
+			var b []byte
+			if !started {
+				b = appendRecordingHeader(b)
+				started = true
+			}
+			_, err := w.Write(appendExchange(b, e))
+			return err
+		}
+	}
+	return rec
+}
+
+// Options returns a copy of opt whose Dialer records the exchanges made
+// using the dialer that opt would otherwise use. Exchange times are read
+// from opt.Clock, or the system clock, as each packet is sent and received.
+func (rec *Recorder) Options(opt QueryOptions) QueryOptions {
+	dial, owned := opt.Dialer, false
+	switch {
+	case opt.Dial != nil:
+		dialFn := opt.Dial
+		dial = func(la, ra string) (net.Conn, error) {
+			return dialWrapper(la, ra, dialFn)
+		}
+		opt.Dial = nil
+	case dial == nil:
+		dial, owned = defaultDialer, true
+	}
+
+	clock := opt.Clock
+	opt.Dialer = func(la, ra string) (net.Conn, error) {
+		con, err := dial(la, ra)
+		if err != nil {
+			return nil, err
+		}
+		e := Exchange{Server: ra}
+		if addr := con.RemoteAddr(); addr != nil {
+			e.Server = addr.String()
+		}
+		if addr := con.LocalAddr(); addr != nil {
+			e.Local = addr.String()
+		}
+		return &recordConn{
+			Conn:  con,
+			rec:   rec,
+			clock: clock,
+			owned: owned,
+			ex:    e,
+		}, nil
+	}
+	return opt
+}
+
+// Exchanges returns the exchanges recorded so far.
+func (rec *Recorder) Exchanges() []Exchange {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return append([]Exchange(nil), rec.exchanges...)
+}
+
+// Err returns the first error encountered writing exchanges.
+func (rec *Recorder) Err() error {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return rec.err
+}
+
+func (rec *Recorder) add(e Exchange) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.exchanges = append(rec.exchanges, e)
+	if rec.write != nil && rec.err == nil {
+		rec.err = rec.write(&e)
+	}
+}
+
+// A recordConn records the first query written to and response read from
+// a connection.
+type recordConn struct {
+	net.Conn
+	rec   *Recorder
+	clock Clock
+	owned bool
+	ex    Exchange
+	done  bool
+}
+
+func (c *recordConn) now() time.Time {
+	if c.clock != nil {
+		return c.clock.Now()
+	}
+	return time.Now()
+}
+
+func (c *recordConn) Write(b []byte) (int, error) {
+	if c.ex.Request == nil {
+		c.ex.Request = append([]byte(nil), b...)
+		c.ex.SendTime = c.now()
+	}
+	n, err := c.Conn.Write(b)
+	if err != nil {
+		c.finish()
+	}
+	return n, err
+}
+
+func (c *recordConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if !c.done && err == nil {
+		c.ex.RecvTime = c.now()
+		c.ex.Response = append([]byte(nil), b[:n]...)
+	}
+	c.finish()
+	return n, err
+}
+
+func (c *recordConn) unwrap() (net.Conn, bool) {
+	return c.Conn, c.owned
+}
+
+func (c *recordConn) Close() error {
+	c.finish()
+	return c.Conn.Close()
+}
+
+func (c *recordConn) finish() {
+	if c.done {
+		return
+	}
+	c.done = true
+	if c.ex.Request != nil {
+		c.rec.add(c.ex)
+	}
+}
+
+// A Replayer replays recorded exchanges through QueryWithOptions in place
+// of querying servers, so that recorded queries can be reproduced exactly.
+// Each query made using the replayer's options consumes the next exchange,
+// whose response and local times are reported to the query. The query's
+// transmit timestamp is replaced by the recorded one, so that the recorded
+// response passes the origin check and any MAC over it remains valid.
+// Queries made with a Replayer's options must not run concurrently.
+type Replayer struct {
+	mu        sync.Mutex
+	exchanges []Exchange
+	next      int
+	cur       *Exchange
+	read      bool
+}
+
+// NewReplayer returns a replayer of the exchanges.
+func NewReplayer(exchanges []Exchange) *Replayer {
+	return &Replayer{exchanges: exchanges}
+}
+
+// Remaining returns the number of exchanges not yet replayed.
+func (p *Replayer) Remaining() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.exchanges) - p.next
+}
+
+// Options returns a copy of opt that replays the next recorded exchange in
+// place of contacting a server.
+func (p *Replayer) Options(opt QueryOptions) QueryOptions {
+	opt.Dial = nil
+	opt.Dialer = p.dial
+	opt.Clock = replayClock{p}
+	opt.TTL = 0
+	opt.Extensions = append([]Extension{replayExtension{p}}, opt.Extensions...)
+	return opt
+}
+
+// Query replays the next recorded exchange, returning the result of
+// querying the recorded server using opt.
+func (p *Replayer) Query(opt QueryOptions) (*Response, error) {
+	p.mu.Lock()
+	if p.next >= len(p.exchanges) {
+		p.mu.Unlock()
+		return nil, errReplayExhausted
+	}
+	server := p.exchanges[p.next].Server
+	p.mu.Unlock()
+	return QueryWithOptions(server, p.Options(opt))
+}
+
+func (p *Replayer) dial(la, ra string) (net.Conn, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.next >= len(p.exchanges) {
+		return nil, errReplayExhausted
+	}
+	p.cur, p.read = &p.exchanges[p.next], false
+	p.next++
+	return &replayConn{p: p, ex: p.cur}, nil
+}
+
+// A replayClock reports the recorded send time of the current exchange until
+// its response has been read, and the recorded receive time afterward.
+type replayClock struct {
+	p *Replayer
+}
+
+func (c replayClock) Now() time.Time {
+	c.p.mu.Lock()
+	defer c.p.mu.Unlock()
+	switch {
+	case c.p.cur == nil:
+		return time.Now()
+	case c.p.read:
+		return c.p.cur.RecvTime
+	default:
+		return c.p.cur.SendTime
+	}
+}
+
+// A replayExtension replaces a query's transmit timestamp with that of the
+// recorded query.
+type replayExtension struct {
+	p *Replayer
+}
+
+func (e replayExtension) ProcessQuery(buf *bytes.Buffer) error {
+	e.p.mu.Lock()
+	defer e.p.mu.Unlock()
+	if e.p.cur != nil && len(e.p.cur.Request) >= 48 && buf.Len() >= 48 {
+		copy(buf.Bytes()[40:48], e.p.cur.Request[40:48])
+	}
+	return nil
+}
+
+func (e replayExtension) ProcessResponse(buf []byte) error {
+	return nil
+}
+
+// A replayConn delivers a recorded response. An exchange without a response
+// is replayed as a timeout.
+type replayConn struct {
+	p  *Replayer
+	ex *Exchange
+}
+
+func (c *replayConn) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (c *replayConn) Read(b []byte) (int, error) {
+	c.p.mu.Lock()
+	c.p.read = true
+	c.p.mu.Unlock()
+	if c.ex.Response == nil {
+		return 0, os.ErrDeadlineExceeded
+	}
+	return copy(b, c.ex.Response), nil
+}
+
+func (c *replayConn) Close() error                     { return nil }
+func (c *replayConn) LocalAddr() net.Addr              { return replayAddr(c.ex.Local) }
+func (c *replayConn) RemoteAddr() net.Addr             { return replayAddr(c.ex.Server) }
+func (c *replayConn) SetDeadline(time.Time) error      { return nil }
+func (c *replayConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *replayConn) SetWriteDeadline(time.Time) error { return nil }
+
+// A replayAddr is the recorded address of a server.
+type replayAddr string
+
+func (a replayAddr) Network() string { return "udp" }
+func (a replayAddr) String() string  { return string(a) }
@@ -0,0 +1,194 @@
+// Copyright © 2015-2023 Brett Vickers.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ntp
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOfflineRecordReplay(t *testing.T) {
+	s := NewServer(ServerState{Stratum: 2, Precision: -20})
+	s.Clock = &offsetClock{time.Hour}
+	s.KeyRing = NewKeyRing(Key{ID: 1, Type: AuthSHA1, Secret: []byte("0123456789abcdef")})
+	s.KeyRing.SetTrusted(1)
+	addr := startTestServer(t, s)
+
+	var buf bytes.Buffer
+	rec := NewRecorder(&buf)
+	auth := AuthOptions{KeyRing: s.KeyRing, KeyID: 1}
+	opt := QueryOptions{Timeout: time.Second, Auth: auth}
+
+	r1, err := QueryWithOptions(addr, rec.Options(opt))
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Nil(t, r1.AuthErr())
+	r2, err := QueryWithOptions(addr, rec.Options(QueryOptions{Timeout: time.Second}))
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Nil(t, rec.Err())
+
+	exchanges := rec.Exchanges()
+	if !assert.Len(t, exchanges, 2) {
+		return
+	}
+	e := exchanges[0]
+	assert.Equal(t, addr, e.Server)
+	assert.Len(t, e.Request, 48+4+20)
+	assert.Len(t, e.Response, 48+4+20)
+	assert.True(t, e.RecvTime.After(e.SendTime))
+
+	// The exchanges survive a round trip through the recording format.
+	read, err := ReadExchanges(bytes.NewReader(buf.Bytes()))
+	if !assert.Nil(t, err) || !assert.Len(t, read, 2) {
+		return
+	}
+	for i := range read {
+		assert.Equal(t, exchanges[i].Server, read[i].Server)
+		assert.Equal(t, exchanges[i].Request, read[i].Request)
+		assert.Equal(t, exchanges[i].Response, read[i].Response)
+		assert.True(t, exchanges[i].SendTime.Equal(read[i].SendTime))
+		assert.True(t, exchanges[i].RecvTime.Equal(read[i].RecvTime))
+	}
+
+	// Replays are deterministic, and match the original responses to within
+	// the difference between the recorded and measured local times.
+	for i := 0; i < 2; i++ {
+		p := NewReplayer(read)
+		r, err := p.Query(opt)
+		if assert.Nil(t, err) {
+			assert.Nil(t, r.AuthErr())
+			assert.InDelta(t, float64(r1.ClockOffset), float64(r.ClockOffset), float64(time.Millisecond))
+			d, _ := read[0].Decode()
+			assert.Equal(t, d.ClockOffset, r.ClockOffset)
+			assert.Equal(t, d.RTT, r.RTT)
+			assert.Equal(t, d.Time, r.Time)
+		}
+		r, err = QueryWithOptions("ignored", p.Options(QueryOptions{}))
+		if assert.Nil(t, err) {
+			assert.InDelta(t, float64(r2.ClockOffset), float64(r.ClockOffset), float64(time.Millisecond))
+		}
+		assert.Equal(t, 0, p.Remaining())
+		_, err = p.Query(opt)
+		assert.NotNil(t, err)
+	}
+
+	// A replay with the wrong key fails authentication.
+	p := NewReplayer(read)
+	bad := opt
+	bad.Auth = AuthOptions{Type: AuthSHA1, Key: "ASCII:fedcba9876543210", KeyID: 1}
+	r, err := p.Query(bad)
+	if assert.Nil(t, err) {
+		assert.NotNil(t, r.AuthErr())
+	}
+}
+
+func TestOfflineRecordTimeout(t *testing.T) {
+	s := NewServer(ServerState{Stratum: 1})
+	s.Access = NewAccessList(AccessRule{Flags: RestrictIgnore})
+	addr := startTestServer(t, s)
+
+	rec := NewRecorder(nil)
+	_, err := QueryWithOptions(addr, rec.Options(QueryOptions{Timeout: 50 * time.Millisecond}))
+	assert.NotNil(t, err)
+	exchanges := rec.Exchanges()
+	if !assert.Len(t, exchanges, 1) {
+		return
+	}
+	assert.Nil(t, exchanges[0].Response)
+	assert.True(t, exchanges[0].RecvTime.IsZero())
+
+	_, err = exchanges[0].Decode()
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	_, err = NewReplayer(exchanges).Query(QueryOptions{})
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+}
+
+type failingExtension struct{}
+
+func (failingExtension) ProcessQuery(buf *bytes.Buffer) error { return errors.New("query failed") }
+func (failingExtension) ProcessResponse(buf []byte) error     { return nil }
+
+func TestOfflineRecordTTL(t *testing.T) {
+	addr := startTestServer(t, NewServer(ServerState{Stratum: 1}))
+	rec := NewRecorder(nil)
+	_, err := QueryWithOptions(addr, rec.Options(QueryOptions{Timeout: time.Second, TTL: 32}))
+	assert.Nil(t, err)
+	assert.Len(t, rec.Exchanges(), 1)
+
+	// Connections opened by the default dialer are closed when the query
+	// fails before the exchange completes.
+	opt := rec.Options(QueryOptions{Timeout: time.Second, Extensions: []Extension{failingExtension{}}})
+	dial := opt.Dialer
+	var con net.Conn
+	opt.Dialer = func(la, ra string) (net.Conn, error) {
+		var err error
+		con, err = dial(la, ra)
+		return con, err
+	}
+	_, err = QueryWithOptions(addr, opt)
+	assert.NotNil(t, err)
+	if assert.NotNil(t, con) {
+		raw, owned := unwrapConn(con)
+		assert.True(t, owned)
+		_, err = raw.Write([]byte{0})
+		assert.ErrorIs(t, err, net.ErrClosed)
+	}
+	assert.Len(t, rec.Exchanges(), 1)
+}
+
+func TestOfflineExchangeDecode(t *testing.T) {
+	send := time.Unix(1700000000, 0)
+	req := (&header{LiVnMode: 4<<3 | byte(client), TransmitTime: 0x1234}).appendTo(nil)
+	h := header{
+		LiVnMode:     4<<3 | byte(server),
+		Stratum:      1,
+		OriginTime:   0x1234,
+		ReceiveTime:  toNtpTime(send.Add(time.Second + 10*time.Millisecond)),
+		TransmitTime: toNtpTime(send.Add(time.Second + 10*time.Millisecond)),
+	}
+	e := Exchange{
+		Server:   "192.0.2.1:123",
+		Request:  req,
+		Response: h.appendTo(nil),
+		SendTime: send,
+		RecvTime: send.Add(20 * time.Millisecond),
+	}
+	r, err := e.Decode()
+	if assert.Nil(t, err) {
+		assert.InDelta(t, float64(time.Second), float64(r.ClockOffset), float64(time.Microsecond))
+		assert.InDelta(t, float64(20*time.Millisecond), float64(r.RTT), float64(time.Microsecond))
+	}
+
+	h.OriginTime = 0x4321
+	e.Response = h.appendTo(nil)
+	_, err = e.Decode()
+	assert.ErrorIs(t, err, ErrServerResponseMismatch)
+
+	e.Request = nil
+	_, err = e.Decode()
+	assert.ErrorIs(t, err, ErrInvalidRecording)
+
+	_, err = ReadExchanges(bytes.NewReader([]byte("NTPX\x01\x00\x05ab")))
+	assert.ErrorIs(t, err, ErrInvalidRecording)
+	_, err = ReadExchanges(bytes.NewReader([]byte("pcap")))
+	assert.ErrorIs(t, err, ErrInvalidRecording)
+
+	var buf bytes.Buffer
+	assert.Nil(t, WriteExchanges(&buf, []Exchange{e}))
+	read, err := ReadExchanges(&buf)
+	if assert.Nil(t, err) && assert.Len(t, read, 1) {
+		assert.Equal(t, e.Server, read[0].Server)
+		assert.True(t, read[0].RecvTime.Equal(e.RecvTime))
+	}
+}
@@ -0,0 +1,444 @@
+// Copyright © 2015-2023 Brett Vickers.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ntp
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/binary"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Relay defaults.
+const (
+	defaultRelayInterval = 64 * time.Second
+
+	// relayPHI is the frequency tolerance (15 ppm) assumed when estimating
+	// the dispersion accumulated while measuring an upstream server.
+	relayPHI = 15e-6
+)
+
+// A Relay periodically queries a set of upstream NTP servers, selects the
+// best of them, and configures a Server to serve time derived from it. The
+// relay acts as the server's Clock, reporting the local system time
+// corrected by the selected server's clock offset, and advertises a stratum
+// one greater than the selected server's.
+//
+// When no upstream server provides a valid response for longer than
+// Holdover, the relay advertises LeapNotInSync and stratum 16 so that
+// clients stop synchronizing to it.
+type Relay struct {
+	// offset holds the selected server's clock offset, in nanoseconds. It
+	// is accessed atomically and is the first field to guarantee 64-bit
+	// alignment on 32-bit platforms.
+	offset int64
+
+	// Servers lists the addresses of the upstream servers.
+	Servers []string
+
+	// Options holds the options used to query the upstream servers. If
+	// Options.Logger is not nil, the relay also logs the upstream responses
+	// it rejects and the changes to the state it advertises.
+	Options QueryOptions
+
+	// Policy, if not nil, is used to validate upstream responses. Otherwise,
+	// Response.Validate is used.
+	Policy *ValidationPolicy
+
+	// Interval is the time between polls of the upstream servers. Defaults
+	// to 64 seconds.
+	Interval time.Duration
+
+	// Holdover is how long the relay continues to serve time after its last
+	// valid upstream response. Defaults to three poll intervals.
+	Holdover time.Duration
+
+	// Orphan, if not nil, enables orphan mode. See OrphanConfig.
+	Orphan *OrphanConfig
+
+	server *Server
+
+	mu           sync.Mutex
+	lastSync     time.Time
+	lastUpstream time.Time
+	source       string
+	response     *Response
+	leader       bool
+}
+
+// An OrphanConfig configures a relay's orphan mode, which keeps a group of
+// relays on an isolated network mutually synchronized when none of them can
+// reach its upstream servers, like ntpd's "tos orphan" setting.
+//
+// When a relay has had no valid upstream response for Wait, it queries the
+// other members of its orphan group (its Peers). If a peer is synchronized
+// at a stratum below the orphan stratum, the relay follows it as it would an
+// upstream server. Otherwise, the relay follows the peer advertising the
+// orphan stratum with the lowest ID, if that ID is lower than its own, and
+// serves time at the orphan stratum plus one. If no such peer responds, the
+// relay becomes the group's leader: it continues to serve its own clock's
+// time at the orphan stratum, with its ID as its reference ID. Because the
+// election is repeated at each poll, the group reverts to normal operation
+// as soon as upstream servers become reachable again.
+type OrphanConfig struct {
+	// Stratum is the stratum advertised by the group's leader. It should be
+	// higher than the stratum of any upstream server, so that synchronized
+	// servers are always preferred. Defaults to 10.
+	Stratum uint8
+
+	// Peers lists the addresses of the other relays in the orphan group.
+	// The relay's own address may be included; it is ignored, as are
+	// peers synchronized to this relay.
+	Peers []string
+
+	// ID is the relay's identifier, which must be unique within the group.
+	// The relay with the lowest ID becomes the group's leader. If zero, an
+	// ID derived from the host name is used.
+	ID uint32
+
+	// Wait is how long the relay waits after it was created or last
+	// received a valid upstream response before entering orphan mode.
+	// Defaults to the relay's holdover period.
+	Wait time.Duration
+}
+
+// Orphan mode defaults.
+const defaultOrphanStratum = 10
+
+// stratum returns the orphan stratum.
+func (c *OrphanConfig) stratum() uint8 {
+	if c.Stratum == 0 {
+		return defaultOrphanStratum
+	}
+	return c.Stratum
+}
+
+// id returns the relay's orphan ID.
+func (c *OrphanConfig) id() uint32 {
+	if c.ID != 0 {
+		return c.ID
+	}
+	host, _ := os.Hostname()
+	sum := md5.Sum([]byte(host))
+	return binary.BigEndian.Uint32(sum[:4]) | 1
+}
+
+// NewRelay returns a relay that queries the upstream servers and configures
+// server to serve the derived time. The server's clock is set to the relay,
+// and it advertises an unsynchronized state until the first successful
+// poll.
+func NewRelay(server *Server, upstreams ...string) *Relay {
+	r := &Relay{Servers: upstreams, server: server, lastUpstream: time.Now()}
+	server.Clock = r
+	state := server.State()
+	state.Leap, state.Stratum = LeapNotInSync, maxStratum
+	server.SetState(state)
+	return r
+}
+
+// Now returns the local system time corrected by the clock offset of the
+// selected upstream server.
+func (r *Relay) Now() time.Time {
+	return time.Now().Add(time.Duration(atomic.LoadInt64(&r.offset)))
+}
+
+// Source returns the address of the selected upstream server and its most
+// recent response. It returns false if the relay is not synchronized.
+func (r *Relay) Source() (string, *Response, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.response == nil {
+		return "", nil, false
+	}
+	return r.source, r.response, true
+}
+
+// OrphanLeader returns true if the relay is leading its orphan group.
+func (r *Relay) OrphanLeader() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.leader
+}
+
+// Run polls the upstream servers every Interval until ctx is done. It
+// returns ctx.Err().
+func (r *Relay) Run(ctx context.Context) error {
+	t := time.NewTicker(durationOrDefault(r.Interval, defaultRelayInterval))
+	defer t.Stop()
+	for {
+		r.Poll()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// Poll queries all upstream servers once and updates the server's state
+// using the best valid response, which is returned. If no upstream server
+// provides a valid response, Poll returns the first error encountered. In
+// orphan mode, Poll returns the response of the peer the relay follows, or
+// a nil response and nil error if the relay leads its orphan group.
+func (r *Relay) Poll() (*Response, error) {
+	results := r.queryAll(r.Servers)
+	best, err := selectSource(results, func(*pollResult) bool { return true })
+	if best != nil {
+		r.mu.Lock()
+		r.lastUpstream = time.Now()
+		r.mu.Unlock()
+		r.update(best.addr, best.remote, best.resp)
+		return best.resp, nil
+	}
+
+	if r.Orphan != nil && r.upstreamLost() {
+		return r.pollOrphan()
+	}
+
+	r.lost()
+	if err == nil {
+		err = ErrNoTimeSource
+	}
+	return nil, err
+}
+
+// A pollResult holds the outcome of querying a single server.
+type pollResult struct {
+	addr   string
+	remote net.Addr
+	local  net.Addr
+	resp   *Response
+	err    error
+}
+
+// queryAll queries the servers in parallel.
+func (r *Relay) queryAll(servers []string) []pollResult {
+	results := make([]pollResult, len(servers))
+	var wg sync.WaitGroup
+	for i, addr := range servers {
+		wg.Add(1)
+		go func(i int, addr string) {
+			defer wg.Done()
+			remote, local, resp, err := r.query(addr)
+			results[i] = pollResult{addr, remote, local, resp, err}
+		}(i, addr)
+	}
+	wg.Wait()
+	return results
+}
+
+// selectSource returns the best of the valid responses accepted by the
+// filter, along with the first error encountered.
+func selectSource(results []pollResult, accept func(*pollResult) bool) (*pollResult, error) {
+	var best *pollResult
+	var firstErr error
+	for i := range results {
+		res := &results[i]
+		if res.err != nil {
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			continue
+		}
+		if !accept(res) {
+			continue
+		}
+		if best == nil || betterSource(res.resp, best.resp) {
+			best = res
+		}
+	}
+	return best, firstErr
+}
+
+// upstreamLost returns true if the relay has been without a valid upstream
+// response for long enough to enter orphan mode.
+func (r *Relay) upstreamLost() bool {
+	wait := durationOrDefault(r.Orphan.Wait, r.holdover())
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return time.Since(r.lastUpstream) > wait
+}
+
+// pollOrphan queries the relay's orphan peers and either follows the best
+// of them or becomes the group's leader.
+func (r *Relay) pollOrphan() (*Response, error) {
+	stratum, id := r.Orphan.stratum(), r.Orphan.id()
+	results := r.queryAll(r.Orphan.Peers)
+	best, _ := selectSource(results, func(res *pollResult) bool {
+		if r.isLoop(res, id) {
+			return false
+		}
+		resp := res.resp
+		return resp.Stratum < stratum || (resp.Stratum == stratum && resp.ReferenceID < id)
+	})
+	if best != nil {
+		r.update(best.addr, best.remote, best.resp)
+		return best.resp, nil
+	}
+
+	// Lead the group, serving the relay's own clock.
+	r.mu.Lock()
+	r.lastSync = time.Now()
+	r.source, r.response = "", nil
+	r.leader = true
+	r.mu.Unlock()
+
+	r.debug("ntp relay leading orphan group", logStratum, stratum, logReferenceID, id)
+
+	state := r.server.State()
+	state.Leap = LeapNoWarning
+	state.Stratum = stratum
+	state.ReferenceID = id
+	state.ReferenceTime = r.Now()
+	state.RootDelay, state.RootDispersion = 0, 0
+	r.server.SetState(state)
+	return nil, nil
+}
+
+// isLoop returns true if the peer response res was sent by this relay, or
+// by a peer synchronized to it, which must not be followed to avoid a
+// timing loop. While leading the group, the relay advertises its orphan ID
+// as its reference ID, and a peer synchronized to the relay advertises the
+// relay's address, which is the local address of the query. Loopback
+// addresses don't identify a host, so they are not compared.
+func (r *Relay) isLoop(res *pollResult, id uint32) bool {
+	if res.remote != nil && r.server.listening(res.remote) {
+		return true
+	}
+	if res.resp.ReferenceID == id {
+		return true
+	}
+	ip := addrIP(res.local)
+	return ip != nil && !ip.IsLoopback() && res.resp.ReferenceID == referenceID(ip)
+}
+
+// query queries the upstream server at addr and validates its response. It
+// also returns the network addresses of the server and of the local end of
+// the connection.
+func (r *Relay) query(addr string) (remote, local net.Addr, resp *Response, err error) {
+	opt := r.Options
+	dial := opt.Dialer
+	if dial == nil {
+		dial = defaultDialer
+	}
+	if opt.Dial == nil {
+		opt.Dialer = func(la, ra string) (net.Conn, error) {
+			con, err := dial(la, ra)
+			if err == nil {
+				remote, local = con.RemoteAddr(), con.LocalAddr()
+			}
+			return con, err
+		}
+	}
+
+	resp, err = QueryWithOptions(addr, opt)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if r.Policy != nil {
+		err = resp.ValidateWithPolicy(r.Policy).Err()
+	} else {
+		err = resp.Validate()
+	}
+	if err != nil {
+		r.debug("ntp response rejected", logServer, addr, logErr, err)
+		return nil, nil, nil, err
+	}
+	return remote, local, resp, nil
+}
+
+// betterSource returns true if the response a is from a better time source
+// than the response b: one with a smaller root distance or, if equal, a
+// lower stratum.
+func betterSource(a, b *Response) bool {
+	if a.RootDistance != b.RootDistance {
+		return a.RootDistance < b.RootDistance
+	}
+	return a.Stratum < b.Stratum
+}
+
+// update synchronizes the relay to the response resp received from the
+// upstream server at addr.
+func (r *Relay) update(addr string, remote net.Addr, resp *Response) {
+	atomic.StoreInt64(&r.offset, int64(resp.ClockOffset))
+	r.mu.Lock()
+	r.lastSync = time.Now()
+	r.source, r.response = addr, resp
+	r.leader = false
+	r.mu.Unlock()
+
+	stratum := resp.Stratum + 1
+	if stratum > maxStratum {
+		stratum = maxStratum
+	}
+
+	// Accumulate the dispersion of the measurement, due to the upstream
+	// server's precision and the frequency tolerance over the round trip.
+	disp := resp.RootDispersion + resp.Precision +
+		time.Duration(relayPHI*float64(resp.RTT))
+
+	r.debug("ntp relay synchronized", logServer, addr, logStratum, stratum, logOffset, resp.ClockOffset)
+
+	state := r.server.State()
+	state.Leap = resp.Leap
+	state.Stratum = stratum
+	state.ReferenceID = referenceID(addrIP(remote))
+	state.ReferenceTime = r.Now()
+	state.RootDelay = resp.RootDelay + resp.RTT
+	state.RootDispersion = disp
+	r.server.SetState(state)
+}
+
+// lost records a poll in which no upstream server provided a valid
+// response. Once the holdover period has elapsed, the server advertises an
+// unsynchronized state.
+func (r *Relay) lost() {
+	holdover := r.holdover()
+
+	r.mu.Lock()
+	if !r.lastSync.IsZero() && time.Since(r.lastSync) <= holdover {
+		r.mu.Unlock()
+		return
+	}
+	r.source, r.response = "", nil
+	r.leader = false
+	r.mu.Unlock()
+
+	r.debug("ntp relay unsynchronized")
+
+	state := r.server.State()
+	state.Leap, state.Stratum = LeapNotInSync, maxStratum
+	r.server.SetState(state)
+}
+
+// debug logs a message to the relay's logger, if it has one.
+func (r *Relay) debug(msg string, args ...interface{}) {
+	if r.Options.Logger != nil {
+		r.Options.Logger.Debug(msg, args...)
+	}
+}
+
+// holdover returns the relay's holdover period.
+func (r *Relay) holdover() time.Duration {
+	return durationOrDefault(r.Holdover, 3*durationOrDefault(r.Interval, defaultRelayInterval))
+}
+
+// referenceID returns the reference ID identifying an upstream server with
+// address ip: the IPv4 address itself, or the first four bytes of the MD5
+// hash of an IPv6 address. See RFC 5905, section 7.3.
+func referenceID(ip net.IP) uint32 {
+	if ip == nil {
+		return 0
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return binary.BigEndian.Uint32(ip4)
+	}
+	sum := md5.Sum(ip.To16())
+	return binary.BigEndian.Uint32(sum[:4])
+}
@@ -0,0 +1,184 @@
+// Copyright © 2015-2023 Brett Vickers.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ntp
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOfflineRelay(t *testing.T) {
+	primary := NewServer(ServerState{Stratum: 1, ReferenceID: kissCodeID("GPS"), RootDispersion: time.Millisecond})
+	primary.Clock = &offsetClock{time.Hour}
+	secondary := NewServer(ServerState{Stratum: 2, RootDelay: time.Second})
+	secondary.Clock = &offsetClock{-time.Hour}
+	upstreams := []string{startTestServer(t, secondary), startTestServer(t, primary)}
+
+	s := NewServer(ServerState{Stratum: 1, Precision: -20})
+	relay := NewRelay(s, upstreams...)
+	relay.Options.Timeout = time.Second
+	relay.Holdover = time.Nanosecond
+	addr := startTestServer(t, s)
+
+	// The relay is unsynchronized until the first poll.
+	state := s.State()
+	assert.Equal(t, LeapIndicator(LeapNotInSync), state.Leap)
+	assert.Equal(t, uint8(16), state.Stratum)
+
+	resp, err := relay.Poll()
+	if !assert.Nil(t, err) {
+		return
+	}
+	source, r, ok := relay.Source()
+	assert.True(t, ok)
+	assert.Equal(t, upstreams[1], source)
+	assert.Equal(t, resp, r)
+
+	state = s.State()
+	assert.Equal(t, LeapNoWarning, state.Leap)
+	assert.Equal(t, uint8(2), state.Stratum)
+	assert.Equal(t, int8(-20), state.Precision)
+	assert.Equal(t, uint32(0x7f000001), state.ReferenceID)
+	assert.Equal(t, resp.RTT, state.RootDelay)
+	assert.True(t, state.RootDispersion > time.Millisecond)
+
+	// Clients of the relay receive the primary server's time.
+	r, err = QueryWithOptions(addr, QueryOptions{Timeout: time.Second})
+	if assert.Nil(t, err) {
+		assert.Nil(t, r.Validate())
+		assert.Equal(t, uint8(2), r.Stratum)
+		assert.Equal(t, "127.0.0.1", r.ReferenceString())
+		assert.InDelta(t, float64(time.Hour), float64(r.ClockOffset), float64(10*time.Millisecond))
+	}
+
+	// When the upstream servers become unreachable, the relay advertises an
+	// unsynchronized state once the holdover period has elapsed.
+	primary.Close()
+	secondary.Close()
+	relay.Options.Timeout = 100 * time.Millisecond
+	_, err = relay.Poll()
+	assert.NotNil(t, err)
+	_, _, ok = relay.Source()
+	assert.False(t, ok)
+
+	r, err = QueryWithOptions(addr, QueryOptions{Timeout: time.Second})
+	if assert.Nil(t, err) {
+		assert.Equal(t, LeapIndicator(LeapNotInSync), r.Leap)
+		assert.ErrorIs(t, r.Validate(), ErrInvalidStratum)
+	}
+
+	relay.Servers = nil
+	_, err = relay.Poll()
+	assert.ErrorIs(t, err, ErrNoTimeSource)
+}
+
+func TestOfflineRelayOrphan(t *testing.T) {
+	servers := make([]*Server, 3)
+	relays := make([]*Relay, 3)
+	peers := make([]string, 3)
+	for i := range relays {
+		servers[i] = NewServer(ServerState{})
+		relays[i] = NewRelay(servers[i])
+		relays[i].Options.Timeout = 100 * time.Millisecond
+		peers[i] = startTestServer(t, servers[i])
+	}
+	for i, r := range relays {
+		r.Orphan = &OrphanConfig{Peers: peers, ID: uint32(i + 1), Wait: time.Nanosecond}
+	}
+	time.Sleep(time.Millisecond)
+
+	// With no other orphan leader, a relay leads the group, even if a
+	// relay with a higher ID already does.
+	resp, err := relays[2].Poll()
+	assert.Nil(t, resp)
+	assert.Nil(t, err)
+	assert.True(t, relays[2].OrphanLeader())
+	_, err = relays[0].Poll()
+	assert.Nil(t, err)
+	assert.True(t, relays[0].OrphanLeader())
+
+	state := servers[0].State()
+	assert.Equal(t, LeapNoWarning, state.Leap)
+	assert.Equal(t, uint8(10), state.Stratum)
+	assert.Equal(t, uint32(1), state.ReferenceID)
+
+	// The other relays follow the leader with the lowest ID.
+	for _, i := range []int{1, 2} {
+		resp, err = relays[i].Poll()
+		if assert.Nil(t, err) && assert.NotNil(t, resp) {
+			assert.Equal(t, uint32(1), resp.ReferenceID)
+		}
+		assert.False(t, relays[i].OrphanLeader())
+		source, _, _ := relays[i].Source()
+		assert.Equal(t, peers[0], source)
+		assert.Equal(t, uint8(11), servers[i].State().Stratum)
+	}
+
+	// When a relay regains an upstream server, the group follows it.
+	upstream := NewServer(ServerState{Stratum: 1})
+	relays[1].Servers = []string{startTestServer(t, upstream)}
+	_, err = relays[1].Poll()
+	assert.Nil(t, err)
+	assert.Equal(t, uint8(2), servers[1].State().Stratum)
+
+	for _, i := range []int{0, 2} {
+		_, err = relays[i].Poll()
+		assert.Nil(t, err)
+		assert.False(t, relays[i].OrphanLeader())
+		source, _, _ := relays[i].Source()
+		assert.Equal(t, peers[1], source)
+		assert.Equal(t, uint8(3), servers[i].State().Stratum)
+	}
+}
+
+func TestOfflineRelayOrphanSelf(t *testing.T) {
+	upstream := NewServer(ServerState{Stratum: 1})
+	servers := []*Server{NewServer(ServerState{}), NewServer(ServerState{})}
+	relays := make([]*Relay, 2)
+	peers := make([]string, 2)
+	for i := range relays {
+		relays[i] = NewRelay(servers[i])
+		relays[i].Options.Timeout = 100 * time.Millisecond
+		peers[i] = startTestServer(t, servers[i])
+	}
+	for i, r := range relays {
+		r.Orphan = &OrphanConfig{Peers: peers, ID: uint32(i + 1), Wait: time.Nanosecond}
+	}
+	relays[1].Servers = []string{startTestServer(t, upstream)}
+	time.Sleep(time.Millisecond)
+
+	_, err := relays[1].Poll()
+	assert.Nil(t, err)
+	_, err = relays[0].Poll()
+	assert.Nil(t, err)
+	assert.Equal(t, uint8(3), servers[0].State().Stratum)
+
+	// When the peer it follows becomes unsynchronized, the relay doesn't
+	// follow itself, although it advertises a stratum below the orphan
+	// stratum, and leads the group instead.
+	state := servers[1].State()
+	state.Leap, state.Stratum = LeapNotInSync, maxStratum
+	servers[1].SetState(state)
+	resp, err := relays[0].Poll()
+	assert.Nil(t, resp)
+	assert.Nil(t, err)
+	assert.True(t, relays[0].OrphanLeader())
+	assert.Equal(t, uint8(10), servers[0].State().Stratum)
+}
+
+func TestOfflineReferenceID(t *testing.T) {
+	assert.Equal(t, uint32(0xc0000201), referenceID(net.ParseIP("192.0.2.1")))
+	assert.Equal(t, uint32(0), referenceID(nil))
+
+	// IPv6 addresses are identified by the first four bytes of their MD5
+	// hash.
+	a := referenceID(net.ParseIP("2001:db8::1"))
+	b := referenceID(net.ParseIP("2001:db8::2"))
+	assert.NotEqual(t, a, b)
+	assert.NotEqual(t, uint32(0x20010db8), a)
+}
@@ -0,0 +1,15 @@
+// Copyright © 2015-2023 Brett Vickers.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !linux
+// +build !linux
+
+package ntp
+
+import "net"
+
+// listenReusePort reports that SO_REUSEPORT is not supported.
+func listenReusePort(network, address string) (net.PacketConn, error) {
+	return nil, errReusePortUnsupported
+}
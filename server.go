@@ -0,0 +1,590 @@
+// Copyright © 2015-2023 Brett Vickers.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ntp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A ServerState describes the synchronization state a Server advertises in
+// its responses.
+type ServerState struct {
+	// Leap is the leap indicator reported to clients. Report LeapNotInSync
+	// when the server's clock is not synchronized.
+	Leap LeapIndicator
+
+	// Stratum is the server's stratum. Stratum 1 servers are attached to a
+	// reference clock. A stratum of 0 is reported to clients as 16
+	// (unsynchronized), since stratum 0 is reserved for kiss-of-death
+	// packets.
+	Stratum uint8
+
+	// Precision is the precision of the server's clock, expressed as a
+	// power of two in seconds (e.g., -20 for about one microsecond).
+	Precision int8
+
+	// ReferenceID identifies the server's reference clock or upstream
+	// server. For stratum 1, it is typically a 4-character ASCII string such
+	// as "GPS" or "LOCL".
+	ReferenceID uint32
+
+	// ReferenceTime is the time the server's clock was last set or
+	// corrected. If zero, each response reports its own transmit time,
+	// which is appropriate for a server whose clock is continuously
+	// disciplined.
+	ReferenceTime time.Time
+
+	// RootDelay and RootDispersion are the server's total round-trip delay
+	// and dispersion relative to the stratum 1 reference clock.
+	RootDelay      time.Duration
+	RootDispersion time.Duration
+}
+
+// A Server answers NTP queries from clients using the time reported by its
+// clock. Configure the exported fields before calling Serve; the advertised
+// state may be changed at any time using SetState.
+//
+// When a KeyRing is provided, the server verifies the MAC of each
+// authenticated query using the trusted key whose ID appears in the MAC, and
+// signs its response with the same key. Queries authenticated with unknown,
+// untrusted or incorrect keys are answered with a crypto-NAK.
+type Server struct {
+	// stats holds packet counters, updated atomically. It is the first field
+	// to guarantee 64-bit alignment on 32-bit platforms.
+	stats [numStats]uint64
+
+	// Clock supplies the time reported to clients. Defaults to the local
+	// system clock.
+	Clock Clock
+
+	// KeyRing holds the symmetric keys used to authenticate queries and
+	// sign responses. If nil, authenticated queries are answered with a
+	// crypto-NAK.
+	KeyRing *KeyRing
+
+	// RequireAuth causes the server to ignore queries that do not carry a
+	// MAC.
+	RequireAuth bool
+
+	// RateLimit, if not nil, limits the rate at which each client's queries
+	// are answered. If Access is also set, only networks with the
+	// RestrictLimited flag are rate limited.
+	RateLimit *RateLimiter
+
+	// Access, if not nil, determines the restrictions applied to each
+	// packet based on its source address.
+	Access *AccessList
+
+	// MRU, if not nil, records statistics about the clients that have most
+	// recently sent packets to the server.
+	MRU *MRUList
+
+	// Logger, if not nil, receives debug logs of the packets the server
+	// discards, the kiss-of-death packets it sends and the queries that
+	// fail authentication. A *slog.Logger may be used.
+	Logger Logger
+
+	// Smear, if not nil, causes the server to smear leap seconds announced
+	// by its state's leap indicator into the times it serves, instead of
+	// announcing them to clients. The leap second is assumed to occur at the
+	// end of the month in which it was announced, and is smeared to
+	// completion even if the announcement is withdrawn once it has passed.
+	// The server of a Relay may use Smear to smear leap seconds announced by
+	// its upstream servers. Clients of a smearing server should not be
+	// mixed with servers that don't smear.
+	Smear *LeapSmear
+
+	state  atomic.Value // *ServerState
+	mu     sync.Mutex
+	conns  map[net.PacketConn]struct{}
+	closed bool
+	leap   announcedLeap
+}
+
+// ServerStats holds counts of the packets received by a Server and the
+// reasons packets were refused.
+type ServerStats struct {
+	Received    uint64 // packets received
+	Responded   uint64 // responses sent, including kiss-of-death packets
+	Ignored     uint64 // malformed or unsupported packets ignored
+	Denied      uint64 // packets refused by the ignore or noserve restrictions
+	NoQuery     uint64 // control queries refused by noquery or nomodify
+	NoTrust     uint64 // unauthenticated queries refused
+	RateLimited uint64 // queries exceeding the client's rate limit
+	KissOfDeath uint64 // kiss-of-death packets sent
+	CryptoNAK   uint64 // crypto-NAKs sent
+}
+
+// Indexes of the counters in Server.stats.
+const (
+	statReceived = iota
+	statResponded
+	statIgnored
+	statDenied
+	statNoQuery
+	statNoTrust
+	statRateLimited
+	statKissOfDeath
+	statCryptoNAK
+	numStats
+)
+
+// NewServer returns a server advertising the requested state.
+func NewServer(state ServerState) *Server {
+	s := &Server{}
+	s.SetState(state)
+	return s
+}
+
+// State returns the synchronization state the server advertises.
+func (s *Server) State() ServerState {
+	if st, ok := s.state.Load().(*ServerState); ok {
+		return *st
+	}
+	return ServerState{}
+}
+
+// SetState changes the synchronization state the server advertises.
+func (s *Server) SetState(state ServerState) {
+	s.state.Store(&state)
+
+	smear := s.Smear
+	if smear == nil {
+		smear = &LeapSmear{}
+	}
+	now := s.now()
+	s.mu.Lock()
+	s.leap.update(now, state.Leap, smear)
+	s.mu.Unlock()
+}
+
+// smear returns the time t corrected by the offset of any leap second being
+// smeared.
+func (s *Server) smear(t time.Time) time.Time {
+	if s.Smear == nil {
+		return t
+	}
+	s.mu.Lock()
+	leap := s.leap
+	s.mu.Unlock()
+	if leap.li == LeapNoWarning {
+		return t
+	}
+	return t.Add(s.Smear.Offset(t, leap.time, leap.li))
+}
+
+// Stats returns the server's packet counters.
+func (s *Server) Stats() ServerStats {
+	load := func(i int) uint64 { return atomic.LoadUint64(&s.stats[i]) }
+	return ServerStats{
+		Received:    load(statReceived),
+		Responded:   load(statResponded),
+		Ignored:     load(statIgnored),
+		Denied:      load(statDenied),
+		NoQuery:     load(statNoQuery),
+		NoTrust:     load(statNoTrust),
+		RateLimited: load(statRateLimited),
+		KissOfDeath: load(statKissOfDeath),
+		CryptoNAK:   load(statCryptoNAK),
+	}
+}
+
+func (s *Server) count(stat int) {
+	atomic.AddUint64(&s.stats[stat], 1)
+}
+
+// discardReasons names the counters of discarded packets in logs.
+var discardReasons = map[int]string{
+	statIgnored:     "ignored",
+	statDenied:      "denied",
+	statNoQuery:     "noquery",
+	statNoTrust:     "notrust",
+	statRateLimited: "ratelimited",
+}
+
+// discard counts a packet from addr discarded for the reason counted by
+// stat.
+func (s *Server) discard(addr net.Addr, stat int) {
+	s.count(stat)
+	if s.Logger != nil {
+		s.Logger.Debug("ntp packet discarded", logClient, addrString(addr), logReason, discardReasons[stat])
+	}
+}
+
+// addrString returns the string form of addr, which may be nil.
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
+
+// ListenAndServe listens for NTP queries on the UDP address addr and answers
+// them. If addr is empty, ":123" is used. ListenAndServe always returns a
+// non-nil error; after Close, it returns ErrServerClosed.
+func (s *Server) ListenAndServe(addr string) error {
+	if addr == "" {
+		addr = ":123"
+	}
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(conn)
+}
+
+// Serve answers NTP queries received on conn until conn fails or the server
+// is closed. Serve always returns a non-nil error and closes conn; after
+// Close, it returns ErrServerClosed.
+func (s *Server) Serve(conn net.PacketConn) error {
+	if !s.track(conn, true) {
+		conn.Close()
+		return ErrServerClosed
+	}
+	defer s.track(conn, false)
+	defer conn.Close()
+
+	buf := make([]byte, 8192)
+	var out []byte
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		rxTime := s.now()
+		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			return err
+		}
+
+		out = s.appendResponse(out[:0], buf[:n], addr, rxTime)
+		if len(out) > 0 {
+			conn.WriteTo(out, addr)
+		}
+	}
+}
+
+// Close stops the server, closing all connections passed to Serve.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	var err error
+	for conn := range s.conns {
+		if cerr := conn.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	s.conns = nil
+	return err
+}
+
+// track adds conn to or removes it from the set of connections closed by
+// Close. It returns false if the server has already been closed.
+func (s *Server) track(conn net.PacketConn, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !add {
+		delete(s.conns, conn)
+		return true
+	}
+	if s.closed {
+		return false
+	}
+	if s.conns == nil {
+		s.conns = make(map[net.PacketConn]struct{})
+	}
+	s.conns[conn] = struct{}{}
+	return true
+}
+
+// listening returns true if addr is the address of one of the connections
+// the server is serving.
+func (s *Server) listening(addr net.Addr) bool {
+	ip := addrIP(addr)
+	ua, ok := addr.(*net.UDPAddr)
+	if ip == nil || !ok {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		la, ok := conn.LocalAddr().(*net.UDPAddr)
+		if !ok || la.Port != ua.Port {
+			continue
+		}
+		if la.IP.Equal(ip) || (la.IP.IsUnspecified() && isLocalIP(ip)) {
+			return true
+		}
+	}
+	return false
+}
+
+// isLocalIP returns true if ip is the address of one of the host's network
+// interfaces.
+func isLocalIP(ip net.IP) bool {
+	if ip.IsLoopback() {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// now returns the current time according to the server's clock.
+func (s *Server) now() time.Time {
+	if s.Clock != nil {
+		return s.Clock.Now()
+	}
+	return time.Now()
+}
+
+// Respond returns the server's response to the query packet req, received
+// from addr at time rxTime. It returns nil if the query should be ignored.
+// Respond is used by Serve, and may be used directly by servers that manage
+// their own sockets.
+func (s *Server) Respond(req []byte, addr net.Addr, rxTime time.Time) []byte {
+	resp := s.appendResponse(nil, req, addr, rxTime)
+	if len(resp) == 0 {
+		return nil
+	}
+	return resp
+}
+
+// appendResponse appends the server's response to the query packet req to
+// dst. It returns dst unchanged if the query should be ignored.
+func (s *Server) appendResponse(dst, req []byte, addr net.Addr, rxTime time.Time) []byte {
+	s.count(statReceived)
+	if len(req) == 0 {
+		s.discard(addr, statIgnored)
+		return dst
+	}
+
+	// Control packets are shorter than NTP packets, so only the first byte
+	// is examined before the access list is consulted.
+	md := mode(req[0] & 0x07)
+	version := int((req[0] >> 3) & 0x07)
+	ip := addrIP(addr)
+	var flags RestrictFlag
+	if s.Access != nil {
+		flags = s.Access.Flags(ip)
+	}
+	if s.MRU != nil {
+		s.MRU.record(addr, uint8(md), version, flags, rxTime)
+	}
+	isQuery := md == client && version >= 1 && version <= 4 && len(req) >= 48
+	var reqHdr header
+	if isQuery {
+		reqHdr.unmarshal(req)
+	}
+
+	switch {
+	case flags&RestrictIgnore != 0:
+		s.discard(addr, statDenied)
+		return dst
+	case md == controlMessage || md == reservedPrivate:
+		// Control queries are not supported, but are counted separately when
+		// refused by a restriction.
+		if flags&RestrictNoQuery != 0 || (flags&RestrictNoModify != 0 && isModify(req)) {
+			s.discard(addr, statNoQuery)
+		} else {
+			s.discard(addr, statIgnored)
+		}
+		return dst
+	case !isQuery:
+		s.discard(addr, statIgnored)
+		return dst
+	case flags&RestrictNoServe != 0:
+		if flags&RestrictKoD != 0 {
+			s.count(statDenied)
+			return s.appendKissOfDeath(dst, &reqHdr, addr, "DENY", rxTime)
+		}
+		s.discard(addr, statDenied)
+		return dst
+	}
+
+	if s.RateLimit != nil && (s.Access == nil || flags&RestrictLimited != 0) {
+		kod := s.RateLimit.KissOfDeath || flags&RestrictKoD != 0
+		switch s.RateLimit.check(ip, rxTime, kod) {
+		case rateDrop:
+			s.discard(addr, statRateLimited)
+			if s.MRU != nil {
+				s.MRU.limit(addr, false)
+			}
+			return dst
+		case rateKoD:
+			s.count(statRateLimited)
+			if s.MRU != nil {
+				s.MRU.limit(addr, true)
+			}
+			return s.appendKissOfDeath(dst, &reqHdr, addr, "RATE", rxTime)
+		}
+	}
+
+	key, authenticated, nak := s.authenticate(req, addr)
+	if !authenticated && !nak {
+		switch {
+		case s.RequireAuth || flags&RestrictNoTrust != 0:
+			s.discard(addr, statNoTrust)
+			return dst
+		case len(req) > 48:
+			s.discard(addr, statIgnored)
+			return dst
+		}
+	}
+
+	state := s.State()
+	h := header{
+		Stratum:        state.Stratum,
+		Poll:           reqHdr.Poll,
+		Precision:      state.Precision,
+		RootDelay:      ntpTimeShort(NewShortTimestamp(state.RootDelay)),
+		RootDispersion: ntpTimeShort(NewShortTimestamp(state.RootDispersion)),
+		ReferenceID:    state.ReferenceID,
+		OriginTime:     reqHdr.TransmitTime,
+		ReceiveTime:    toNtpTime(s.smear(rxTime)),
+	}
+	leap := state.Leap
+	if s.Smear != nil && (leap == LeapAddSecond || leap == LeapDelSecond) {
+		leap = LeapNoWarning
+	}
+	h.setLeap(leap)
+	h.setVersion(reqHdr.getVersion())
+	h.setMode(server)
+	if h.Stratum == 0 {
+		h.Stratum = maxStratum
+	}
+
+	xmitTime := s.smear(s.now())
+	h.TransmitTime = toNtpTime(xmitTime)
+	if state.ReferenceTime.IsZero() {
+		h.ReferenceTime = h.TransmitTime
+	} else {
+		h.ReferenceTime = toNtpTime(s.smear(state.ReferenceTime))
+	}
+
+	resp := h.appendTo(dst)
+	switch {
+	case nak:
+		resp = append(resp, 0, 0, 0, 0)
+	case authenticated:
+		buf := bytes.NewBuffer(resp)
+		appendMAC(buf, AuthOptions{Type: key.Type, KeyID: key.ID}, key.Secret)
+		resp = buf.Bytes()
+	}
+
+	// Never send an unauthenticated client a response larger than its query,
+	// so the server can't be used to amplify traffic sent to a spoofed
+	// address.
+	if !authenticated && len(resp)-len(dst) > len(req) {
+		s.discard(addr, statIgnored)
+		return dst
+	}
+	if nak {
+		s.count(statCryptoNAK)
+	}
+	s.count(statResponded)
+	return resp
+}
+
+// isModify returns true if the control query in req attempts to modify the
+// server's state.
+func isModify(req []byte) bool {
+	if mode(req[0]&0x07) == reservedPrivate {
+		return true
+	}
+	if len(req) < 2 {
+		return false
+	}
+	switch req[1] & 0x1f {
+	case 3, 5, 6, 8, 9, 31: // write variables, write clock, set trap, configure, save, unset trap
+		return true
+	}
+	return false
+}
+
+// appendKissOfDeath appends a kiss-of-death response carrying the requested
+// kiss code to dst.
+func (s *Server) appendKissOfDeath(dst []byte, reqHdr *header, addr net.Addr, code string, rxTime time.Time) []byte {
+	h := header{
+		Poll:        reqHdr.Poll,
+		ReferenceID: kissCodeID(code),
+		OriginTime:  reqHdr.TransmitTime,
+		ReceiveTime: toNtpTime(rxTime),
+	}
+	h.setLeap(LeapNotInSync)
+	h.setVersion(reqHdr.getVersion())
+	h.setMode(server)
+	h.TransmitTime = toNtpTime(s.now())
+
+	s.count(statKissOfDeath)
+	s.count(statResponded)
+	if s.Logger != nil {
+		s.Logger.Debug("ntp kiss of death sent", logClient, addrString(addr), logKissCode, code)
+	}
+	return h.appendTo(dst)
+}
+
+// kissCodeID returns the reference ID holding a 4-character kiss code.
+func kissCodeID(code string) uint32 {
+	var b [4]byte
+	copy(b[:], code)
+	return binary.BigEndian.Uint32(b[:])
+}
+
+// authenticate verifies the MAC of the query packet req from addr. It
+// returns the key used to sign the query if it was authenticated, or
+// nak=true if the query carried a MAC that could not be verified and should
+// be answered with a crypto-NAK.
+func (s *Server) authenticate(req []byte, addr net.Addr) (key Key, authenticated, nak bool) {
+	if len(req) == 48 {
+		return Key{}, false, false
+	}
+	if s.KeyRing == nil {
+		return Key{}, false, true
+	}
+
+	key, err := s.KeyRing.authenticate(req)
+	var authErr *AuthError
+	if err != nil && s.Logger != nil {
+		var keyID uint32
+		if errors.As(err, &authErr) {
+			keyID = authErr.KeyID
+		}
+		s.Logger.Debug("ntp authentication failed", logClient, addrString(addr), logKeyID, keyID, logErr, err)
+	}
+	switch {
+	case err == nil:
+		return key, true, false
+	case errors.As(err, &authErr) &&
+		(authErr.Failure == AuthWrongKeyID || authErr.Failure == AuthDigestMismatch):
+		return Key{}, false, true
+	default:
+		// Malformed MACs and crypto-NAKs sent by the client are ignored.
+		return Key{}, false, false
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright © 2015-2023 Brett Vickers.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ntp
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type offsetClock struct {
+	d time.Duration
+}
+
+func (c *offsetClock) Now() time.Time {
+	return time.Now().Add(c.d)
+}
+
+// startTestServer starts serving s on a loopback address and returns the
+// address.
+func startTestServer(t *testing.T, s *Server) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- s.Serve(conn) }()
+	t.Cleanup(func() {
+		s.Close()
+		assert.ErrorIs(t, <-done, ErrServerClosed)
+	})
+	return conn.LocalAddr().String()
+}
+
+func TestOfflineServer(t *testing.T) {
+	s := NewServer(ServerState{
+		Stratum:        1,
+		Precision:      -20,
+		ReferenceID:    0x47505300, // "GPS"
+		RootDispersion: time.Millisecond,
+	})
+	s.Clock = &offsetClock{time.Hour}
+	addr := startTestServer(t, s)
+
+	r, err := QueryWithOptions(addr, QueryOptions{Timeout: time.Second})
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Nil(t, r.Validate())
+	assert.Equal(t, uint8(1), r.Stratum)
+	assert.Equal(t, ".GPS.", r.ReferenceString())
+	assert.Equal(t, LeapNoWarning, r.Leap)
+	assert.Equal(t, 4, r.Version)
+	assert.InDelta(t, float64(time.Hour), float64(r.ClockOffset), float64(10*time.Millisecond))
+	assert.InDelta(t, float64(time.Millisecond), float64(r.RootDispersion), float64(20*time.Microsecond))
+
+	s.SetState(ServerState{Stratum: 2, Leap: LeapNotInSync, ReferenceID: 0x0a000001})
+	r, err = QueryWithOptions(addr, QueryOptions{Timeout: time.Second, Version: 3})
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, LeapIndicator(LeapNotInSync), r.Leap)
+	assert.Equal(t, "10.0.0.1", r.ReferenceString())
+	assert.Equal(t, 3, r.Version)
+	assert.ErrorIs(t, r.Validate(), ErrInvalidLeapSecond)
+}
+
+func TestOfflineServerAuth(t *testing.T) {
+	ring, err := ParseKeys(strings.NewReader(testChronyKeys), KeyFileChrony)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(ServerState{Stratum: 1})
+	s.KeyRing = NewKeyRing(ring...)
+	s.KeyRing.SetTrusted(1, 2, 5, 6)
+	s.RequireAuth = true
+	addr := startTestServer(t, s)
+
+	// Queries signed with trusted keys receive signed responses.
+	for _, id := range []uint16{1, 2, 5, 6} {
+		opt := QueryOptions{Timeout: time.Second, Auth: AuthOptions{KeyRing: s.KeyRing, KeyID: id}}
+		r, err := QueryWithOptions(addr, opt)
+		if !assert.Nil(t, err, "key %d", id) {
+			continue
+		}
+		assert.Nil(t, r.AuthErr(), "key %d", id)
+		assert.Nil(t, r.ValidateWithPolicy(&ValidationPolicy{RequireAuth: true}).Err(), "key %d", id)
+	}
+
+	// Queries signed with untrusted or unknown keys receive a crypto-NAK.
+	untrusted := NewKeyRing(ring...)
+	untrusted.Add(Key{ID: 9, Type: AuthSHA1, Secret: []byte("unknown-key-secret")})
+	for _, id := range []uint16{3, 9} {
+		opt := QueryOptions{Timeout: time.Second, Auth: AuthOptions{KeyRing: untrusted, KeyID: id}}
+		r, err := QueryWithOptions(addr, opt)
+		if !assert.Nil(t, err, "key %d", id) {
+			continue
+		}
+		var authErr *AuthError
+		if assert.True(t, errors.As(r.AuthErr(), &authErr), "key %d", id) {
+			assert.Equal(t, AuthCryptoNAK, authErr.Failure)
+		}
+	}
+
+	// Queries signed with the wrong secret receive a crypto-NAK.
+	wrong := NewKeyRing(Key{ID: 2, Type: AuthSHA1, Secret: []byte("not-the-right-secret")})
+	r, err := QueryWithOptions(addr, QueryOptions{Timeout: time.Second, Auth: AuthOptions{KeyRing: wrong, KeyID: 2}})
+	if assert.Nil(t, err) {
+		assert.ErrorIs(t, r.AuthErr(), ErrAuthFailed)
+	}
+
+	// Unauthenticated queries are ignored.
+	_, err = QueryWithOptions(addr, QueryOptions{Timeout: 200 * time.Millisecond})
+	var qerr *QueryError
+	if assert.True(t, errors.As(err, &qerr)) {
+		assert.True(t, qerr.Timeout())
+	}
+}
+
+func TestOfflineServerRespond(t *testing.T) {
+	s := NewServer(ServerState{Stratum: 1})
+	now := time.Now()
+
+	// Short packets and packets in modes other than client mode are ignored.
+	assert.Nil(t, s.Respond(make([]byte, 47), nil, now))
+	query := make([]byte, 48)
+	query[0] = 4<<3 | byte(server)
+	assert.Nil(t, s.Respond(query, nil, now))
+	query[0] = 4<<3 | byte(controlMessage)
+	assert.Nil(t, s.Respond(query, nil, now))
+
+	// A server without a key ring answers authenticated queries with a
+	// crypto-NAK.
+	query[0] = 4<<3 | byte(client)
+	query = append(query, make([]byte, 20)...)
+	query[51] = 1
+	resp := s.Respond(query, nil, now)
+	if assert.Len(t, resp, 52) {
+		assert.Equal(t, []byte{0, 0, 0, 0}, resp[48:])
+	}
+}
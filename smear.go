@@ -0,0 +1,239 @@
+// Copyright © 2015-2023 Brett Vickers.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ntp
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// A Clock is a source of the current time.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+}
+
+// SmearShape selects the curve used to spread a leap second across a
+// smearing window.
+type SmearShape int
+
+const (
+	// SmearLinear spreads the leap second evenly across the window, causing
+	// the smeared clock to run at a constant, slightly altered rate.
+	SmearLinear SmearShape = iota
+
+	// SmearCosine spreads the leap second along a raised cosine curve,
+	// avoiding abrupt changes in the smeared clock's rate at the edges of
+	// the window.
+	SmearCosine
+)
+
+// A LeapSmear describes how a leap second is spread ("smeared") across a
+// window of time surrounding it, so that clocks never repeat or skip a
+// second. The zero value describes a linear smear over the 24 hours from
+// noon to noon (UTC) surrounding the leap second.
+type LeapSmear struct {
+	// Shape selects the smearing curve. Defaults to SmearLinear.
+	Shape SmearShape
+
+	// Before and After determine the portions of the smearing window that
+	// precede and follow the leap second. If both are zero, the window
+	// spans the 12 hours before and the 12 hours after the leap second.
+	Before time.Duration
+	After  time.Duration
+
+	// Func, if not nil, overrides Shape with a custom smearing curve. It is
+	// called with the fraction of the window elapsed, in the range [0,1],
+	// and must return the fraction of the leap second applied, increasing
+	// monotonically from 0 to 1.
+	Func func(x float64) float64
+}
+
+// window returns the portions of the smearing window before and after the
+// leap second.
+func (s *LeapSmear) window() (before, after time.Duration) {
+	if s.Before == 0 && s.After == 0 {
+		return 12 * time.Hour, 12 * time.Hour
+	}
+	return s.Before, s.After
+}
+
+// fraction returns the fraction of the leap second to be applied x of the
+// way through the smearing window.
+func (s *LeapSmear) fraction(x float64) float64 {
+	switch {
+	case s.Func != nil:
+		return s.Func(x)
+	case s.Shape == SmearCosine:
+		return (1 - math.Cos(math.Pi*x)) / 2
+	default:
+		return x
+	}
+}
+
+// Active returns true if the UTC time t falls within the smearing window
+// surrounding a leap second occurring at time leap.
+func (s *LeapSmear) Active(t, leap time.Time) bool {
+	before, after := s.window()
+	return !t.Before(leap.Add(-before)) && t.Before(leap.Add(after))
+}
+
+// Offset returns the correction to add to the UTC time t to obtain smeared
+// time, given a leap second of type li that occurs at the end of the day
+// preceding leap. The offset is zero outside the smearing window and for
+// leap indicators other than LeapAddSecond and LeapDelSecond.
+//
+// Because time.Time cannot represent an inserted leap second, UTC times
+// following an inserted leap second are one second "behind" the elapsed
+// time. The offset accounts for this, so smeared time advances smoothly
+// across the leap.
+func (s *LeapSmear) Offset(t, leap time.Time, li LeapIndicator) time.Duration {
+	var sign float64
+	switch li {
+	case LeapAddSecond:
+		sign = -1
+	case LeapDelSecond:
+		sign = 1
+	default:
+		return 0
+	}
+	if !s.Active(t, leap) {
+		return 0
+	}
+
+	before, after := s.window()
+	x := float64(t.Sub(leap.Add(-before))) / float64(before+after)
+	f := s.fraction(x)
+	if !t.Before(leap) {
+		// The UTC clock has already been stepped by the leap second.
+		f--
+	}
+	return time.Duration(math.Round(sign * f * float64(time.Second)))
+}
+
+// A SmearedClock is a Clock that reports the local system time corrected by
+// the clock offset measured in an NTP response, smearing leap seconds
+// announced by the server's leap indicator or scheduled in a leap table.
+// The times and offsets in a Response are never smeared, so a SmearedClock
+// is the source of smeared time for clients. It is safe for concurrent use.
+type SmearedClock struct {
+	// Smear configures how leap seconds are smeared.
+	Smear LeapSmear
+
+	// Base is the underlying clock. Defaults to the local system clock.
+	Base Clock
+
+	mu     sync.Mutex
+	offset time.Duration
+	leap   announcedLeap
+	table  *LeapTable
+}
+
+// An announcedLeap tracks the leap second announced by a series of leap
+// indicators, so that it can be smeared to completion after the
+// announcements stop.
+type announcedLeap struct {
+	time time.Time
+	li   LeapIndicator
+}
+
+// update records the leap indicator li, reported at time t. A leap second
+// is assumed to occur at the end of the month containing t. A pending
+// announcement is retracted only if smearing hasn't begun.
+func (a *announcedLeap) update(t time.Time, li LeapIndicator, smear *LeapSmear) {
+	switch li {
+	case LeapAddSecond, LeapDelSecond:
+		y, m, _ := t.UTC().Date()
+		a.time = time.Date(y, m+1, 1, 0, 0, 0, 0, time.UTC)
+		a.li = li
+	case LeapNoWarning:
+		before, _ := smear.window()
+		if a.li != LeapNoWarning && t.Before(a.time.Add(-before)) {
+			a.li = LeapNoWarning
+		}
+	}
+}
+
+// NewSmearedClock returns a SmearedClock that smears leap seconds as
+// described by smear.
+func NewSmearedClock(smear LeapSmear) *SmearedClock {
+	return &SmearedClock{Smear: smear}
+}
+
+// Update records the clock offset and leap indicator reported by the
+// response. A leap second announced by the response is assumed to occur at
+// the end of the month containing the response's transmit time. Once a leap
+// second has been announced, it is smeared to completion even if later
+// responses no longer announce it.
+func (c *SmearedClock) Update(r *Response) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.offset = r.ClockOffset
+	c.leap.update(r.Time, r.Leap, &c.Smear)
+}
+
+// SetLeapTable configures the clock to smear the leap seconds scheduled in
+// the table, in addition to those announced by NTP responses. A nil table
+// disables the use of a leap table.
+func (c *SmearedClock) SetLeapTable(t *LeapTable) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.table = t
+}
+
+// Now returns the current smeared time.
+func (c *SmearedClock) Now() time.Time {
+	t, offset := c.now()
+	return t.Add(offset)
+}
+
+// Smearing returns true if a leap second is currently being smeared, along
+// with the correction currently applied to the unsmeared time.
+func (c *SmearedClock) Smearing() (active bool, offset time.Duration) {
+	t, offset := c.now()
+	_, active = c.pendingLeap(t)
+	return active, offset
+}
+
+// now returns the current unsmeared time and the smearing offset to apply
+// to it.
+func (c *SmearedClock) now() (time.Time, time.Duration) {
+	var t time.Time
+	if c.Base != nil {
+		t = c.Base.Now()
+	} else {
+		t = time.Now()
+	}
+
+	c.mu.Lock()
+	t = t.Add(c.offset)
+	c.mu.Unlock()
+
+	leap, ok := c.pendingLeap(t)
+	if !ok {
+		return t, 0
+	}
+	return t, c.Smear.Offset(t, leap.Time, leap.Leap)
+}
+
+// pendingLeap returns the leap second whose smearing window contains the
+// time t, if any.
+func (c *SmearedClock) pendingLeap(t time.Time) (LeapEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.leap.li != LeapNoWarning && c.Smear.Active(t, c.leap.time) {
+		return LeapEntry{Time: c.leap.time, Leap: c.leap.li}, true
+	}
+	if c.table != nil {
+		_, after := c.Smear.window()
+		if e, ok := c.table.NextLeap(t.Add(-after)); ok && c.Smear.Active(t, e.Time) {
+			return e, true
+		}
+	}
+	return LeapEntry{}, false
+}
@@ -0,0 +1,151 @@
+// Copyright © 2015-2023 Brett Vickers.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ntp
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fixedClock struct {
+	t time.Time
+}
+
+func (c *fixedClock) Now() time.Time {
+	return c.t
+}
+
+func TestOfflineLeapSmearOffset(t *testing.T) {
+	leap := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	var linear LeapSmear
+	cases := []struct {
+		t      time.Time
+		offset time.Duration
+	}{
+		{leap.Add(-13 * time.Hour), 0},
+		{leap.Add(-12 * time.Hour), 0},
+		{leap.Add(-6 * time.Hour), -250 * time.Millisecond},
+		{leap.Add(-time.Nanosecond), -500 * time.Millisecond},
+		{leap, 500 * time.Millisecond},
+		{leap.Add(6 * time.Hour), 250 * time.Millisecond},
+		{leap.Add(12 * time.Hour), 0},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.offset, linear.Offset(c.t, leap, LeapAddSecond), c.t)
+		assert.Equal(t, -c.offset, linear.Offset(c.t, leap, LeapDelSecond), c.t)
+		assert.Equal(t, time.Duration(0), linear.Offset(c.t, leap, LeapNoWarning), c.t)
+	}
+
+	// Smeared time advances smoothly across an inserted leap second. UTC
+	// readings 1ms before and 1ms after the leap are 1.002s apart in
+	// elapsed time, and the smeared times differ by the same amount less
+	// the tiny portion of the leap second smeared in the interim.
+	before := leap.Add(-time.Millisecond)
+	after := leap.Add(time.Millisecond)
+	smearedBefore := before.Add(linear.Offset(before, leap, LeapAddSecond))
+	smearedAfter := after.Add(linear.Offset(after, leap, LeapAddSecond))
+	assert.InDelta(t, time.Second+2*time.Millisecond, smearedAfter.Sub(smearedBefore), 100)
+
+	cosine := LeapSmear{Shape: SmearCosine}
+	assert.Equal(t, -500*time.Millisecond, cosine.Offset(leap.Add(-time.Nanosecond), leap, LeapAddSecond))
+	assert.True(t, cosine.Offset(leap.Add(-6*time.Hour), leap, LeapAddSecond) > -250*time.Millisecond)
+
+	custom := LeapSmear{
+		Before: 0,
+		After:  10 * time.Hour,
+		Func:   func(x float64) float64 { return x * x },
+	}
+	assert.False(t, custom.Active(leap.Add(-time.Second), leap))
+	assert.True(t, custom.Active(leap, leap))
+	assert.Equal(t, time.Second, custom.Offset(leap, leap, LeapAddSecond))
+	assert.Equal(t, 750*time.Millisecond, custom.Offset(leap.Add(5*time.Hour), leap, LeapAddSecond))
+}
+
+func TestOfflineSmearedClock(t *testing.T) {
+	leap := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	base := &fixedClock{t: leap.Add(-6*time.Hour - time.Second)}
+	c := NewSmearedClock(LeapSmear{})
+	c.Base = base
+
+	// No leap announced.
+	active, _ := c.Smearing()
+	assert.False(t, active)
+	assert.Equal(t, base.t, c.Now())
+
+	// Leap announced via the response's leap indicator.
+	c.Update(&Response{
+		Time:        time.Date(2016, 12, 31, 10, 0, 0, 0, time.UTC),
+		ClockOffset: time.Second,
+		Leap:        LeapAddSecond,
+	})
+	active, offset := c.Smearing()
+	assert.True(t, active)
+	assert.Equal(t, -250*time.Millisecond, offset)
+	assert.Equal(t, base.t.Add(time.Second-250*time.Millisecond), c.Now())
+
+	// The announcement is retained once smearing has begun.
+	c.Update(&Response{Time: leap.Add(time.Hour), ClockOffset: time.Second})
+	active, _ = c.Smearing()
+	assert.True(t, active)
+
+	// Leap scheduled via a leap table.
+	c = NewSmearedClock(LeapSmear{})
+	c.Base = base
+	c.SetLeapTable(loadTestLeapTable(t))
+	base.t = leap.Add(6 * time.Hour)
+	active, offset = c.Smearing()
+	assert.True(t, active)
+	assert.Equal(t, 250*time.Millisecond, offset)
+
+	base.t = leap.Add(13 * time.Hour)
+	active, offset = c.Smearing()
+	assert.False(t, active)
+	assert.Equal(t, time.Duration(0), offset)
+}
+
+func TestOfflineServerSmear(t *testing.T) {
+	leap := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := &fixedClock{t: leap.Add(-6 * time.Hour)}
+	s := NewServer(ServerState{})
+	s.Clock = clock
+	s.SetState(ServerState{Stratum: 1, Leap: LeapAddSecond})
+
+	query := make([]byte, 48)
+	query[0] = 4<<3 | byte(client)
+	respond := func() *header {
+		h := new(header)
+		resp := s.Respond(query, &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 123}, clock.t)
+		if assert.Len(t, resp, 48) {
+			h.unmarshal(resp)
+		}
+		return h
+	}
+
+	// Without smearing, the leap second is announced.
+	h := respond()
+	assert.Equal(t, LeapIndicator(LeapAddSecond), h.getLeap())
+	assert.Equal(t, toNtpTime(clock.t), h.TransmitTime)
+
+	// With smearing, it is applied to the times served instead.
+	s.Smear = &LeapSmear{}
+	h = respond()
+	assert.Equal(t, LeapNoWarning, h.getLeap())
+	assert.Equal(t, toNtpTime(clock.t.Add(-250*time.Millisecond)), h.TransmitTime)
+	assert.Equal(t, toNtpTime(clock.t.Add(-250*time.Millisecond)), h.ReceiveTime)
+
+	// Smearing continues after the announcement is withdrawn.
+	clock.t = leap.Add(6 * time.Hour)
+	s.SetState(ServerState{Stratum: 1})
+	h = respond()
+	assert.Equal(t, toNtpTime(clock.t.Add(250*time.Millisecond)), h.TransmitTime)
+
+	clock.t = leap.Add(13 * time.Hour)
+	h = respond()
+	assert.Equal(t, toNtpTime(clock.t), h.TransmitTime)
+}
@@ -0,0 +1,424 @@
+// Copyright © 2015-2023 Brett Vickers.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ntp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Status handler defaults.
+const (
+	defaultStatusInterval = 64 * time.Second
+	defaultStatusHistory  = 64
+	defaultStatusMaxAge   = 3 // intervals
+)
+
+// errNoResponse is recorded when a query returns neither a response nor an
+// error.
+var errNoResponse = errors.New("no response")
+
+// A StatusHandler tracks the time synchronization state reported by a set
+// of NTP servers and renders it over HTTP, for use as a debugging endpoint.
+// For each server it shows the last response, the result of validating it,
+// and a history of measured clock offsets. The view is served as an HTML
+// page, or as JSON if the request's Accept header asks for
+// application/json or its query string holds format=json.
+//
+// Servers may be queried by the handler itself, using Poll or Run, or the
+// results of queries made elsewhere may be recorded using Observe.
+// HealthHandler returns a companion handler suitable for a health check.
+// A StatusHandler is safe for concurrent use.
+type StatusHandler struct {
+	// Servers lists the addresses of the servers queried by Poll.
+	Servers []string
+
+	// Options holds the options used to query the servers.
+	Options QueryOptions
+
+	// Policy, if not nil, is used to validate responses. Otherwise,
+	// Response.Validate is used.
+	Policy *ValidationPolicy
+
+	// Interval is the time between polls made by Run. Defaults to 64
+	// seconds.
+	Interval time.Duration
+
+	// History is the number of clock offsets retained for each server.
+	// Defaults to 64.
+	History int
+
+	// MaxOffset and MaxRootDistance are the health check's limits on the
+	// absolute clock offset and root distance of a server's last response.
+	// A zero limit is not checked.
+	MaxOffset       time.Duration
+	MaxRootDistance time.Duration
+
+	// MaxAge is the age beyond which a server's last response no longer
+	// counts towards the health check, so that the check fails if polling
+	// stops. Defaults to three times Interval.
+	MaxAge time.Duration
+
+	mu      sync.Mutex
+	order   []string
+	servers map[string]*serverStatus
+}
+
+// serverStatus holds the state recorded for a single server.
+type serverStatus struct {
+	updated  time.Time
+	response *Response
+	err      error // query error
+	invalid  error // validation error
+	history  []offsetSample
+}
+
+// An offsetSample is a clock offset measured at a point in time.
+type offsetSample struct {
+	Time   time.Time `json:"time"`
+	Offset float64   `json:"offset"`
+}
+
+// NewStatusHandler returns a status handler for the servers.
+func NewStatusHandler(servers ...string) *StatusHandler {
+	return &StatusHandler{Servers: servers}
+}
+
+// Run polls the servers every Interval until ctx is done. It returns
+// ctx.Err().
+func (h *StatusHandler) Run(ctx context.Context) error {
+	t := time.NewTicker(durationOrDefault(h.Interval, defaultStatusInterval))
+	defer t.Stop()
+	for {
+		h.Poll()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// Poll queries each of the servers once, in parallel, and records the
+// results.
+func (h *StatusHandler) Poll() {
+	var wg sync.WaitGroup
+	for _, addr := range h.Servers {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			r, err := QueryWithOptions(addr, h.Options)
+			h.Observe(addr, r, err)
+		}(addr)
+	}
+	wg.Wait()
+}
+
+// Observe records the result of a query of server, as returned by
+// QueryWithOptions. Servers not listed in Servers are shown after the
+// listed servers, in the order they were first observed.
+func (h *StatusHandler) Observe(server string, r *Response, err error) {
+	if err == nil && r == nil {
+		err = errNoResponse
+	}
+	var invalid error
+	if err == nil {
+		if h.Policy != nil {
+			invalid = r.ValidateWithPolicy(h.Policy).Err()
+		} else {
+			invalid = r.Validate()
+		}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := h.status(server)
+	s.updated = time.Now()
+	s.err, s.invalid = err, invalid
+	if err != nil {
+		return
+	}
+	s.response = r
+	if !r.IsKissOfDeath() {
+		s.history = append(s.history, offsetSample{s.updated, r.ClockOffset.Seconds()})
+		if n := h.historyLen(); len(s.history) > n {
+			s.history = append(s.history[:0], s.history[len(s.history)-n:]...)
+		}
+	}
+}
+
+// status returns the state recorded for server, creating it if necessary.
+// It must be called with h.mu held.
+func (h *StatusHandler) status(server string) *serverStatus {
+	if h.servers == nil {
+		h.servers = make(map[string]*serverStatus)
+	}
+	s, ok := h.servers[server]
+	if !ok {
+		s = &serverStatus{}
+		h.servers[server] = s
+		h.order = append(h.order, server)
+	}
+	return s
+}
+
+func (h *StatusHandler) historyLen() int {
+	if h.History > 0 {
+		return h.History
+	}
+	return defaultStatusHistory
+}
+
+// Status types rendered as JSON.
+type (
+	statusView struct {
+		Time    time.Time          `json:"time"`
+		Healthy bool               `json:"healthy"`
+		Reason  string             `json:"reason,omitempty"`
+		Servers []serverStatusView `json:"servers"`
+	}
+
+	serverStatusView struct {
+		Server          string         `json:"server"`
+		Updated         *time.Time     `json:"updated,omitempty"`
+		Error           string         `json:"error,omitempty"`
+		Valid           bool           `json:"valid"`
+		ValidationError string         `json:"validation_error,omitempty"`
+		Response        *responseView  `json:"response,omitempty"`
+		History         []offsetSample `json:"history"`
+		Sparkline       template.HTML  `json:"-"`
+	}
+
+	// responseView holds the fields of a Response. Durations are expressed
+	// in seconds.
+	responseView struct {
+		Time           time.Time `json:"time"`
+		ClockOffset    float64   `json:"clock_offset"`
+		RTT            float64   `json:"rtt"`
+		Precision      float64   `json:"precision"`
+		Version        int       `json:"version"`
+		Stratum        uint8     `json:"stratum"`
+		ReferenceID    string    `json:"reference_id"`
+		ReferenceTime  time.Time `json:"reference_time"`
+		RootDelay      float64   `json:"root_delay"`
+		RootDispersion float64   `json:"root_dispersion"`
+		RootDistance   float64   `json:"root_distance"`
+		Leap           uint8     `json:"leap"`
+		MinError       float64   `json:"min_error"`
+		KissCode       string    `json:"kiss_code,omitempty"`
+		Poll           float64   `json:"poll"`
+	}
+)
+
+// view returns a snapshot of the handler's state.
+func (h *StatusHandler) view() *statusView {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// List the configured servers first, even if not yet queried.
+	names := append([]string(nil), h.Servers...)
+	listed := make(map[string]bool)
+	for _, s := range names {
+		listed[s] = true
+	}
+	for _, s := range h.order {
+		if !listed[s] {
+			names = append(names, s)
+		}
+	}
+
+	v := &statusView{Time: time.Now(), Servers: []serverStatusView{}}
+	for _, name := range names {
+		sv := serverStatusView{Server: name, History: []offsetSample{}}
+		if s, ok := h.servers[name]; ok {
+			updated := s.updated
+			sv.Updated = &updated
+			sv.Error = errString(s.err)
+			sv.Valid = s.err == nil && s.invalid == nil
+			sv.ValidationError = errString(s.invalid)
+			sv.History = append(sv.History, s.history...)
+			if r := s.response; r != nil && s.err == nil {
+				sv.Response = &responseView{
+					Time:           r.Time,
+					ClockOffset:    r.ClockOffset.Seconds(),
+					RTT:            r.RTT.Seconds(),
+					Precision:      r.Precision.Seconds(),
+					Version:        r.Version,
+					Stratum:        r.Stratum,
+					ReferenceID:    r.ReferenceString(),
+					ReferenceTime:  r.ReferenceTime,
+					RootDelay:      r.RootDelay.Seconds(),
+					RootDispersion: r.RootDispersion.Seconds(),
+					RootDistance:   r.RootDistance.Seconds(),
+					Leap:           uint8(r.Leap),
+					MinError:       r.MinError.Seconds(),
+					KissCode:       r.KissCode,
+					Poll:           r.Poll.Seconds(),
+				}
+			}
+		}
+		v.Servers = append(v.Servers, sv)
+	}
+	v.Reason = h.unhealthy(v.Time)
+	v.Healthy = v.Reason == ""
+	return v
+}
+
+// unhealthy returns the reason the health check fails at time now, or the
+// empty string if it passes. The check passes if the last query of at least
+// one server, made within MaxAge, produced a valid response within the
+// configured limits. It must be called with h.mu held.
+func (h *StatusHandler) unhealthy(now time.Time) string {
+	if len(h.servers) == 0 {
+		return "no servers queried"
+	}
+
+	maxAge := h.MaxAge
+	if maxAge <= 0 {
+		maxAge = defaultStatusMaxAge * durationOrDefault(h.Interval, defaultStatusInterval)
+	}
+
+	var reasons []string
+	for _, name := range h.order {
+		s := h.servers[name]
+		var reason string
+		switch {
+		case s.err != nil:
+			reason = s.err.Error()
+		case s.invalid != nil:
+			reason = s.invalid.Error()
+		case now.Sub(s.updated) > maxAge:
+			reason = fmt.Sprintf("last queried %v ago", now.Sub(s.updated).Round(time.Second))
+		case h.MaxOffset > 0 && absDuration(s.response.ClockOffset) > h.MaxOffset:
+			reason = fmt.Sprintf("clock offset %v exceeds %v", s.response.ClockOffset, h.MaxOffset)
+		case h.MaxRootDistance > 0 && s.response.RootDistance > h.MaxRootDistance:
+			reason = fmt.Sprintf("root distance %v exceeds %v", s.response.RootDistance, h.MaxRootDistance)
+		default:
+			return ""
+		}
+		reasons = append(reasons, name+": "+reason)
+	}
+	return strings.Join(reasons, "; ")
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// ServeHTTP renders the time synchronization view as HTML or JSON.
+func (h *StatusHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	v := h.view()
+	if req.URL.Query().Get("format") == "json" ||
+		strings.Contains(req.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(v)
+		return
+	}
+
+	for i := range v.Servers {
+		v.Servers[i].Sparkline = sparkline(v.Servers[i].History)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	statusTemplate.Execute(w, v)
+}
+
+// HealthHandler returns a handler that responds with status 200 if the
+// time synchronization state is healthy, and 503 otherwise. It is healthy
+// if the last query of at least one server, made within MaxAge, produced a
+// valid response whose clock offset and root distance are within MaxOffset
+// and MaxRootDistance.
+func (h *StatusHandler) HealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		h.mu.Lock()
+		reason := h.unhealthy(time.Now())
+		h.mu.Unlock()
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if reason != "" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "unhealthy: %s\n", reason)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+}
+
+// sparkline returns an inline SVG plotting the offset history.
+func sparkline(history []offsetSample) template.HTML {
+	const width, height = 120, 20
+	if len(history) < 2 {
+		return ""
+	}
+	lo, hi := history[0].Offset, history[0].Offset
+	for _, s := range history {
+		if s.Offset < lo {
+			lo = s.Offset
+		}
+		if s.Offset > hi {
+			hi = s.Offset
+		}
+	}
+	span := hi - lo
+	if span == 0 {
+		span = 1
+	}
+
+	var pts strings.Builder
+	for i, s := range history {
+		x := float64(i) * width / float64(len(history)-1)
+		y := height - (s.Offset-lo)/span*height
+		fmt.Fprintf(&pts, "%.1f,%.1f ", x, y)
+	}
+	return template.HTML(fmt.Sprintf(
+		`<svg width="%d" height="%d"><polyline fill="none" stroke="currentColor" points="%s"/></svg>`,
+		width, height, strings.TrimSpace(pts.String())))
+}
+
+var statusTemplate = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>NTP status</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; }
+th, td { padding: 4px 8px; text-align: left; border-bottom: 1px solid #ddd; }
+.bad { color: #b00; }
+</style>
+</head>
+<body>
+<h1>NTP status</h1>
+<p>{{if .Healthy}}Healthy{{else}}<span class="bad">Unhealthy: {{.Reason}}</span>{{end}} as of {{.Time.Format "2006-01-02 15:04:05 MST"}}</p>
+<table>
+<tr><th>Server</th><th>Status</th><th>Offset</th><th>RTT</th><th>Stratum</th><th>Reference</th><th>Root distance</th><th>Leap</th><th>Updated</th><th>Offset history</th></tr>
+{{range .Servers}}<tr>
+<td>{{.Server}}</td>
+<td>{{if .Error}}<span class="bad">{{.Error}}</span>{{else if .ValidationError}}<span class="bad">{{.ValidationError}}</span>{{else if .Updated}}valid{{else}}not queried{{end}}</td>
+{{with .Response}}<td>{{.ClockOffset}}s</td><td>{{.RTT}}s</td><td>{{.Stratum}}</td><td>{{.ReferenceID}}</td><td>{{.RootDistance}}s</td><td>{{.Leap}}</td>{{else}}<td></td><td></td><td></td><td></td><td></td><td></td>{{end}}
+<td>{{with .Updated}}{{.Format "15:04:05"}}{{end}}</td>
+<td>{{.Sparkline}}</td>
+</tr>
+{{end}}</table>
+</body>
+</html>
+`))
@@ -0,0 +1,152 @@
+// Copyright © 2015-2023 Brett Vickers.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ntp
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func get(t *testing.T, h http.Handler, target, accept string) (int, string, string) {
+	t.Helper()
+	req := httptest.NewRequest("GET", target, nil)
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	body, _ := io.ReadAll(w.Result().Body)
+	return w.Code, w.Header().Get("Content-Type"), string(body)
+}
+
+func TestOfflineStatusHandler(t *testing.T) {
+	s := NewServer(ServerState{Stratum: 2, ReferenceID: 0xc0000201})
+	s.Clock = &offsetClock{250 * time.Millisecond}
+	addr := startTestServer(t, s)
+
+	h := NewStatusHandler(addr, "192.0.2.1")
+	h.Options = QueryOptions{Timeout: time.Second}
+	h.History = 3
+	health := h.HealthHandler()
+
+	code, _, body := get(t, health, "/healthz", "")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Contains(t, body, "no servers queried")
+
+	for i := 0; i < 4; i++ {
+		r, err := QueryWithOptions(addr, h.Options)
+		h.Observe(addr, r, err)
+	}
+	h.Observe("192.0.2.1", nil, &QueryError{Server: "192.0.2.1", Op: "read", Err: ErrServerClosed})
+
+	code, typ, body := get(t, h, "/debug/ntp?format=json", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "application/json", typ)
+	var v struct {
+		Healthy bool
+		Servers []struct {
+			Server   string
+			Valid    bool
+			Error    string
+			Response *struct {
+				ClockOffset float64 `json:"clock_offset"`
+				Stratum     uint8
+				ReferenceID string `json:"reference_id"`
+			}
+			History []struct{ Offset float64 }
+		}
+	}
+	if assert.Nil(t, json.Unmarshal([]byte(body), &v)) && assert.Len(t, v.Servers, 2) {
+		assert.True(t, v.Healthy)
+		s0, s1 := v.Servers[0], v.Servers[1]
+		assert.Equal(t, addr, s0.Server)
+		assert.True(t, s0.Valid)
+		if assert.NotNil(t, s0.Response) {
+			assert.InDelta(t, 0.25, s0.Response.ClockOffset, 0.01)
+			assert.Equal(t, uint8(2), s0.Response.Stratum)
+			assert.Equal(t, "192.0.2.1", s0.Response.ReferenceID)
+		}
+		assert.Len(t, s0.History, 3)
+		assert.Equal(t, "192.0.2.1", s1.Server)
+		assert.False(t, s1.Valid)
+		assert.Contains(t, s1.Error, "read")
+		assert.Nil(t, s1.Response)
+	}
+
+	// The same view is rendered as HTML, and as JSON on request.
+	code, typ, body = get(t, h, "/debug/ntp", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.True(t, strings.HasPrefix(typ, "text/html"))
+	assert.Contains(t, body, "<td>"+addr+"</td>")
+	assert.Contains(t, body, "<polyline")
+	assert.Contains(t, body, "server closed")
+	_, typ, _ = get(t, h, "/debug/ntp", "application/json")
+	assert.Equal(t, "application/json", typ)
+
+	code, _, body = get(t, health, "/healthz", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ok\n", body)
+
+	// The health check fails when every server exceeds the limits.
+	h.MaxOffset = 100 * time.Millisecond
+	code, _, body = get(t, health, "/healthz", "")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Contains(t, body, "clock offset")
+	h.MaxOffset = 0
+	h.MaxRootDistance = time.Nanosecond
+	code, _, body = get(t, health, "/healthz", "")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Contains(t, body, "root distance")
+	h.MaxRootDistance = 0
+
+	// The health check fails once the last responses are too old.
+	h.mu.Lock()
+	for _, s := range h.servers {
+		s.updated = s.updated.Add(-time.Hour)
+	}
+	h.mu.Unlock()
+	code, _, body = get(t, health, "/healthz", "")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Contains(t, body, "last queried 1h0m0s ago")
+	h.MaxAge = 2 * time.Hour
+	code, _, _ = get(t, health, "/healthz", "")
+	assert.Equal(t, http.StatusOK, code)
+}
+
+func TestOfflineStatusNoResponse(t *testing.T) {
+	h := NewStatusHandler()
+	h.MaxOffset = time.Second
+	h.MaxRootDistance = time.Second
+	h.Observe("192.0.2.1", nil, nil)
+
+	v := h.view()
+	if assert.Len(t, v.Servers, 1) {
+		assert.False(t, v.Servers[0].Valid)
+		assert.Equal(t, "no response", v.Servers[0].Error)
+	}
+	assert.False(t, v.Healthy)
+}
+
+func TestOfflineStatusPoll(t *testing.T) {
+	addr := startTestServer(t, NewServer(ServerState{Stratum: 16}))
+	h := NewStatusHandler(addr)
+	h.Options = QueryOptions{Timeout: time.Second}
+	h.Poll()
+
+	v := h.view()
+	if assert.Len(t, v.Servers, 1) {
+		assert.False(t, v.Servers[0].Valid)
+		assert.Contains(t, v.Servers[0].ValidationError, "stratum")
+		assert.NotNil(t, v.Servers[0].Response)
+	}
+	assert.False(t, v.Healthy)
+}
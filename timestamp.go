@@ -0,0 +1,224 @@
+// Copyright © 2015-2023 Brett Vickers.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ntp
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Era-related constants.
+const (
+	// Number of seconds in an NTP era.
+	eraSeconds = 1 << 32
+
+	// Number of seconds between the start of NTP era 0 (1900-01-01) and the
+	// Unix epoch (1970-01-01).
+	unixToNtp = 2208988800
+)
+
+// defaultPivot is the pivot time used by the package when converting
+// timestamps to absolute times. Timestamps are interpreted as falling in
+// the range [1970-01-01, 2106-02-07), which spans the NTP era 0 to era 1
+// rollover in 2036.
+var defaultPivot = time.Unix(1<<31, 0)
+
+// A Timestamp is a 64-bit fixed-point (Q32.32) NTP timestamp. The upper 32
+// bits hold the number of seconds elapsed since the start of the timestamp's
+// NTP era, and the lower 32 bits hold the fractional second. Era 0 began on
+// 1900-01-01 and era 1 begins on 2036-02-07. Because a Timestamp does not
+// record its era, converting it to an absolute time requires a pivot time
+// or an explicit era number.
+type Timestamp uint64
+
+// NewTimestamp converts the time t into a Timestamp. Times outside NTP era
+// 0 are reduced modulo the era length; use Era to obtain the era number.
+func NewTimestamp(t time.Time) Timestamp {
+	_, sec := eraSplit(t.Unix() + unixToNtp)
+	frac := (uint64(t.Nanosecond())<<32 + nanoPerSec/2) / nanoPerSec
+	return Timestamp(uint64(sec)<<32 + frac)
+}
+
+// Era returns the NTP era number of the time t. Era 0 spans 1900-01-01 to
+// 2036-02-07, era 1 spans 2036-02-07 to 2172-03-15, and so on. Times before
+// 1900 have negative era numbers.
+func Era(t time.Time) int {
+	era, _ := eraSplit(t.Unix() + unixToNtp)
+	return int(era)
+}
+
+// eraSplit splits a count of seconds since the start of NTP era 0 into an
+// era number and the number of seconds elapsed within the era.
+func eraSplit(sec int64) (era int64, offset uint32) {
+	era = sec >> 32 // arithmetic shift rounds toward negative infinity
+	return era, uint32(sec - era*eraSeconds)
+}
+
+// Seconds returns the integral number of seconds elapsed within the
+// timestamp's era.
+func (t Timestamp) Seconds() uint32 {
+	return uint32(t >> 32)
+}
+
+// Fraction returns the fractional second portion of the timestamp, in units
+// of 2^-32 seconds.
+func (t Timestamp) Fraction() uint32 {
+	return uint32(t)
+}
+
+// TimeInEra returns the absolute time represented by the timestamp, assuming
+// it falls within the requested NTP era.
+func (t Timestamp) TimeInEra(era int) time.Time {
+	sec := int64(era)*eraSeconds + int64(t.Seconds()) - unixToNtp
+	return time.Unix(sec, int64(fracToNano(t.Fraction()))).UTC()
+}
+
+// Time returns the absolute time represented by the timestamp. The era is
+// chosen so that the returned time lies within 68 years (2^31 seconds) of
+// the pivot time, in the range [pivot-2^31s, pivot+2^31s).
+func (t Timestamp) Time(pivot time.Time) time.Time {
+	era := Era(pivot)
+	_, pivotSec := eraSplit(pivot.Unix() + unixToNtp)
+	delta := int64(int32(t.Seconds() - pivotSec))
+	switch {
+	case int64(pivotSec)+delta < 0:
+		era--
+	case int64(pivotSec)+delta >= eraSeconds:
+		era++
+	}
+	return t.TimeInEra(era)
+}
+
+// Sub returns the signed duration t-u. The two timestamps are assumed to lie
+// within 68 years of each other, which allows the difference to be computed
+// accurately even when they fall in neighboring NTP eras.
+//
+// See: https://www.eecis.udel.edu/~mills/y2k.html
+func (t Timestamp) Sub(u Timestamp) time.Duration {
+	d := int64(t - u)
+	if d < 0 {
+		return -ntpTime(-d).Duration()
+	}
+	return ntpTime(d).Duration()
+}
+
+// Add returns the timestamp t+d, wrapping around at the end of the era.
+func (t Timestamp) Add(d time.Duration) Timestamp {
+	if d < 0 {
+		return t - Timestamp(durationToFixed(-d, 32))
+	}
+	return t + Timestamp(durationToFixed(d, 32))
+}
+
+// String formats the timestamp as two 8-digit hexadecimal numbers holding
+// the seconds and fraction, separated by a period. This is the format used
+// by ntpq to display timestamps (e.g., "e5a1b2c3.1a2b3c4d").
+func (t Timestamp) String() string {
+	return fmt.Sprintf("%08x.%08x", t.Seconds(), t.Fraction())
+}
+
+// ParseTimestamp parses a timestamp in the hexadecimal "seconds.fraction"
+// format produced by Timestamp.String. An optional "0x" prefix is permitted.
+func ParseTimestamp(s string) (Timestamp, error) {
+	sec, frac, err := parseHexFixed(s, 32)
+	if err != nil {
+		return 0, err
+	}
+	return Timestamp(sec<<32 | frac), nil
+}
+
+// A ShortTimestamp is a 32-bit fixed-point (Q16.16) NTP short format value,
+// used by NTP packets to report root delay and root dispersion. The upper 16
+// bits hold the number of seconds, and the lower 16 bits hold the fractional
+// second.
+type ShortTimestamp uint32
+
+// NewShortTimestamp converts the non-negative duration d into a
+// ShortTimestamp. Durations too large to represent are clamped to the
+// largest representable value.
+func NewShortTimestamp(d time.Duration) ShortTimestamp {
+	if d < 0 {
+		return 0
+	}
+	v := durationToFixed(d, 16)
+	if v > 0xffffffff {
+		return 0xffffffff
+	}
+	return ShortTimestamp(v)
+}
+
+// Seconds returns the integral number of seconds in the short timestamp.
+func (t ShortTimestamp) Seconds() uint16 {
+	return uint16(t >> 16)
+}
+
+// Fraction returns the fractional second portion of the short timestamp, in
+// units of 2^-16 seconds.
+func (t ShortTimestamp) Fraction() uint16 {
+	return uint16(t)
+}
+
+// Duration returns the duration represented by the short timestamp.
+func (t ShortTimestamp) Duration() time.Duration {
+	return ntpTimeShort(t).Duration()
+}
+
+// String formats the short timestamp as two 4-digit hexadecimal numbers
+// holding the seconds and fraction, separated by a period (e.g.,
+// "0001.8000").
+func (t ShortTimestamp) String() string {
+	return fmt.Sprintf("%04x.%04x", t.Seconds(), t.Fraction())
+}
+
+// ParseShortTimestamp parses a short timestamp in the hexadecimal
+// "seconds.fraction" format produced by ShortTimestamp.String.
+func ParseShortTimestamp(s string) (ShortTimestamp, error) {
+	sec, frac, err := parseHexFixed(s, 16)
+	if err != nil {
+		return 0, err
+	}
+	return ShortTimestamp(sec<<16 | frac), nil
+}
+
+// fracToNano converts a 32-bit binary fraction of a second into a rounded
+// number of nanoseconds.
+func fracToNano(frac uint32) uint64 {
+	nsec := uint64(frac) * nanoPerSec
+	return (nsec + 0x80000000) >> 32
+}
+
+// durationToFixed converts the non-negative duration d into an unsigned
+// fixed-point value having the requested number of fraction bits, rounding
+// to the nearest representable value.
+func durationToFixed(d time.Duration, fracBits uint) uint64 {
+	sec := uint64(d) / nanoPerSec
+	nsec := uint64(d) % nanoPerSec
+	frac := (nsec<<fracBits + nanoPerSec/2) / nanoPerSec
+	return sec<<fracBits + frac
+}
+
+// parseHexFixed parses a "seconds.fraction" hexadecimal string where each
+// part holds the given number of bits.
+func parseHexFixed(s string, bits int) (sec, frac uint64, err error) {
+	in := strings.TrimPrefix(strings.TrimPrefix(s, "0x"), "0X")
+	dot := strings.IndexByte(in, '.')
+	if dot < 0 {
+		return 0, 0, fmt.Errorf("invalid timestamp %q: %w", s, errMissingFraction)
+	}
+	sec, err = strconv.ParseUint(in[:dot], 16, bits)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid timestamp %q: %w", s, err)
+	}
+	frac, err = strconv.ParseUint(in[dot+1:], 16, bits)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid timestamp %q: %w", s, err)
+	}
+	return sec, frac, nil
+}
+
+var errMissingFraction = errors.New("missing '.' separator")
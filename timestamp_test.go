@@ -0,0 +1,107 @@
+// Copyright © 2015-2023 Brett Vickers.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ntp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOfflineTimestampEra(t *testing.T) {
+	cases := []struct {
+		time string
+		era  int
+		ts   Timestamp
+	}{
+		{"1899-12-31 23:59:59", -1, 0xffffffff00000000},
+		{"1900-01-01 00:00:00", 0, 0x0000000000000000},
+		{"1970-01-01 00:00:00", 0, 0x83aa7e8000000000},
+		{"2036-02-07 06:28:15", 0, 0xffffffff00000000},
+		{"2036-02-07 06:28:16", 1, 0x0000000000000000},
+		{"2172-03-15 12:56:32", 2, 0x0000000000000000},
+		{"2300-01-01 00:00:00", 2, 0xf060598000000000},
+	}
+
+	const timeFormat = "2006-01-02 15:04:05"
+	for _, c := range cases {
+		tm, _ := time.Parse(timeFormat, c.time)
+		assert.Equal(t, c.era, Era(tm), c.time)
+		assert.Equal(t, c.ts, NewTimestamp(tm), c.time)
+		assert.Equal(t, tm, c.ts.TimeInEra(c.era), c.time)
+		assert.Equal(t, tm, c.ts.Time(tm.Add(1000*time.Hour)), c.time)
+	}
+}
+
+func TestOfflineTimestampPivot(t *testing.T) {
+	pivot := time.Date(2036, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, d := range []time.Duration{
+		0,
+		time.Second,
+		-time.Second,
+		24 * time.Hour,
+		60 * 365 * 24 * time.Hour,
+		-60 * 365 * 24 * time.Hour,
+	} {
+		tm := pivot.Add(d).Add(250 * time.Millisecond)
+		assert.Equal(t, tm, NewTimestamp(tm).Time(pivot))
+	}
+}
+
+func TestOfflineTimestampSub(t *testing.T) {
+	t0 := time.Date(2036, 2, 7, 6, 28, 10, 0, time.UTC)
+	t1 := t0.Add(10*time.Second + 500*time.Millisecond)
+	ts0, ts1 := NewTimestamp(t0), NewTimestamp(t1)
+
+	assert.True(t, ts1 < ts0) // era rollover
+	assert.Equal(t, 10*time.Second+500*time.Millisecond, ts1.Sub(ts0))
+	assert.Equal(t, -10*time.Second-500*time.Millisecond, ts0.Sub(ts1))
+	assert.Equal(t, ts1, ts0.Add(10*time.Second+500*time.Millisecond))
+	assert.Equal(t, ts0, ts1.Add(-10*time.Second-500*time.Millisecond))
+}
+
+func TestOfflineTimestampString(t *testing.T) {
+	ts := Timestamp(0xe5a1b2c31a2b3c4d)
+	assert.Equal(t, "e5a1b2c3.1a2b3c4d", ts.String())
+	assert.Equal(t, "00000000.00000000", Timestamp(0).String())
+
+	parsed, err := ParseTimestamp("e5a1b2c3.1a2b3c4d")
+	assert.Nil(t, err)
+	assert.Equal(t, ts, parsed)
+
+	parsed, err = ParseTimestamp("0xe5a1b2c3.1a2b3c4d")
+	assert.Nil(t, err)
+	assert.Equal(t, ts, parsed)
+
+	for _, s := range []string{"", "e5a1b2c3", "e5a1b2c3.", "1e5a1b2c3.00000000", "e5a1b2c3.1a2b3c4g"} {
+		_, err = ParseTimestamp(s)
+		assert.NotNil(t, err, s)
+	}
+}
+
+func TestOfflineShortTimestamp(t *testing.T) {
+	cases := []struct {
+		ts  ShortTimestamp
+		d   time.Duration
+		str string
+	}{
+		{0x00000000, 0, "0000.0000"},
+		{0x00008000, 500 * time.Millisecond, "0000.8000"},
+		{0x00018000, 1500 * time.Millisecond, "0001.8000"},
+		{0xffff0000, 65535 * time.Second, "ffff.0000"},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.d, c.ts.Duration())
+		assert.Equal(t, c.ts, NewShortTimestamp(c.d))
+		assert.Equal(t, c.str, c.ts.String())
+		parsed, err := ParseShortTimestamp(c.str)
+		assert.Nil(t, err)
+		assert.Equal(t, c.ts, parsed)
+	}
+
+	assert.Equal(t, ShortTimestamp(0), NewShortTimestamp(-time.Second))
+	assert.Equal(t, ShortTimestamp(0xffffffff), NewShortTimestamp(100000*time.Second))
+}
@@ -0,0 +1,274 @@
+// Copyright © 2015-2023 Brett Vickers.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ntp
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+)
+
+// A ClientTrace is a set of hooks called at each stage of a query made with
+// QueryWithOptions, in the manner of net/http/httptrace. It allows the time
+// spent resolving, dialing, waiting for and checking a response to be fed
+// to tracing systems. Any hook may be nil. Each hook receives the system
+// time at which the event occurred.
+//
+// Hooks are called synchronously by the goroutine making the query, so they
+// should return quickly. A ClientTrace may be shared by concurrent queries
+// if its hooks are safe for concurrent use.
+type ClientTrace struct {
+	// DNSStart is called before the server's host name is resolved. It is
+	// not called if the host is an IP address, or if QueryOptions specifies
+	// a custom dialer, which is responsible for its own resolution.
+	DNSStart func(DNSStartInfo)
+
+	// DNSDone is called after the server's host name has been resolved.
+	DNSDone func(DNSDoneInfo)
+
+	// DialDone is called after the connection to the server has been
+	// opened, or has failed to open.
+	DialDone func(DialDoneInfo)
+
+	// ExtensionDone is called after each extension has processed the query
+	// or the response.
+	ExtensionDone func(ExtensionDoneInfo)
+
+	// WroteQuery is called after the query packet has been written.
+	WroteQuery func(WroteQueryInfo)
+
+	// ReadResponse is called after a response packet has been read, or the
+	// read has failed.
+	ReadResponse func(ReadResponseInfo)
+
+	// Validated is called after the response has been checked. Responses
+	// that do not match the query are reported with the error that caused
+	// the query to fail. Otherwise, the result of Response.Validate is
+	// reported.
+	Validated func(ValidatedInfo)
+
+	// AuthDone is called after the MAC of the response has been verified,
+	// for queries using symmetric key authentication.
+	AuthDone func(AuthDoneInfo)
+}
+
+// DNSStartInfo is passed to ClientTrace.DNSStart.
+type DNSStartInfo struct {
+	Time time.Time
+	Host string
+}
+
+// DNSDoneInfo is passed to ClientTrace.DNSDone.
+type DNSDoneInfo struct {
+	Time time.Time
+
+	// Addrs holds the addresses the host name resolved to. The query is
+	// sent to the first address in the family of QueryOptions.LocalAddress
+	// if it is set, and otherwise to the first IPv4 address, or the first
+	// address if there are no IPv4 addresses.
+	Addrs []net.IPAddr
+
+	// Err is the error that occurred resolving the host name, if any.
+	Err error
+}
+
+// DialDoneInfo is passed to ClientTrace.DialDone.
+type DialDoneInfo struct {
+	Time time.Time
+
+	// LocalAddr and RemoteAddr are the addresses of the connection's
+	// endpoints. They are nil if the dial failed.
+	LocalAddr  net.Addr
+	RemoteAddr net.Addr
+
+	// Err is the error returned by the dialer, if any.
+	Err error
+}
+
+// ExtensionDoneInfo is passed to ClientTrace.ExtensionDone.
+type ExtensionDoneInfo struct {
+	Time time.Time
+
+	// Extension is the extension that processed the packet.
+	Extension Extension
+
+	// Response is true if the extension processed the response, and false
+	// if it processed the query.
+	Response bool
+
+	// Err is the error returned by the extension, if any.
+	Err error
+}
+
+// WroteQueryInfo is passed to ClientTrace.WroteQuery.
+type WroteQueryInfo struct {
+	Time time.Time
+
+	// Len is the length of the query packet, including extensions and
+	// MAC.
+	Len int
+
+	// Err is the error that occurred writing the query, if any.
+	Err error
+}
+
+// ReadResponseInfo is passed to ClientTrace.ReadResponse.
+type ReadResponseInfo struct {
+	Time time.Time
+
+	// Len is the length of the response packet.
+	Len int
+
+	// Err is the error that occurred reading the response, if any.
+	Err error
+}
+
+// ValidatedInfo is passed to ClientTrace.Validated.
+type ValidatedInfo struct {
+	Time time.Time
+
+	// Err is the error describing why the response is unsuitable for time
+	// synchronization, or nil if it is valid.
+	Err error
+}
+
+// AuthDoneInfo is passed to ClientTrace.AuthDone.
+type AuthDoneInfo struct {
+	Time time.Time
+
+	// Type and KeyID identify the algorithm and key used to authenticate
+	// the query.
+	Type  AuthType
+	KeyID uint16
+
+	// Err is the error that occurred authenticating the response, or nil
+	// if it was authenticated.
+	Err error
+}
+
+// The methods below call the corresponding hooks of a trace, which may be
+// nil.
+
+func (t *ClientTrace) dnsStart(host string) {
+	if t != nil && t.DNSStart != nil {
+		t.DNSStart(DNSStartInfo{Time: time.Now(), Host: host})
+	}
+}
+
+func (t *ClientTrace) dnsDone(addrs []net.IPAddr, err error) {
+	if t != nil && t.DNSDone != nil {
+		t.DNSDone(DNSDoneInfo{Time: time.Now(), Addrs: addrs, Err: err})
+	}
+}
+
+func (t *ClientTrace) dialDone(con net.Conn, err error) {
+	if t != nil && t.DialDone != nil {
+		info := DialDoneInfo{Time: time.Now(), Err: err}
+		if con != nil {
+			info.LocalAddr, info.RemoteAddr = con.LocalAddr(), con.RemoteAddr()
+		}
+		t.DialDone(info)
+	}
+}
+
+func (t *ClientTrace) extensionDone(e Extension, response bool, err error) {
+	if t != nil && t.ExtensionDone != nil {
+		t.ExtensionDone(ExtensionDoneInfo{Time: time.Now(), Extension: e, Response: response, Err: err})
+	}
+}
+
+func (t *ClientTrace) wroteQuery(n int, err error) {
+	if t != nil && t.WroteQuery != nil {
+		t.WroteQuery(WroteQueryInfo{Time: time.Now(), Len: n, Err: err})
+	}
+}
+
+func (t *ClientTrace) readResponse(n int, err error) {
+	if t != nil && t.ReadResponse != nil {
+		t.ReadResponse(ReadResponseInfo{Time: time.Now(), Len: n, Err: err})
+	}
+}
+
+func (t *ClientTrace) validated(err error) {
+	if t != nil && t.Validated != nil {
+		t.Validated(ValidatedInfo{Time: time.Now(), Err: err})
+	}
+}
+
+func (t *ClientTrace) authDone(opt AuthOptions, err error) {
+	if t != nil && t.AuthDone != nil {
+		t.AuthDone(AuthDoneInfo{Time: time.Now(), Type: opt.Type, KeyID: opt.KeyID, Err: err})
+	}
+}
+
+// resolve resolves the host of remoteAddress, which must include a port,
+// reporting the resolution to the trace's DNS hooks. It chooses an address
+// in the family of localAddress if it is set, and otherwise the address the
+// default dialer would choose. It returns remoteAddress with the host
+// replaced by the chosen address.
+func (t *ClientTrace) resolve(remoteAddress, localAddress string) (string, error) {
+	host, port, err := net.SplitHostPort(remoteAddress)
+	if err != nil {
+		return "", err
+	}
+	ip := host
+	if i := strings.IndexByte(host, '%'); i >= 0 {
+		ip = host[:i]
+	}
+	if net.ParseIP(ip) != nil {
+		return remoteAddress, nil
+	}
+
+	t.dnsStart(host)
+	addrs, err := net.DefaultResolver.LookupIPAddr(context.Background(), host)
+	t.dnsDone(addrs, err)
+	if err != nil {
+		return "", err
+	}
+
+	var laddr *net.UDPAddr
+	if localAddress != "" {
+		if laddr, err = net.ResolveUDPAddr("udp", net.JoinHostPort(localAddress, "0")); err != nil {
+			return "", err
+		}
+	}
+	chosen := chooseAddr(addrs, udpNetwork(laddr))
+	if chosen == nil {
+		return "", &net.AddrError{Err: "no suitable address found", Addr: host}
+	}
+	return net.JoinHostPort(chosen.String(), port), nil
+}
+
+// chooseAddr returns the address net.ResolveUDPAddr would choose from addrs
+// for the network: the first address of the network's family, or for
+// "udp", the first IPv4 address or else the first address. It returns nil
+// if there is no suitable address.
+func chooseAddr(addrs []net.IPAddr, network string) *net.IPAddr {
+	var chosen *net.IPAddr
+	for i, a := range addrs {
+		ipv4 := a.IP.To4() != nil
+		if (network == "udp4" && !ipv4) || (network == "udp6" && ipv4) {
+			continue
+		}
+		if chosen == nil || (network == "udp" && ipv4 && chosen.IP.To4() == nil) {
+			chosen = &addrs[i]
+		}
+	}
+	return chosen
+}
+
+// udpNetwork returns the network to which remote addresses must belong to
+// be reachable from laddr, which may be nil.
+func udpNetwork(laddr *net.UDPAddr) string {
+	switch {
+	case laddr == nil || laddr.IP == nil:
+		return "udp"
+	case laddr.IP.To4() != nil:
+		return "udp4"
+	default:
+		return "udp6"
+	}
+}
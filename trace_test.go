@@ -0,0 +1,146 @@
+// Copyright © 2015-2023 Brett Vickers.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ntp
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type nopExtension struct{ err error }
+
+func (e nopExtension) ProcessQuery(buf *bytes.Buffer) error { return nil }
+func (e nopExtension) ProcessResponse(buf []byte) error     { return e.err }
+
+// eventTrace returns a trace that records the names of the events reported
+// to it, and checks that their times are non-decreasing.
+func eventTrace(t *testing.T, events *[]string) *ClientTrace {
+	var last time.Time
+	add := func(name string, tm time.Time) {
+		assert.False(t, tm.Before(last), name)
+		last = tm
+		*events = append(*events, name)
+	}
+	return &ClientTrace{
+		DNSStart: func(i DNSStartInfo) { add("dns start "+i.Host, i.Time) },
+		DNSDone: func(i DNSDoneInfo) {
+			assert.Nil(t, i.Err)
+			assert.NotEmpty(t, i.Addrs)
+			add("dns done", i.Time)
+		},
+		DialDone: func(i DialDoneInfo) {
+			assert.Nil(t, i.Err)
+			assert.NotNil(t, i.LocalAddr)
+			assert.NotNil(t, i.RemoteAddr)
+			add("dial", i.Time)
+		},
+		ExtensionDone: func(i ExtensionDoneInfo) {
+			if i.Response {
+				add("extension response", i.Time)
+			} else {
+				add("extension query", i.Time)
+			}
+		},
+		WroteQuery:   func(i WroteQueryInfo) { add("wrote", i.Time) },
+		ReadResponse: func(i ReadResponseInfo) { add("read", i.Time) },
+		Validated: func(i ValidatedInfo) {
+			if i.Err != nil {
+				add("invalid", i.Time)
+			} else {
+				add("valid", i.Time)
+			}
+		},
+		AuthDone: func(i AuthDoneInfo) {
+			assert.Equal(t, AuthSHA1, i.Type)
+			assert.Equal(t, uint16(1), i.KeyID)
+			add("auth", i.Time)
+		},
+	}
+}
+
+func TestOfflineClientTrace(t *testing.T) {
+	s := NewServer(ServerState{Stratum: 1})
+	s.KeyRing = NewKeyRing(Key{ID: 1, Type: AuthSHA1, Secret: []byte("0123456789abcdef")})
+	s.KeyRing.SetTrusted(1)
+	addr := startTestServer(t, s)
+
+	var events []string
+	opt := QueryOptions{
+		Timeout:    time.Second,
+		Auth:       AuthOptions{KeyRing: s.KeyRing, KeyID: 1},
+		Extensions: []Extension{nopExtension{}},
+		Trace:      eventTrace(t, &events),
+	}
+	_, err := QueryWithOptions(addr, opt)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{
+		"dial", "extension query", "wrote", "read", "extension response", "auth", "valid",
+	}, events)
+
+	// Host names are resolved when the default dialer is used.
+	_, port, _ := net.SplitHostPort(addr)
+	events = nil
+	opt.Auth = AuthOptions{}
+	opt.Extensions = nil
+	_, err = QueryWithOptions(net.JoinHostPort("localhost", port), opt)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"dns start localhost", "dns done", "dial", "wrote", "read", "valid"}, events)
+}
+
+func TestOfflineChooseAddr(t *testing.T) {
+	addrs := []net.IPAddr{
+		{IP: net.ParseIP("2001:db8::1")},
+		{IP: net.ParseIP("192.0.2.1")},
+		{IP: net.ParseIP("192.0.2.2")},
+	}
+	assert.Equal(t, &addrs[1], chooseAddr(addrs, "udp"))
+	assert.Equal(t, &addrs[1], chooseAddr(addrs, "udp4"))
+	assert.Equal(t, &addrs[0], chooseAddr(addrs, "udp6"))
+	assert.Equal(t, &addrs[0], chooseAddr(addrs[:1], "udp"))
+	assert.Nil(t, chooseAddr(addrs[1:], "udp6"))
+	assert.Equal(t, "udp6", udpNetwork(&net.UDPAddr{IP: net.ParseIP("::1")}))
+}
+
+func TestOfflineClientTraceFailure(t *testing.T) {
+	s := NewServer(ServerState{Stratum: 1})
+	addr := startTestServer(t, s)
+
+	var events []string
+	extErr := errors.New("extension failed")
+	opt := QueryOptions{
+		Timeout:    time.Second,
+		Extensions: []Extension{nopExtension{err: extErr}},
+		Trace:      eventTrace(t, &events),
+	}
+	_, err := QueryWithOptions(addr, opt)
+	assert.ErrorIs(t, err, extErr)
+	assert.Equal(t, []string{"dial", "extension query", "wrote", "read", "extension response"}, events)
+
+	// Responses failing the origin check are reported as invalid.
+	events = nil
+	f := NewFaultInjector(1)
+	f.SpoofOrigin = 1
+	opt = f.Options(QueryOptions{Timeout: time.Second, Trace: eventTrace(t, &events)})
+	_, err = QueryWithOptions(addr, opt)
+	assert.ErrorIs(t, err, ErrServerResponseMismatch)
+	assert.Equal(t, []string{"dial", "wrote", "read", "invalid"}, events)
+
+	var readErr error
+	s = NewServer(ServerState{Stratum: 1})
+	s.Access = NewAccessList(AccessRule{Flags: RestrictIgnore})
+	addr = startTestServer(t, s)
+	opt = QueryOptions{
+		Timeout: 50 * time.Millisecond,
+		Trace:   &ClientTrace{ReadResponse: func(i ReadResponseInfo) { readErr = i.Err }},
+	}
+	_, err = QueryWithOptions(addr, opt)
+	assert.NotNil(t, err)
+	assert.NotNil(t, readErr)
+}